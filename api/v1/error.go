@@ -0,0 +1,53 @@
+package distributed_services_with_go
+
+import "fmt"
+
+// ErrOffsetOutOfRange is returned when reading an offset that isn't in the
+// log, either because it was truncated or because it hasn't been written yet.
+type ErrOffsetOutOfRange struct {
+	Offset uint64
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return fmt.Sprintf("offset out of range: %d", e.Offset)
+}
+
+// ErrSequenceOutOfOrder is returned when appending a record whose sequence is
+// lower than the last one appended by its producer, and isn't one of its
+// recent ones. It's a duplicate of a record whose offset the log no longer
+// knows, or the producer is reusing sequence numbers.
+type ErrSequenceOutOfOrder struct {
+	ProducerID string
+	Sequence   uint64
+	Last       uint64
+}
+
+func (e ErrSequenceOutOfOrder) Error() string {
+	return fmt.Sprintf("producer %q sequence %d is before its last sequence %d",
+		e.ProducerID, e.Sequence, e.Last)
+}
+
+// ErrSequenceGap is returned when appending a record whose sequence skips
+// ahead of the one after the last appended by its producer. The records in
+// between never reached the log, so it would be missing them.
+type ErrSequenceGap struct {
+	ProducerID string
+	Sequence   uint64
+	Last       uint64
+}
+
+func (e ErrSequenceGap) Error() string {
+	return fmt.Sprintf("producer %q sequence %d doesn't follow its last sequence %d",
+		e.ProducerID, e.Sequence, e.Last)
+}
+
+// ErrTransactionNotFound is returned when appending to, committing or
+// aborting a transaction that isn't open: it was never begun, it has ended
+// already, or it timed out.
+type ErrTransactionNotFound struct {
+	ID string
+}
+
+func (e ErrTransactionNotFound) Error() string {
+	return fmt.Sprintf("transaction %q not found", e.ID)
+}
@@ -0,0 +1,34 @@
+package distributed_services_with_go
+
+// The media types the HTTP API's bodies can be sent in. Protobuf skips
+// JSON's parsing and the base64 encoding of record values, so it suits
+// high-throughput producers; JSON is the default.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	// ContentTypeRawRecords is the body of a raw consume. All integers are
+	// big-endian uint64s. The body is the number of records, then where
+	// each record starts relative to the first, then the records as the log
+	// stores them, each its length followed by the record encoded as JSON.
+	ContentTypeRawRecords = "application/x-log-records"
+)
+
+// Error codes identify what went wrong in an ErrorResponse. Unlike the
+// messages, they won't change, so clients can act on them.
+const (
+	CodeBadRequest          = "bad_request"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeOffsetOutOfRange    = "offset_out_of_range"
+	CodeSequenceOutOfOrder  = "sequence_out_of_order"
+	CodeSequenceGap         = "sequence_gap"
+	CodeTransactionNotFound = "transaction_not_found"
+	CodeRawUnavailable      = "raw_unavailable"
+	CodeRecovering          = "recovering"
+	CodeInternal            = "internal"
+	// CodeUnsupportedMediaType is returned for a request body that isn't
+	// JSON or protobuf, and CodeNotAcceptable when the Accept header rules
+	// out both for the response.
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeNotAcceptable        = "not_acceptable"
+)
@@ -0,0 +1,281 @@
+// Package client talks to the log's HTTP server, so that callers don't have
+// to build requests and decode responses by hand.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// ErrOffsetNotFound is returned when the server has no record at the
+// requested offset, which usually means the consumer has caught up.
+var ErrOffsetNotFound = errors.New("offset not found")
+
+// ErrTransactionNotFound is returned when appending to, committing or
+// aborting a transaction the server doesn't have open, e.g. because it timed
+// out.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// StatusError is returned when the server answers with an unexpected status.
+// Code is the error code from the server's response, one of the api.Code
+// constants, if it sent one.
+type StatusError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// LastSequence comes with api.CodeSequenceGap errors: it's the sequence
+	// of the producer's last record in the log.
+	LastSequence *uint64
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned %d %s: %s",
+		e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// temporary reports whether retrying the request that failed with err might
+// succeed: network errors and 5xx responses are worth retrying, requests the
+// server rejected aren't.
+func temporary(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// httpClient makes the requests shared by the producer and the consumer.
+type httpClient struct {
+	addr   string
+	client *http.Client
+}
+
+func newHTTPClient(addr string, client *http.Client) *httpClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpClient{addr: strings.TrimSuffix(addr, "/"), client: client}
+}
+
+func (c *httpClient) produce(ctx context.Context, record *api.Record) (uint64, error) {
+	req := &api.ProduceRequest{Record: record}
+	res := &api.ProduceResponse{}
+	if err := c.do(ctx, http.MethodPost, "/records", req, res); err != nil {
+		return 0, transactionError(err)
+	}
+	return res.Offset, nil
+}
+
+// produceBatch appends the records in one request and returns their offsets.
+func (c *httpClient) produceBatch(ctx context.Context, records []*api.Record) ([]uint64, error) {
+	req := &api.ProduceBatchRequest{Records: records}
+	res := &api.ProduceBatchResponse{}
+	if err := c.do(ctx, http.MethodPost, "/records/batch", req, res); err != nil {
+		return nil, transactionError(err)
+	}
+	if len(res.Offsets) != len(records) {
+		return nil, fmt.Errorf("server returned %d offsets for %d records", len(res.Offsets), len(records))
+	}
+	return res.Offsets, nil
+}
+
+// consume reads the record at offset or, if readCommitted is set, the first
+// record from offset on that's visible to read-committed consumers.
+func (c *httpClient) consume(ctx context.Context, offset uint64, readCommitted bool) (*api.Record, error) {
+	res := &api.ConsumeResponse{}
+	path := "/records/" + strconv.FormatUint(offset, 10)
+	if readCommitted {
+		path += "?isolation=read_committed"
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, res); err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.Code == api.CodeOffsetOutOfRange {
+			return nil, ErrOffsetNotFound
+		}
+		return nil, err
+	}
+	if res.Record == nil {
+		return nil, fmt.Errorf("server returned no record for offset %d", offset)
+	}
+	return res.Record, nil
+}
+
+// errRawUnavailable is returned by consumeRaw when the records at the offset
+// have to be consumed one by one.
+var errRawUnavailable = errors.New("records aren't available raw")
+
+// consumeRaw reads the records from offset on, about maxBytes of them, as the
+// log stores them. See api.ContentTypeRawRecords for the body.
+func (c *httpClient) consumeRaw(ctx context.Context, offset uint64, maxBytes int) ([]*api.Record, error) {
+	path := fmt.Sprintf("/records/%d/raw?max_bytes=%d", offset, maxBytes)
+	req, err := http.NewRequest(http.MethodGet, c.addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	// errors still come as messages
+	req.Header.Set("Accept", api.ContentTypeRawRecords+", "+api.ContentTypeProtobuf)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err := statusError(res)
+		switch err.Code {
+		case api.CodeOffsetOutOfRange:
+			return nil, ErrOffsetNotFound
+		case api.CodeRawUnavailable:
+			return nil, errRawUnavailable
+		}
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRawRecords(b)
+}
+
+// decodeRawRecords decodes the body of a raw consume.
+func decodeRawRecords(b []byte) ([]*api.Record, error) {
+	malformed := errors.New("malformed raw records")
+	if len(b) < 8 {
+		return nil, malformed
+	}
+	n := binary.BigEndian.Uint64(b)
+	if n == 0 || n > uint64(len(b)-8)/8 {
+		return nil, malformed
+	}
+	positions, data := b[8:8+8*n], b[8+8*n:]
+	records := make([]*api.Record, 0, n)
+	for i := uint64(0); i < n; i++ {
+		pos := binary.BigEndian.Uint64(positions[8*i:])
+		if pos > uint64(len(data)) || uint64(len(data))-pos < 8 {
+			return nil, malformed
+		}
+		size := binary.BigEndian.Uint64(data[pos:])
+		if size > uint64(len(data))-pos-8 {
+			return nil, malformed
+		}
+		record := &api.Record{}
+		if err := json.Unmarshal(data[pos+8:pos+8+size], record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (c *httpClient) offsets(ctx context.Context) (lowest, highest uint64, err error) {
+	res := &api.OffsetsResponse{}
+	if err = c.do(ctx, http.MethodGet, "/offsets", nil, res); err != nil {
+		return 0, 0, err
+	}
+	return res.Lowest, res.Highest, nil
+}
+
+func (c *httpClient) beginTransaction(ctx context.Context) (string, error) {
+	res := &api.BeginTransactionResponse{}
+	if err := c.do(ctx, http.MethodPost, "/transactions", nil, res); err != nil {
+		return "", err
+	}
+	return res.TransactionId, nil
+}
+
+// endTransaction commits or aborts a transaction, depending on action.
+func (c *httpClient) endTransaction(ctx context.Context, id, action string) (uint64, error) {
+	res := &api.EndTransactionResponse{}
+	path := "/transactions/" + url.PathEscape(id) + "/" + action
+	if err := c.do(ctx, http.MethodPost, path, nil, res); err != nil {
+		return 0, transactionError(err)
+	}
+	return res.Offset, nil
+}
+
+// transactionError turns the server's transaction_not_found errors into
+// ErrTransactionNotFound.
+func transactionError(err error) error {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == api.CodeTransactionNotFound {
+		return ErrTransactionNotFound
+	}
+	return err
+}
+
+// do makes a request, sending body and decoding the response into v as
+// protobuf, which saves encoding record values as base64 JSON strings.
+func (c *httpClient) do(ctx context.Context, method, path string, body, v proto.Message) error {
+	var r io.Reader
+	if body != nil {
+		b, err := proto.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.addr+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", api.ContentTypeProtobuf)
+	}
+	req.Header.Set("Accept", api.ContentTypeProtobuf)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return statusError(res)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, v)
+}
+
+// statusError reads the error from an unsuccessful response. Proxies in front
+// of the server may not answer with an api.ErrorResponse, so it falls back to
+// the body's text.
+func statusError(res *http.Response) *StatusError {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	errRes := &api.ErrorResponse{}
+	var err error
+	switch mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt {
+	case api.ContentTypeProtobuf:
+		err = proto.Unmarshal(b, errRes)
+	case api.ContentTypeJSON:
+		err = protojson.Unmarshal(b, errRes)
+	default:
+		err = errors.New("not an error response")
+	}
+	if err == nil && errRes.Code != "" {
+		return &StatusError{
+			StatusCode:   res.StatusCode,
+			Code:         errRes.Code,
+			Message:      errRes.Message,
+			LastSequence: errRes.LastSequence,
+		}
+	}
+	return &StatusError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(b))}
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// ConsumerConfig configures a Consumer. Zero values get the defaults noted on
+// each field.
+type ConsumerConfig struct {
+	// Addr is the server's base URL, e.g. "http://localhost:8080".
+	Addr string
+	// Offset is the offset of the first record to consume.
+	Offset uint64
+	// MaxRecords is the most records returned by one Poll. Defaults to 100.
+	MaxRecords int
+	// PollInterval is how long Run waits before polling again once it has
+	// caught up with the log, or while paused. Defaults to 100ms.
+	PollInterval time.Duration
+	// Client is the HTTP client used for requests, http.DefaultClient if nil.
+	Client *http.Client
+	// ReadCommitted makes the consumer skip the records of aborted
+	// transactions and wait for open transactions to end, rather than
+	// returning every record as it's appended. Transactions' commit and
+	// abort markers are skipped either way.
+	ReadCommitted bool
+	// FetchBytes, if set, makes Poll fetch records in runs of about that
+	// many bytes, copied straight from the log's files by the server,
+	// rather than with a request per record. It suits consumers catching up
+	// on a lot of records. Records the server can't send that way, such as
+	// encrypted ones, are read one by one. It's ignored with ReadCommitted,
+	// which needs the server to filter the records.
+	FetchBytes int
+}
+
+// Consumer reads records from the server in order, keeping track of the
+// offset of the next record to read.
+type Consumer struct {
+	config ConsumerConfig
+	http   *httpClient
+
+	mu     sync.Mutex
+	offset uint64
+	paused bool
+}
+
+func NewConsumer(c ConsumerConfig) *Consumer {
+	if c.MaxRecords <= 0 {
+		c.MaxRecords = 100
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = 100 * time.Millisecond
+	}
+	return &Consumer{
+		config: c,
+		http:   newHTTPClient(c.Addr, c.Client),
+		offset: c.Offset,
+	}
+}
+
+// Poll returns the records from the consumer's offset on, up to MaxRecords of
+// them, and advances the offset past them. It returns no records if the
+// consumer is paused or has caught up with the log.
+func (c *Consumer) Poll(ctx context.Context) ([]*api.Record, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return nil, nil
+	}
+	var records []*api.Record
+	for len(records) < c.config.MaxRecords {
+		fetched, err := c.fetch(ctx)
+		if err == ErrOffsetNotFound {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		for _, record := range fetched {
+			if len(records) == c.config.MaxRecords {
+				// the rest are fetched again by the next Poll
+				break
+			}
+			c.offset = record.Offset + 1
+			if record.Control != api.Control_CONTROL_NONE {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// fetch reads the records at the consumer's offset: a run of them if
+// FetchBytes is set and the server can send them raw, one otherwise. The
+// caller must hold mu.
+func (c *Consumer) fetch(ctx context.Context) ([]*api.Record, error) {
+	if c.config.FetchBytes > 0 && !c.config.ReadCommitted {
+		records, err := c.http.consumeRaw(ctx, c.offset, c.config.FetchBytes)
+		if err != errRawUnavailable {
+			return records, err
+		}
+	}
+	record, err := c.http.consume(ctx, c.offset, c.config.ReadCommitted)
+	if err != nil {
+		return nil, err
+	}
+	return []*api.Record{record}, nil
+}
+
+// Run polls in a loop, calling handle with each record, until the context is
+// done or handle returns an error. A record whose handler fails is read again
+// by the next Poll.
+func (c *Consumer) Run(ctx context.Context, handle func(*api.Record) error) error {
+	for {
+		records, err := c.Poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		for _, record := range records {
+			if err = handle(record); err != nil {
+				c.Seek(record.Offset)
+				return err
+			}
+		}
+		if len(records) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.config.PollInterval):
+		}
+	}
+}
+
+// Offsets returns the offsets of the first and the last record in the log.
+func (c *Consumer) Offsets(ctx context.Context) (lowest, highest uint64, err error) {
+	return c.http.offsets(ctx)
+}
+
+// Offset returns the offset of the next record the consumer will read.
+func (c *Consumer) Offset() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// Seek moves the consumer to the given offset.
+func (c *Consumer) Seek(offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = offset
+}
+
+// Pause stops Poll from returning records until Resume is called.
+func (c *Consumer) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+}
+
+func (c *Consumer) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+}
+
+func (c *Consumer) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
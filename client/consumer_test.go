@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func produce(t *testing.T, addr string, n int) {
+	t.Helper()
+	p := NewProducer(ProducerConfig{Addr: addr})
+	for i := 0; i < n; i++ {
+		require.NoError(t, p.Send(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))}, nil))
+	}
+	require.NoError(t, p.Close())
+}
+
+func TestConsumerPoll(t *testing.T) {
+	srv := newTestServer(t)
+	produce(t, srv.URL, 5)
+
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL, Offset: 1, MaxRecords: 3})
+	lowest, highest, err := c.Offsets(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(4), highest)
+
+	records, err := c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	for i, record := range records {
+		require.Equal(t, uint64(i+1), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i+1)), record.Value)
+	}
+	require.Equal(t, uint64(4), c.Offset())
+
+	// a paused consumer doesn't return records or advance
+	c.Pause()
+	require.True(t, c.Paused())
+	records, err = c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(4), c.Offset())
+	c.Resume()
+
+	// the consumer stops at the end of the log
+	records, err = c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	records, err = c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(5), c.Offset())
+}
+
+func TestConsumerPollRaw(t *testing.T) {
+	srv := newTestServer(t)
+	produce(t, srv.URL, 20)
+
+	// the records span several segments, and a raw fetch stops at the end
+	// of one
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL, Offset: 1, MaxRecords: 15, FetchBytes: 1 << 20})
+	records, err := c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 15)
+	records2, err := c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records2, 4)
+	for i, record := range append(records, records2...) {
+		require.Equal(t, uint64(i+1), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i+1)), record.Value)
+	}
+	records, err = c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(20), c.Offset())
+}
+
+func TestConsumerRun(t *testing.T) {
+	srv := newTestServer(t)
+	produce(t, srv.URL, 3)
+
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL, PollInterval: time.Millisecond})
+	errStop := errors.New("stop")
+	var seen []uint64
+	err := c.Run(context.Background(), func(record *api.Record) error {
+		if record.Offset == 4 {
+			return errStop
+		}
+		seen = append(seen, record.Offset)
+		if record.Offset == 2 {
+			// records produced while running are picked up by later polls
+			produce(t, srv.URL, 2)
+		}
+		return nil
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, []uint64{0, 1, 2, 3}, seen)
+	// the record that failed is read again next time
+	require.Equal(t, uint64(4), c.Offset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = c.Run(ctx, func(record *api.Record) error { return nil })
+	require.Equal(t, context.DeadlineExceeded, err)
+}
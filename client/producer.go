@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// ErrProducerClosed is returned by Send after Close is called.
+var ErrProducerClosed = errors.New("producer closed")
+
+// ProducerConfig configures a Producer. Zero values get the defaults noted
+// on each field.
+type ProducerConfig struct {
+	// Addr is the server's base URL, e.g. "http://localhost:8080".
+	Addr string
+	// BatchSize is the most records sent in one batch. Defaults to 100.
+	BatchSize int
+	// Linger is how long the producer waits for a batch to fill up before
+	// sending it anyway. Defaults to 5ms.
+	Linger time.Duration
+	// MaxRetries is how many times a batch is retried after a temporary
+	// failure before its records' callbacks get the error. Defaults to 3; set it
+	// negative to disable retries.
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubling on every retry
+	// up to MaxBackoff. Defaults to 100ms and 5s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Client is the HTTP client used for requests, http.DefaultClient if nil.
+	Client *http.Client
+	// ProducerID identifies the producer to the log, which numbers its
+	// records so a retried record is only appended once. Defaults to a
+	// random ID. A producer restarting with the same ID must start from
+	// where it left off with FirstSequence.
+	ProducerID string
+	// FirstSequence is the sequence number of the first record sent.
+	FirstSequence uint64
+}
+
+// Callback is called once a record was delivered, with its offset, or once
+// the producer gave up on it, with the error.
+type Callback func(offset uint64, err error)
+
+// Producer sends records to the server asynchronously. Records are sent in
+// the order Send was called, in batches of up to BatchSize records, each
+// batch in one request.
+type Producer struct {
+	config ProducerConfig
+	http   *httpClient
+
+	// mu guards closed and pending, the number of records sent but not yet
+	// delivered or failed. flushed is signaled when pending drops to 0.
+	mu      sync.Mutex
+	flushed *sync.Cond
+	closed  bool
+	pending int
+
+	queue chan *send
+	done  chan struct{}
+
+	// sequence is the sequence number of the next record to send, and
+	// unsure how many of the numbers before it went to records that failed
+	// without the producer knowing whether they were appended. They're
+	// only used by the producer's goroutine.
+	sequence uint64
+	unsure   uint64
+}
+
+type send struct {
+	record   *api.Record
+	callback Callback
+}
+
+func NewProducer(c ProducerConfig) *Producer {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.Linger <= 0 {
+		c.Linger = 5 * time.Millisecond
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 3
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 5 * time.Second
+	}
+	if c.ProducerID == "" {
+		c.ProducerID = newProducerID()
+	}
+	p := &Producer{
+		config:   c,
+		http:     newHTTPClient(c.Addr, c.Client),
+		queue:    make(chan *send, c.BatchSize),
+		done:     make(chan struct{}),
+		sequence: c.FirstSequence,
+	}
+	p.flushed = sync.NewCond(&p.mu)
+	go p.run()
+	return p
+}
+
+// Send queues the record to be sent, blocking while BatchSize records are
+// queued already. The record is sent with the producer's ID and the next
+// sequence number in place of its own. The callback, which may be nil, is
+// called from the producer's goroutine once the record is delivered or has
+// failed for good, so it shouldn't block.
+func (p *Producer) Send(record *api.Record, callback Callback) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProducerClosed
+	}
+	p.pending++
+	p.mu.Unlock()
+	p.queue <- &send{record: record, callback: callback}
+	return nil
+}
+
+// ProducerID returns the ID the producer numbers its records under.
+func (p *Producer) ProducerID() string {
+	return p.config.ProducerID
+}
+
+// Flush blocks until every record sent so far was delivered or failed.
+func (p *Producer) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.pending > 0 {
+		p.flushed.Wait()
+	}
+}
+
+// Close flushes the queued records and stops the producer. Send fails once
+// Close is called.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	p.Flush()
+	close(p.queue)
+	<-p.done
+	return nil
+}
+
+// run collects sends into batches, sending a batch once it's full or once
+// Linger has passed since its first record was queued.
+func (p *Producer) run() {
+	defer close(p.done)
+	var batch []*send
+	var linger <-chan time.Time
+	for {
+		select {
+		case s, ok := <-p.queue:
+			if !ok {
+				p.sendBatch(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) == 1 {
+				linger = time.After(p.config.Linger)
+			}
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+		case <-linger:
+		}
+		p.sendBatch(batch)
+		batch, linger = nil, nil
+	}
+}
+
+// sendBatch sends the batch's records, with the producer's ID in place of
+// their own, and calls their callbacks.
+func (p *Producer) sendBatch(batch []*send) {
+	if len(batch) == 0 {
+		return
+	}
+	records := make([]*api.Record, len(batch))
+	for i, s := range batch {
+		records[i] = proto.Clone(s.record).(*api.Record)
+		records[i].ProducerId = p.config.ProducerID
+	}
+	offs, err := p.sendNumbered(records)
+	for i, s := range batch {
+		if s.callback == nil {
+			continue
+		}
+		if err != nil {
+			s.callback(0, err)
+		} else {
+			s.callback(offs[i], nil)
+		}
+	}
+	p.mu.Lock()
+	if p.pending -= len(batch); p.pending == 0 {
+		p.flushed.Broadcast()
+	}
+	p.mu.Unlock()
+}
+
+// sendNumbered numbers the records consecutively and sends them. Records are
+// numbered as they're sent rather than when Send is called, so the numbers
+// are in the order the log sees them, and the log rejects a number that
+// skips ahead. A retry is sent with the same numbers, and the log answers it
+// with the original offsets if an earlier attempt was appended after all.
+func (p *Producer) sendNumbered(records []*api.Record) ([]uint64, error) {
+	number := func() {
+		for i, record := range records {
+			record.Sequence = p.sequence + uint64(i)
+		}
+	}
+	number()
+	offs, err := p.sendWithRetries(records)
+	var statusErr *StatusError
+	if p.unsure > 0 && errors.As(err, &statusErr) && statusErr.Code == api.CodeSequenceGap &&
+		statusErr.LastSequence != nil {
+		// some of the records before these weren't appended after all, so
+		// these take over their numbers
+		if next := *statusErr.LastSequence + 1; next < p.sequence && p.sequence-next <= p.unsure {
+			p.sequence, p.unsure = next, 0
+			number()
+			offs, err = p.sendWithRetries(records)
+		}
+	}
+	n := uint64(len(records))
+	switch {
+	case err == nil:
+		p.sequence += n
+		p.unsure = 0
+	case errors.As(err, &statusErr) && statusErr.StatusCode < 500:
+		// the log rejected the records, so the next ones can have their
+		// numbers
+	default:
+		// the records may have been appended before the response was
+		// lost, so their numbers can't be reused until the log says they
+		// weren't
+		p.sequence += n
+		p.unsure += n
+	}
+	return offs, err
+}
+
+func (p *Producer) sendWithRetries(records []*api.Record) ([]uint64, error) {
+	backoff := p.config.Backoff
+	for attempt := 0; ; attempt++ {
+		offs, err := p.http.produceBatch(context.Background(), records)
+		if err == nil || !temporary(err) || attempt >= p.config.MaxRetries {
+			return offs, err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.MaxBackoff {
+			backoff = p.config.MaxBackoff
+		}
+	}
+}
+
+func newProducerID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
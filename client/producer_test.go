@@ -0,0 +1,278 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+	"github.com/MRSharff/distributed-services-with-go/server"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	srv := httptest.NewServer(server.NewHTTPServer("", server.Config{CommitLog: clog}).Handler)
+	t.Cleanup(func() {
+		srv.Close()
+		require.NoError(t, clog.Remove())
+	})
+	return srv
+}
+
+func TestProducer(t *testing.T) {
+	srv := newTestServer(t)
+	p := NewProducer(ProducerConfig{Addr: srv.URL})
+
+	var mu sync.Mutex
+	offsets := make(map[string]uint64)
+	for i := 0; i < 10; i++ {
+		value := fmt.Sprintf("record %d", i)
+		err := p.Send(&api.Record{Value: []byte(value)}, func(off uint64, err error) {
+			require.NoError(t, err)
+			mu.Lock()
+			offsets[value] = off
+			mu.Unlock()
+		})
+		require.NoError(t, err)
+	}
+	p.Flush()
+
+	// records are delivered in the order they were sent
+	require.Len(t, offsets, 10)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, uint64(i), offsets[fmt.Sprintf("record %d", i)])
+	}
+
+	require.NoError(t, p.Close())
+	require.Equal(t, ErrProducerClosed, p.Send(&api.Record{}, nil))
+}
+
+func TestProducerBatches(t *testing.T) {
+	srv := newTestServer(t)
+	// batches records the size of each batch the server gets
+	var mu sync.Mutex
+	var batches []int
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		req := &api.ProduceBatchRequest{}
+		if err == nil {
+			err = proto.Unmarshal(b, req)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, len(req.Records))
+		mu.Unlock()
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+	sent := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), batches...)
+	}
+	send := func(p *Producer, n int) <-chan error {
+		done := make(chan error, n)
+		for i := 0; i < n; i++ {
+			require.NoError(t, p.Send(&api.Record{Value: []byte("hello")}, func(off uint64, err error) {
+				done <- err
+			}))
+		}
+		return done
+	}
+
+	t.Run("full", func(t *testing.T) {
+		// a full batch is sent without waiting out the linger
+		p := NewProducer(ProducerConfig{Addr: counting.URL, BatchSize: 3, Linger: time.Hour})
+		defer p.Close()
+		done := send(p, 6)
+		for i := 0; i < 6; i++ {
+			require.NoError(t, <-done)
+		}
+		require.Equal(t, []int{3, 3}, sent())
+	})
+
+	t.Run("linger", func(t *testing.T) {
+		mu.Lock()
+		batches = nil
+		mu.Unlock()
+		const linger = 50 * time.Millisecond
+		p := NewProducer(ProducerConfig{Addr: counting.URL, BatchSize: 100, Linger: linger})
+		defer p.Close()
+		start := time.Now()
+		done := send(p, 2)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, <-done)
+		}
+		// a batch that doesn't fill up is sent once the linger runs out
+		require.GreaterOrEqual(t, time.Since(start), linger)
+		require.Equal(t, []int{2}, sent())
+	})
+
+	// the batches were numbered one after another
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL})
+	records, err := c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 8)
+	for i, record := range records[:6] {
+		require.Equal(t, uint64(i), record.Sequence)
+	}
+}
+
+func TestProducerRetries(t *testing.T) {
+	srv := newTestServer(t)
+	// fail the first two attempts with a temporary error
+	var mu sync.Mutex
+	failures := 2
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failures > 0
+		failures--
+		mu.Unlock()
+		if fail {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	p := NewProducer(ProducerConfig{Addr: flaky.URL, Backoff: time.Millisecond})
+	defer p.Close()
+	done := make(chan error, 1)
+	require.NoError(t, p.Send(&api.Record{Value: []byte("hello")}, func(off uint64, err error) {
+		done <- err
+	}))
+	require.NoError(t, <-done)
+
+	// the producer gives up after MaxRetries
+	mu.Lock()
+	failures = 10
+	mu.Unlock()
+	p = NewProducer(ProducerConfig{Addr: flaky.URL, Backoff: time.Millisecond, MaxRetries: 2})
+	defer p.Close()
+	require.NoError(t, p.Send(&api.Record{Value: []byte("hello")}, func(off uint64, err error) {
+		done <- err
+	}))
+	err := <-done
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, err.(*StatusError).StatusCode)
+	require.Equal(t, 7, failures)
+}
+
+func TestProducerFailureLeavesNoGap(t *testing.T) {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	down := false
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := down
+		mu.Unlock()
+		if fail {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	p := NewProducer(ProducerConfig{Addr: flaky.URL, Backoff: time.Millisecond, MaxRetries: 1})
+	defer p.Close()
+	send := func(record *api.Record) (uint64, error) {
+		done := make(chan error, 1)
+		var off uint64
+		require.NoError(t, p.Send(record, func(o uint64, err error) {
+			off = o
+			done <- err
+		}))
+		return off, <-done
+	}
+	_, err := send(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	// the record is sent as it is, so the server rejects a control record,
+	// and the next record can have its number
+	_, err = send(&api.Record{Value: []byte("commit"), Control: api.Control_CONTROL_COMMIT})
+	require.Equal(t, http.StatusBadRequest, err.(*StatusError).StatusCode)
+	// the second record fails for good, without the producer knowing it
+	// never reached the log
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	_, err = send(&api.Record{Value: []byte("second")})
+	require.Error(t, err)
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	// the log rejects the third record's number as skipping the second's,
+	// so the producer gives the third that number instead
+	off, err := send(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL})
+	records, err := c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "third", string(records[1].Value))
+	require.Equal(t, uint64(1), records[1].Sequence)
+}
+
+func TestProducerRetriesAreIdempotent(t *testing.T) {
+	srv := newTestServer(t)
+	// append the first attempt but lose its response, as if it timed out
+	var mu sync.Mutex
+	lost := 1
+	lossy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lose := lost > 0
+		lost--
+		mu.Unlock()
+		if lose {
+			srv.Config.Handler.ServeHTTP(httptest.NewRecorder(), r)
+			http.Error(w, "timed out", http.StatusGatewayTimeout)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer lossy.Close()
+
+	p := NewProducer(ProducerConfig{Addr: lossy.URL, Backoff: time.Millisecond})
+	defer p.Close()
+	offsets := make(chan uint64, 2)
+	for _, value := range []string{"first", "second"} {
+		require.NoError(t, p.Send(&api.Record{Value: []byte(value)}, func(off uint64, err error) {
+			require.NoError(t, err)
+			offsets <- off
+		}))
+	}
+	require.Equal(t, uint64(0), <-offsets)
+	require.Equal(t, uint64(1), <-offsets)
+
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL})
+	_, highest, err := c.Offsets(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), highest)
+	records, err := c.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, p.ProducerID(), records[0].ProducerId)
+	require.Equal(t, uint64(0), records[0].Sequence)
+	require.Equal(t, uint64(1), records[1].Sequence)
+}
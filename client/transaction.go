@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// TransactionConfig configures the connection a Transaction is made over.
+type TransactionConfig struct {
+	// Addr is the server's base URL, e.g. "http://localhost:8080".
+	Addr string
+	// Client is the HTTP client used for requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Transaction appends records that consumers with ReadCommitted set see all
+// together once it's committed, or never if it's aborted. The server aborts
+// a transaction nothing has been appended to for a while, after which its
+// methods return ErrTransactionNotFound.
+type Transaction struct {
+	id   string
+	http *httpClient
+}
+
+// BeginTransaction opens a transaction on the server.
+func BeginTransaction(ctx context.Context, c TransactionConfig) (*Transaction, error) {
+	http := newHTTPClient(c.Addr, c.Client)
+	id, err := http.beginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{id: id, http: http}, nil
+}
+
+// ID returns the transaction's ID, which its records carry as their
+// TransactionId.
+func (t *Transaction) ID() string {
+	return t.id
+}
+
+// Append appends the record to the transaction and returns its offset. Unlike
+// a Producer's, appends aren't retried.
+func (t *Transaction) Append(ctx context.Context, record *api.Record) (uint64, error) {
+	record = proto.Clone(record).(*api.Record)
+	record.TransactionId = t.id
+	return t.http.produce(ctx, record)
+}
+
+// Commit ends the transaction, making its records visible to read-committed
+// consumers. It returns the offset of the commit marker.
+func (t *Transaction) Commit(ctx context.Context) (uint64, error) {
+	return t.http.endTransaction(ctx, t.id, "commit")
+}
+
+// Abort ends the transaction, hiding its records from read-committed
+// consumers. It returns the offset of the abort marker.
+func (t *Transaction) Abort(ctx context.Context) (uint64, error) {
+	return t.http.endTransaction(ctx, t.id, "abort")
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestTransaction(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	values := func(records []*api.Record) []string {
+		var values []string
+		for _, record := range records {
+			values = append(values, string(record.Value))
+		}
+		return values
+	}
+
+	committed, err := BeginTransaction(ctx, TransactionConfig{Addr: srv.URL})
+	require.NoError(t, err)
+	aborted, err := BeginTransaction(ctx, TransactionConfig{Addr: srv.URL})
+	require.NoError(t, err)
+	for _, txn := range []*Transaction{committed, aborted, committed} {
+		_, err = txn.Append(ctx, &api.Record{Value: []byte(txn.ID()[:4])})
+		require.NoError(t, err)
+	}
+
+	c := NewConsumer(ConsumerConfig{Addr: srv.URL, ReadCommitted: true})
+	records, err := c.Poll(ctx)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(0), c.Offset())
+
+	_, err = aborted.Abort(ctx)
+	require.NoError(t, err)
+	off, err := committed.Commit(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	records, err = c.Poll(ctx)
+	require.NoError(t, err)
+	id := committed.ID()[:4]
+	require.Equal(t, []string{id, id}, values(records))
+	require.Equal(t, uint64(3), c.Offset())
+
+	// read-uncommitted consumers get the aborted record, but not the
+	// markers
+	records, err = NewConsumer(ConsumerConfig{Addr: srv.URL}).Poll(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	_, err = committed.Append(ctx, &api.Record{Value: []byte("late")})
+	require.Equal(t, ErrTransactionNotFound, err)
+	_, err = aborted.Commit(ctx)
+	require.Equal(t, ErrTransactionNotFound, err)
+}
@@ -0,0 +1,187 @@
+// loadgen drives a running server with producers and consumers for a while
+// and reports the throughput and latency they saw, so changes to the server
+// can be checked for performance regressions.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/client"
+)
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "the server's base URL")
+	producers := flag.Int("producers", 4, "the number of producers")
+	consumers := flag.Int("consumers", 1, "the number of consumers, each reading every record produced")
+	duration := flag.Duration("duration", 10*time.Second, "how long to produce for")
+	size := flag.Int("size", 100, "the size of the records' values in bytes, at least 8")
+	rate := flag.Int("rate", 0, "the records per second each producer sends, 0 for as many as it can")
+	batch := flag.Int("batch", 100, "the producers' batch size")
+	linger := flag.Duration("linger", 5*time.Millisecond, "how long producers wait for a batch to fill")
+	fetchBytes := flag.Int("fetch-bytes", 0, "if set, consumers fetch records raw in runs of about this many bytes")
+	flag.Parse()
+	if *size < timestampBytes {
+		fmt.Fprintf(os.Stderr, "loadgen: -size must be at least %d bytes\n", timestampBytes)
+		os.Exit(2)
+	}
+
+	r, err := run(config{
+		addr:       *addr,
+		producers:  *producers,
+		consumers:  *consumers,
+		duration:   *duration,
+		size:       *size,
+		rate:       *rate,
+		fetchBytes: *fetchBytes,
+		producer: client.ProducerConfig{
+			Addr:      *addr,
+			BatchSize: *batch,
+			Linger:    *linger,
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadgen: %v\n", err)
+		os.Exit(1)
+	}
+	r.print(os.Stdout, *size)
+	if r.produceErrors > 0 || r.consumeErrors > 0 {
+		os.Exit(1)
+	}
+}
+
+type config struct {
+	addr       string
+	producers  int
+	consumers  int
+	duration   time.Duration
+	size       int
+	rate       int
+	fetchBytes int
+	producer   client.ProducerConfig
+}
+
+// timestampBytes is the size of the time a record was sent at, which starts
+// its value so consumers can measure the end-to-end latency.
+const timestampBytes = 8
+
+// drainTimeout bounds how long consumers keep reading after the producers
+// stop, to catch up with the records produced last.
+const drainTimeout = 10 * time.Second
+
+// run produces records for the configured duration while the consumers read
+// them, then waits for the consumers to catch up.
+func run(c config) (*results, error) {
+	r := &results{}
+	ctx := context.Background()
+
+	// consumers start after the records already in the log
+	_, highest, err := client.NewConsumer(client.ConsumerConfig{Addr: c.addr}).Offsets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := highest + 1
+	if highest == 0 {
+		// an empty log and a log holding one record look the same
+		start = 0
+	}
+
+	var produced sync.WaitGroup
+	began := time.Now()
+	deadline := began.Add(c.duration)
+	for i := 0; i < c.producers; i++ {
+		produced.Add(1)
+		go func() {
+			defer produced.Done()
+			produce(c, deadline, r)
+		}()
+	}
+
+	consumeCtx, stopConsumers := context.WithCancel(ctx)
+	defer stopConsumers()
+	var consumed sync.WaitGroup
+	for i := 0; i < c.consumers; i++ {
+		consumed.Add(1)
+		go func() {
+			defer consumed.Done()
+			consume(consumeCtx, c, start, r)
+		}()
+	}
+
+	produced.Wait()
+	r.produceTime = time.Since(began)
+	// let the consumers read the rest of what was produced
+	r.mu.Lock()
+	want := r.produced * uint64(c.consumers)
+	r.mu.Unlock()
+	drainDeadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(drainDeadline) {
+		r.mu.Lock()
+		done := r.consumed >= want
+		r.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopConsumers()
+	consumed.Wait()
+	r.consumeTime = time.Since(began)
+	return r, nil
+}
+
+// produce sends records until the deadline, at the configured rate if
+// there is one.
+func produce(c config, deadline time.Time, r *results) {
+	p := client.NewProducer(c.producer)
+	defer p.Close()
+	var tick <-chan time.Time
+	if c.rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(c.rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	for time.Now().Before(deadline) {
+		if tick != nil {
+			<-tick
+		}
+		value := make([]byte, c.size)
+		sent := time.Now()
+		binary.BigEndian.PutUint64(value, uint64(sent.UnixNano()))
+		err := p.Send(&api.Record{Value: value}, func(_ uint64, err error) {
+			r.produce(time.Since(sent), err)
+		})
+		if err != nil {
+			r.produce(0, err)
+			return
+		}
+	}
+}
+
+// consume reads records from start on until the context is done.
+func consume(ctx context.Context, c config, start uint64, r *results) {
+	cons := client.NewConsumer(client.ConsumerConfig{
+		Addr:         c.addr,
+		Offset:       start,
+		PollInterval: 10 * time.Millisecond,
+		FetchBytes:   c.fetchBytes,
+	})
+	err := cons.Run(ctx, func(record *api.Record) error {
+		if len(record.Value) < timestampBytes {
+			// not one of ours
+			return nil
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(record.Value)))
+		r.consume(time.Since(sent))
+		return nil
+	})
+	if err != nil && err != context.Canceled {
+		r.consumeError(err)
+	}
+}
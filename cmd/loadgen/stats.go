@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// results collects what the producers and consumers saw. Every latency is
+// kept, which is fine for runs of a few million records.
+type results struct {
+	mu sync.Mutex
+
+	produced       uint64
+	produceErrors  uint64
+	produceLatency []time.Duration
+	produceTime    time.Duration
+
+	consumed      uint64
+	consumeErrors uint64
+	endToEnd      []time.Duration
+	consumeTime   time.Duration
+
+	firstErr error
+}
+
+// produce records a send that was acknowledged after latency, or failed.
+func (r *results) produce(latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.produceErrors++
+		r.setErr(err)
+		return
+	}
+	r.produced++
+	r.produceLatency = append(r.produceLatency, latency)
+}
+
+// consume records a record that was read latency after it was sent.
+func (r *results) consume(latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consumed++
+	r.endToEnd = append(r.endToEnd, latency)
+}
+
+func (r *results) consumeError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consumeErrors++
+	r.setErr(err)
+}
+
+// setErr keeps the first error. The caller must hold mu.
+func (r *results) setErr(err error) {
+	if r.firstErr == nil {
+		r.firstErr = err
+	}
+}
+
+func (r *results) print(w io.Writer, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(w, "produced  %d records in %s, %d errors\n",
+		r.produced, r.produceTime.Round(time.Millisecond), r.produceErrors)
+	printRate(w, r.produced, size, r.produceTime)
+	fmt.Fprintf(w, "  ack latency  %s\n", percentiles(r.produceLatency))
+	fmt.Fprintf(w, "consumed  %d records in %s, %d errors\n",
+		r.consumed, r.consumeTime.Round(time.Millisecond), r.consumeErrors)
+	printRate(w, r.consumed, size, r.consumeTime)
+	fmt.Fprintf(w, "  end-to-end   %s\n", percentiles(r.endToEnd))
+	if r.firstErr != nil {
+		fmt.Fprintf(w, "first error: %v\n", r.firstErr)
+	}
+}
+
+func printRate(w io.Writer, records uint64, size int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	perSec := float64(records) / d.Seconds()
+	fmt.Fprintf(w, "  throughput   %.0f records/s, %.2f MiB/s\n",
+		perSec, perSec*float64(size)/(1<<20))
+}
+
+// percentiles formats the p50, p99 and p999 of the latencies, sorting them.
+func percentiles(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "n/a"
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) time.Duration {
+		i := int(p * float64(len(latencies)))
+		if i >= len(latencies) {
+			i = len(latencies) - 1
+		}
+		return latencies[i].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %s  p99 %s  p999 %s  max %s",
+		at(0.50), at(0.99), at(0.999), latencies[len(latencies)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/client"
+)
+
+// errDone stops a consumer once it printed as many records as asked for.
+var errDone = errors.New("done")
+
+// consume prints the records from -offset on.
+func consume(args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ExitOnError)
+	addr := addrFlag(fs)
+	offset := fs.Uint64("offset", 0, "the offset of the first record to print")
+	follow := fs.Bool("follow", false, "keep waiting for new records once caught up")
+	n := fs.Int("n", 0, "stop after printing this many records, 0 for no limit")
+	readCommitted := readCommittedFlag(fs)
+	format := formatFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	print, err := printer(*format)
+	if err != nil {
+		return err
+	}
+	c := client.NewConsumer(client.ConsumerConfig{Addr: *addr, Offset: *offset, ReadCommitted: *readCommitted})
+	return run(c, *follow, *n, print)
+}
+
+// tail prints the last -n records.
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	addr := addrFlag(fs)
+	n := fs.Uint64("n", 10, "the number of records to print")
+	follow := fs.Bool("f", false, "keep printing new records as they're produced")
+	readCommitted := readCommittedFlag(fs)
+	format := formatFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	print, err := printer(*format)
+	if err != nil {
+		return err
+	}
+	c := client.NewConsumer(client.ConsumerConfig{Addr: *addr, ReadCommitted: *readCommitted})
+	lowest, highest, err := c.Offsets(context.Background())
+	if err != nil {
+		return err
+	}
+	start := lowest
+	if highest+1 > lowest+*n {
+		start = highest + 1 - *n
+	}
+	c.Seek(start)
+	return run(c, *follow, 0, print)
+}
+
+// offsets prints the lowest and highest offsets in the log.
+func offsets(args []string) error {
+	fs := flag.NewFlagSet("offsets", flag.ExitOnError)
+	addr := addrFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c := client.NewConsumer(client.ConsumerConfig{Addr: *addr})
+	lowest, highest, err := c.Offsets(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("lowest\t%d\nhighest\t%d\n", lowest, highest)
+	return nil
+}
+
+// run prints the consumer's records until it catches up, or until
+// interrupted if follow is set, stopping early after limit records if limit
+// isn't 0.
+func run(c *client.Consumer, follow bool, limit int, print func(*api.Record) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	printed := 0
+	handle := func(record *api.Record) error {
+		if limit > 0 && printed == limit {
+			return errDone
+		}
+		printed++
+		return print(record)
+	}
+	if follow {
+		err := c.Run(ctx, handle)
+		if err == errDone || err == context.Canceled {
+			return nil
+		}
+		return err
+	}
+	for {
+		records, err := c.Poll(ctx)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, record := range records {
+			if err = handle(record); err == errDone {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readCommittedFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("read-committed", false,
+		"only print records of committed transactions, waiting for open ones to end")
+}
+
+func formatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", "raw", "how to print records: raw, json or hex")
+}
+
+// printer returns a function that prints records in the given format.
+func printer(format string) (func(*api.Record) error, error) {
+	switch format {
+	case "raw":
+		return func(record *api.Record) error {
+			_, err := fmt.Printf("%s\n", record.Value)
+			return err
+		}, nil
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		return func(record *api.Record) error {
+			return enc.Encode(struct {
+				Offset uint64 `json:"offset"`
+				Value  []byte `json:"value"`
+			}{record.Offset, record.Value})
+		}, nil
+	case "hex":
+		return func(record *api.Record) error {
+			_, err := fmt.Printf("%d\t%s\n", record.Offset, hex.EncodeToString(record.Value))
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,67 @@
+// logctl produces records to and consumes records from a running server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"consume": {
+		usage: "print records from an offset on",
+		run:   consume,
+	},
+	"offsets": {
+		usage: "print the lowest and highest offsets",
+		run:   offsets,
+	},
+	"produce": {
+		usage: "produce records read from stdin, one per line, or from a file",
+		run:   produce,
+	},
+	"tail": {
+		usage: "print the last records, and optionally follow the log",
+		run:   tail,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "logctl: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "logctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: logctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+func addrFlag(fs *flag.FlagSet) *string {
+	return fs.String("addr", "http://localhost:8080", "the server's base URL")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/client"
+)
+
+// maxLineBytes bounds the records read from stdin.
+const maxLineBytes = 1 << 20
+
+// produce sends every line of stdin as a record, or the whole of -file as a
+// single record, and prints the offsets the records were written at.
+func produce(args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	addr := addrFlag(fs)
+	file := fs.String("file", "", "produce the contents of this file as one record instead of reading stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	p := client.NewProducer(client.ProducerConfig{Addr: *addr})
+	var mu sync.Mutex
+	var failed int
+	callback := func(off uint64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Println(off)
+	}
+
+	if *file != "" {
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		if err = p.Send(&api.Record{Value: b}, callback); err != nil {
+			return err
+		}
+	} else if err := produceLines(p, os.Stdin, callback); err != nil {
+		return err
+	}
+	if err := p.Close(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records failed", failed)
+	}
+	return nil
+}
+
+func produceLines(p *client.Producer, r io.Reader, callback client.Callback) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	for scanner.Scan() {
+		// the scanner reuses its buffer, so copy the line
+		value := append([]byte{}, scanner.Bytes()...)
+		if err := p.Send(&api.Record{Value: value}, callback); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// backup writes a snapshot of the log to a file, or to stdout.
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir, config := logFlags(fs)
+	out := fs.String("o", "-", "the file to write the snapshot to, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := config()
+	if err != nil {
+		return err
+	}
+	// reading the log is all a backup needs, and it can run alongside
+	// other readers
+	c.ReadOnly = true
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	l, err := log.NewLog(*dir, c)
+	if err != nil {
+		return err
+	}
+	if err = l.Snapshot(w); err != nil {
+		_ = l.Close()
+		return err
+	}
+	if err = l.Close(); err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// restore recreates a log from a snapshot file, or from stdin.
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "the directory to restore the log into")
+	in := fs.String("i", "-", "the snapshot file to restore, - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errRequired("-dir")
+	}
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	l, err := log.Restore(*dir, r)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
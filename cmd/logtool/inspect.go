@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// list prints the segments in the data directory.
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("dir", "", "the log's data directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errRequired("-dir")
+	}
+	infos, err := log.Segments(*dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "BASE\tNEXT\tRECORDS\tSTORE BYTES\tINDEX BYTES\tKEY\t")
+	for _, info := range infos {
+		key := info.KeyID
+		if key == "" {
+			key = "-"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%s\t\n",
+			info.BaseOffset, info.NextOffset, info.Records(),
+			info.StoreBytes, info.IndexBytes, key,
+		)
+	}
+	return w.Flush()
+}
+
+// dump prints the records in a range of offsets as JSON, one per line.
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	dir, config := logFlags(fs)
+	from := fs.Uint64("from", 0, "the first offset to dump")
+	to := fs.Uint64("to", math.MaxUint64, "the offset to stop dumping at, exclusive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := config()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	return log.Dump(*dir, c, *from, *to, func(record *api.Record) error {
+		return enc.Encode(record)
+	})
+}
+
+// verify checks every segment's index against its store and exits with an
+// error if any of them are inconsistent.
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", "", "the log's data directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errRequired("-dir")
+	}
+	problems, err := log.Verify(*dir)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	return nil
+}
+
+// repair rebuilds the index of every inconsistent segment, or of the segment
+// given with -base, from its store.
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dir := fs.String("dir", "", "the log's data directory")
+	base := fs.Int64("base", -1, "the base offset of the segment to repair, all inconsistent segments if unset")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errRequired("-dir")
+	}
+	if *base >= 0 {
+		return log.RepairIndex(*dir, uint64(*base))
+	}
+	problems, err := log.Verify(*dir)
+	if err != nil {
+		return err
+	}
+	repaired := make(map[uint64]bool)
+	for _, problem := range problems {
+		if repaired[problem.BaseOffset] {
+			continue
+		}
+		fmt.Printf("repairing segment %d: %s\n", problem.BaseOffset, problem.Problem)
+		if err = log.RepairIndex(*dir, problem.BaseOffset); err != nil {
+			return err
+		}
+		repaired[problem.BaseOffset] = true
+	}
+	return nil
+}
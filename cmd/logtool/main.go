@@ -0,0 +1,110 @@
+// logtool works on the data directory of a log while the log is offline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {
+		usage: "write a snapshot of the log",
+		run:   backup,
+	},
+	"dump": {
+		usage: "print the records in a range of offsets as JSON",
+		run:   dump,
+	},
+	"list": {
+		usage: "list the segments with their offsets and sizes",
+		run:   list,
+	},
+	"reencrypt": {
+		usage: "re-encrypt every segment under the keyring's active key",
+		run:   reencrypt,
+	},
+	"restore": {
+		usage: "recreate a log from a snapshot",
+		run:   restore,
+	},
+	"repair": {
+		usage: "rebuild index files from store files",
+		run:   repair,
+	},
+	"verify": {
+		usage: "check that every index matches its store",
+		run:   verify,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "logtool: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "logtool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: logtool <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+// logFlags registers the flags needed to open a log and returns a function
+// that builds the log's config once the flags are parsed.
+//
+// The segment limits should match the ones the log was written with. Opening
+// the log leaves the index files as they are, but the commands that write to
+// it go by the limits to decide when the active segment is full.
+func logFlags(fs *flag.FlagSet) (dir *string, config func() (log.Config, error)) {
+	dir = fs.String("dir", "", "the log's data directory")
+	maxStoreBytes := fs.Uint64("max-store-bytes", 0, "the log's Segment.MaxStoreBytes")
+	maxIndexBytes := fs.Uint64("max-index-bytes", 0, "the log's Segment.MaxIndexBytes")
+	keyring := fs.String("keyring", "", "the keyring file, if the log is encrypted")
+	return dir, func() (log.Config, error) {
+		c := log.Config{}
+		if *dir == "" {
+			return c, errRequired("-dir")
+		}
+		c.Segment.MaxStoreBytes = *maxStoreBytes
+		c.Segment.MaxIndexBytes = *maxIndexBytes
+		if *keyring != "" {
+			k, err := log.LoadKeyring(*keyring)
+			if err != nil {
+				return c, err
+			}
+			c.Encryption.Keyring = k
+		}
+		return c, nil
+	}
+}
+
+func errRequired(flag string) error {
+	return fmt.Errorf("%s is required", flag)
+}
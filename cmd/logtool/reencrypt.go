@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// reencrypt rewrites the segments that aren't encrypted under the active key
+// of the keyring, so that the old keys can be retired.
+func reencrypt(args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	dir, config := logFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := config()
+	if err != nil {
+		return err
+	}
+	if c.Encryption.Keyring == nil {
+		return errRequired("-keyring")
+	}
+	l, err := log.NewLog(*dir, c)
+	if err != nil {
+		return err
+	}
+	if err = l.Reencrypt(); err != nil {
+		_ = l.Close()
+		return err
+	}
+	return l.Close()
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	commitlog "github.com/MRSharff/distributed-services-with-go/log"
+	"github.com/MRSharff/distributed-services-with-go/trace"
+)
+
+// Config is the server's configuration. It's loaded from, lowest precedence
+// first: the defaults, the file named by -config, LOGSERVER_* environment
+// variables, and command-line flags.
+type Config struct {
+	Addr            string   `json:"addr"`
+	DiagnosticsAddr string   `json:"diagnostics_addr"`
+	DataDir         string   `json:"data_dir"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	Segment         struct {
+		MaxStoreBytes uint64 `json:"max_store_bytes"`
+		MaxIndexBytes uint64 `json:"max_index_bytes"`
+		InitialOffset uint64 `json:"initial_offset"`
+	} `json:"segment"`
+	Encryption struct {
+		KeyringFile string `json:"keyring_file"`
+	} `json:"encryption"`
+	// Tier offloads closed segments to a directory, e.g. on a network
+	// mount, or to an S3 compatible bucket, if either is set.
+	Tier struct {
+		Dir string `json:"dir"`
+		S3  struct {
+			Endpoint        string `json:"endpoint"`
+			Bucket          string `json:"bucket"`
+			Region          string `json:"region"`
+			Prefix          string `json:"prefix"`
+			AccessKeyID     string `json:"access_key_id"`
+			SecretAccessKey string `json:"secret_access_key"`
+		} `json:"s3"`
+		LocalSegments int    `json:"local_segments"`
+		CacheDir      string `json:"cache_dir"`
+		CacheSegments int    `json:"cache_segments"`
+	} `json:"tier"`
+	Log struct {
+		Level  string `json:"level"`
+		Format string `json:"format"`
+	} `json:"log"`
+	Trace struct {
+		Exporter     string `json:"exporter"`
+		OTLPEndpoint string `json:"otlp_endpoint"`
+	} `json:"trace"`
+}
+
+func defaultConfig() Config {
+	c := Config{
+		Addr:            ":8080",
+		DataDir:         "data",
+		ShutdownTimeout: Duration(30 * time.Second),
+	}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 12 << 10 // room for 1024 entries
+	c.Tier.LocalSegments = 4
+	c.Tier.CacheSegments = 2
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	c.Trace.Exporter = "none"
+	c.Trace.OTLPEndpoint = trace.DefaultOTLPEndpoint
+	return c
+}
+
+// setting is a config field that can be set by a flag and an environment
+// variable.
+type setting struct {
+	flag  string
+	usage string
+	field func(c *Config) flag.Value
+}
+
+var settings = []setting{
+	{"addr", "address to serve the log on",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Addr) }},
+	{"diagnostics-addr", "address to serve pprof profiles, goroutine dumps and build info on, e.g. localhost:6060; off if empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.DiagnosticsAddr) }},
+	{"data-dir", "directory the log is kept in",
+		func(c *Config) flag.Value { return (*stringValue)(&c.DataDir) }},
+	{"shutdown-timeout", "how long to wait for in-flight requests on shutdown",
+		func(c *Config) flag.Value { return &c.ShutdownTimeout }},
+	{"max-store-bytes", "size a segment's store file can grow to before a new segment is created",
+		func(c *Config) flag.Value { return (*uint64Value)(&c.Segment.MaxStoreBytes) }},
+	{"max-index-bytes", "size a segment's index file can grow to, a multiple of the 12 byte index entry",
+		func(c *Config) flag.Value { return (*uint64Value)(&c.Segment.MaxIndexBytes) }},
+	{"initial-offset", "offset of the first record in a new log",
+		func(c *Config) flag.Value { return (*uint64Value)(&c.Segment.InitialOffset) }},
+	{"keyring-file", "JSON keyring file whose active key encrypts new segments at rest; off if empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Encryption.KeyringFile) }},
+	{"tier-dir", "directory closed segments are offloaded to, e.g. on a network mount; off if empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.Dir) }},
+	{"tier-s3-endpoint", "base URL of the S3 compatible service closed segments are offloaded to; off if empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.S3.Endpoint) }},
+	{"tier-s3-bucket", "bucket closed segments are offloaded to",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.S3.Bucket) }},
+	{"tier-s3-region", "region of the bucket, us-east-1 if empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.S3.Region) }},
+	{"tier-s3-prefix", "prefix of the names of the objects in the bucket",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.S3.Prefix) }},
+	{"tier-s3-access-key-id", "access key ID requests to the bucket are signed with",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.S3.AccessKeyID) }},
+	{"tier-s3-secret-access-key", "secret access key requests to the bucket are signed with; prefer the environment to the command line",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.S3.SecretAccessKey) }},
+	{"tier-local-segments", "segments, including the active one, kept on local disk when offloading",
+		func(c *Config) flag.Value { return (*intValue)(&c.Tier.LocalSegments) }},
+	{"tier-cache-dir", "directory offloaded segments are cached in while they're read; \"cache\" in the data dir if empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tier.CacheDir) }},
+	{"tier-cache-segments", "offloaded segments kept in the cache",
+		func(c *Config) flag.Value { return (*intValue)(&c.Tier.CacheSegments) }},
+	{"log-level", "minimum level logged: debug, info, warn or error",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Level) }},
+	{"log-format", "log format: text or json",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Format) }},
+	{"trace-exporter", "where to export trace spans: none, stdout or otlp",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Trace.Exporter) }},
+	{"otlp-endpoint", "collector URL that spans are sent to with -trace-exporter=otlp",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Trace.OTLPEndpoint) }},
+}
+
+// envPrefix is prepended to a setting's flag name, upper-cased with dashes
+// replaced by underscores, to get its environment variable, e.g.
+// LOGSERVER_DATA_DIR.
+const envPrefix = "LOGSERVER_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the config from the command-line arguments, the
+// environment and the config file they name, and validates it. It returns
+// the name of the config file too, or "" if there wasn't one.
+func loadConfig(args []string) (Config, string, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(envPrefix+"CONFIG"),
+		"config file to load, in YAML, TOML or JSON depending on its extension (env "+envPrefix+"CONFIG)")
+	for _, s := range settings {
+		// flags are applied once the file has been loaded, so just
+		// remember what they were set to for now
+		fs.Var(&rawValue{s.field(&c).String()}, s.flag, s.usage+" (env "+envName(s.flag)+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, "", err
+	}
+	if fs.NArg() > 0 {
+		return c, "", fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *file != "" {
+		if err := loadConfigFile(*file, &c); err != nil {
+			return c, "", fmt.Errorf("load %s: %w", *file, err)
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(envName(s.flag)); ok {
+			if err := s.field(&c).Set(v); err != nil {
+				return c, "", fmt.Errorf("%s: %w", envName(s.flag), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if err = s.field(&c).Set(f.Value.String()); err != nil {
+					err = fmt.Errorf("-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return c, "", err
+	}
+	return c, *file, c.Validate()
+}
+
+// loadConfigFile overlays the settings in the named file onto c. Whatever
+// the file's format, it's decoded into a generic map first and then into c
+// through its JSON tags, so every format uses the same keys and unknown keys
+// are rejected the same way.
+func loadConfigFile(name string, c *Config) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".json":
+		// keep numbers as they're written, rather than as float64s that
+		// can't hold every uint64
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err = dec.Decode(&m); err == nil && dec.More() {
+			err = errors.New("unexpected data after the settings")
+		}
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &m)
+	case ".toml":
+		m, err = parseTOML(data)
+	default:
+		return fmt.Errorf("unknown config file format %q, want .yaml, .toml or .json", ext)
+	}
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		// the file might not be JSON, so don't say it is
+		return fmt.Errorf("unknown setting %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return err
+}
+
+// Validate checks the config makes sense before the server acts on it. It
+// only looks at the settings themselves; files they name, like the keyring,
+// are read when the log is opened.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr must be set"))
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data_dir must be set"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if err := c.logConfig().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("segment: %w", err))
+	}
+	if c.Tier.Dir != "" && c.Tier.S3.Endpoint != "" {
+		errs = append(errs, errors.New("tier.dir and tier.s3.endpoint can't both be set"))
+	}
+	if c.Tier.S3.Endpoint != "" && c.Tier.S3.Bucket == "" {
+		errs = append(errs, errors.New("tier.s3.bucket must be set with tier.s3.endpoint"))
+	}
+	if c.Tier.Dir != "" || c.Tier.S3.Endpoint != "" {
+		if c.Tier.LocalSegments < 1 {
+			errs = append(errs, errors.New("tier.local_segments must be at least 1, for the active segment"))
+		}
+		if c.Tier.CacheSegments < 1 {
+			errs = append(errs, errors.New("tier.cache_segments must be at least 1"))
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level %q isn't debug, info, warn or error", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format %q isn't text or json", c.Log.Format))
+	}
+	switch c.Trace.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Trace.OTLPEndpoint == "" {
+			errs = append(errs, errors.New("trace.otlp_endpoint must be set to export spans with otlp"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("trace.exporter %q isn't none, stdout or otlp", c.Trace.Exporter))
+	}
+	return errors.Join(errs...)
+}
+
+// logConfig returns the config for the log, without its metrics registry,
+// keyring or object store.
+func (c Config) logConfig() commitlog.Config {
+	lc := commitlog.Config{}
+	lc.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	lc.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	lc.Segment.InitialOffset = c.Segment.InitialOffset
+	lc.Tier.LocalSegments = c.Tier.LocalSegments
+	lc.Tier.CacheDir = c.Tier.CacheDir
+	lc.Tier.CacheSegments = c.Tier.CacheSegments
+	return lc
+}
+
+// loadLogConfig returns logConfig with the keyring loaded and the tier's
+// object store set up, if there are any. serve calls it once, to open the
+// log.
+func (c Config) loadLogConfig() (commitlog.Config, error) {
+	lc := c.logConfig()
+	if c.Encryption.KeyringFile != "" {
+		k, err := commitlog.LoadKeyring(c.Encryption.KeyringFile)
+		if err != nil {
+			return lc, fmt.Errorf("encryption.keyring_file: %w", err)
+		}
+		lc.Encryption.Keyring = k
+	}
+	var err error
+	switch {
+	case c.Tier.Dir != "":
+		lc.Tier.Store, err = commitlog.NewDirObjectStore(c.Tier.Dir)
+		if err != nil {
+			return lc, fmt.Errorf("tier.dir: %w", err)
+		}
+	case c.Tier.S3.Endpoint != "":
+		lc.Tier.Store, err = commitlog.NewS3ObjectStore(commitlog.S3Config{
+			Endpoint:        c.Tier.S3.Endpoint,
+			Bucket:          c.Tier.S3.Bucket,
+			Region:          c.Tier.S3.Region,
+			Prefix:          c.Tier.S3.Prefix,
+			AccessKeyID:     c.Tier.S3.AccessKeyID,
+			SecretAccessKey: c.Tier.S3.SecretAccessKey,
+		})
+		if err != nil {
+			return lc, fmt.Errorf("tier.s3: %w", err)
+		}
+	}
+	return lc, nil
+}
+
+// LogValue logs the config as a group of its settings, so the effective
+// config can be logged on startup.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("addr", c.Addr),
+		slog.String("diagnostics_addr", c.DiagnosticsAddr),
+		slog.String("data_dir", c.DataDir),
+		slog.Duration("shutdown_timeout", time.Duration(c.ShutdownTimeout)),
+		slog.Group("segment",
+			slog.Uint64("max_store_bytes", c.Segment.MaxStoreBytes),
+			slog.Uint64("max_index_bytes", c.Segment.MaxIndexBytes),
+			slog.Uint64("initial_offset", c.Segment.InitialOffset),
+		),
+		slog.Group("encryption",
+			slog.String("keyring_file", c.Encryption.KeyringFile),
+		),
+		slog.Group("tier",
+			slog.String("dir", c.Tier.Dir),
+			slog.Group("s3",
+				slog.String("endpoint", c.Tier.S3.Endpoint),
+				slog.String("bucket", c.Tier.S3.Bucket),
+				slog.String("region", c.Tier.S3.Region),
+				slog.String("prefix", c.Tier.S3.Prefix),
+				slog.String("access_key_id", c.Tier.S3.AccessKeyID),
+				slog.String("secret_access_key", redact(c.Tier.S3.SecretAccessKey)),
+			),
+			slog.Int("local_segments", c.Tier.LocalSegments),
+			slog.String("cache_dir", c.Tier.CacheDir),
+			slog.Int("cache_segments", c.Tier.CacheSegments),
+		),
+		slog.Group("log",
+			slog.String("level", c.Log.Level),
+			slog.String("format", c.Log.Format),
+		),
+		slog.Group("trace",
+			slog.String("exporter", c.Trace.Exporter),
+			slog.String("otlp_endpoint", c.Trace.OTLPEndpoint),
+		),
+	)
+}
+
+// redact hides a secret from the logs, but not whether it's set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// Duration is a time.Duration written like "30s" in config files.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"30s\": %w", err)
+	}
+	return d.Set(s)
+}
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type uint64Value uint64
+
+func (v *uint64Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+func (v *uint64Value) Set(s string) error {
+	// decimal only, so a leading zero doesn't make it octal
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = uint64Value(n)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 0)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+
+// rawValue is a flag.Value that keeps what the flag was set to.
+type rawValue struct {
+	s string
+}
+
+func (v *rawValue) String() string     { return v.s }
+func (v *rawValue) Set(s string) error { v.s = s; return nil }
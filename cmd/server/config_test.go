@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name, data string) string {
+		name = path.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(name, []byte(data), 0644))
+		return name
+	}
+
+	// a 16 byte key
+	keyring := write("keyring.json", `{"active": "k1", "keys": {"k1": "MDEyMzQ1Njc4OWFiY2RlZg=="}}`)
+
+	for _, tt := range []struct {
+		name string
+		// file is the config file's name and contents, env the environment
+		// and args the flags
+		file, data string
+		env        map[string]string
+		args       []string
+		// want changes the defaults to what's expected
+		want func(c *Config)
+		err  string
+		// logErr is the error loading the log's config, which reads the
+		// files the config names
+		logErr string
+	}{
+		{name: "defaults", want: func(c *Config) {}},
+		{
+			name: "yaml", file: "c.yaml",
+			data: "addr: :9090\nshutdown_timeout: 5s\nsegment:\n  max_store_bytes: 18446744073709551615\n",
+			want: func(c *Config) {
+				c.Addr, c.ShutdownTimeout = ":9090", Duration(5*time.Second)
+				c.Segment.MaxStoreBytes = 1<<64 - 1
+			},
+		},
+		{
+			name: "json numbers aren't rounded", file: "c.json",
+			data: `{"segment": {"max_store_bytes": 18446744073709551615, "initial_offset": 9007199254740993}}`,
+			want: func(c *Config) {
+				c.Segment.MaxStoreBytes = 1<<64 - 1
+				c.Segment.InitialOffset = 1<<53 + 1
+			},
+		},
+		{
+			name: "toml", file: "c.toml",
+			data: "addr = ':9090'\n[segment]\ninitial_offset = 9_007_199_254_740_993\n",
+			want: func(c *Config) {
+				c.Addr = ":9090"
+				c.Segment.InitialOffset = 1<<53 + 1
+			},
+		},
+		{
+			name: "file < env < flags", file: "c.toml",
+			data: "addr = ':9090'\ndata_dir = 'file'\nlog.level = 'debug'\n",
+			env:  map[string]string{"LOGSERVER_DATA_DIR": "env", "LOGSERVER_LOG_LEVEL": "warn"},
+			args: []string{"-log-level", "error"},
+			want: func(c *Config) {
+				c.Addr, c.DataDir, c.Log.Level = ":9090", "env", "error"
+			},
+		},
+		{
+			name: "config file from env", file: "c.json", data: `{"data_dir": "file"}`,
+			env:  map[string]string{"LOGSERVER_CONFIG": path.Join(dir, "c.json")},
+			want: func(c *Config) { c.DataDir = "file" },
+		},
+		{
+			name: "integers are decimal", env: map[string]string{"LOGSERVER_INITIAL_OFFSET": "0755"},
+			args: []string{"-max-store-bytes", "010"},
+			want: func(c *Config) { c.Segment.InitialOffset, c.Segment.MaxStoreBytes = 755, 10 },
+		},
+		{name: "toml leading zeros", file: "c.toml", data: "segment.initial_offset = 0755",
+			err: "load " + path.Join(dir, "c.toml") + ": line 1: bad number 0755: leading zeros aren't allowed"},
+		{name: "unknown setting", file: "c.json", data: `{"segment": {"max_bytes": 1}}`,
+			err: "load " + path.Join(dir, "c.json") + `: unknown setting "max_bytes"`},
+		{name: "trailing data", file: "c.json", data: `{} {}`,
+			err: "load " + path.Join(dir, "c.json") + ": unexpected data after the settings"},
+		{name: "bad env", env: map[string]string{"LOGSERVER_SHUTDOWN_TIMEOUT": "soon"},
+			err: `LOGSERVER_SHUTDOWN_TIMEOUT: time: invalid duration "soon"`},
+		{
+			name: "keyring", file: "c.yaml", data: "encryption:\n  keyring_file: " + keyring + "\n",
+			want: func(c *Config) { c.Encryption.KeyringFile = keyring },
+		},
+		{
+			name: "missing keyring", args: []string{"-keyring-file", path.Join(dir, "missing.json")},
+			want:   func(c *Config) { c.Encryption.KeyringFile = path.Join(dir, "missing.json") },
+			logErr: "encryption.keyring_file: open " + path.Join(dir, "missing.json") + ": no such file or directory",
+		},
+		{
+			name: "tier dir", file: "c.toml",
+			data: "[tier]\ndir = '" + path.Join(dir, "tier") + "'\nlocal_segments = 2\n",
+			want: func(c *Config) { c.Tier.Dir, c.Tier.LocalSegments = path.Join(dir, "tier"), 2 },
+		},
+		{
+			name: "tier s3",
+			env: map[string]string{
+				"LOGSERVER_TIER_S3_ENDPOINT":          "http://localhost:9000",
+				"LOGSERVER_TIER_S3_BUCKET":            "logs",
+				"LOGSERVER_TIER_S3_SECRET_ACCESS_KEY": "secret",
+			},
+			args: []string{"-tier-cache-segments", "8"},
+			want: func(c *Config) {
+				c.Tier.S3.Endpoint, c.Tier.S3.Bucket, c.Tier.S3.SecretAccessKey = "http://localhost:9000", "logs", "secret"
+				c.Tier.CacheSegments = 8
+			},
+		},
+		{name: "tier s3 without a bucket", args: []string{"-tier-s3-endpoint", "http://localhost:9000"},
+			err: "tier.s3.bucket must be set with tier.s3.endpoint"},
+		{name: "two tiers", args: []string{"-tier-dir", "tier", "-tier-s3-endpoint", "http://localhost:9000",
+			"-tier-s3-bucket", "logs", "-tier-local-segments", "0"},
+			err: "tier.dir and tier.s3.endpoint can't both be set\ntier.local_segments must be at least 1, for the active segment"},
+		{name: "invalid", args: []string{"-log-format", "xml"}, err: `log.format "xml" isn't text or json`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				name := write(tt.file, tt.data)
+				if _, ok := tt.env["LOGSERVER_CONFIG"]; !ok {
+					args = append([]string{"-config", name}, args...)
+				}
+			}
+			c, file, err := loadConfig(args)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.file != "" {
+				require.Equal(t, path.Join(dir, tt.file), file)
+			}
+			want := defaultConfig()
+			tt.want(&want)
+			require.Equal(t, want, c)
+			lc, err := c.loadLogConfig()
+			if tt.logErr != "" {
+				require.EqualError(t, err, tt.logErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.Encryption.KeyringFile != "", lc.Encryption.Keyring != nil)
+			require.Equal(t, c.Tier.Dir != "" || c.Tier.S3.Endpoint != "", lc.Tier.Store != nil)
+		})
+	}
+}
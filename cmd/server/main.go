@@ -1,11 +1,235 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	commitlog "github.com/MRSharff/distributed-services-with-go/log"
+	"github.com/MRSharff/distributed-services-with-go/metrics"
 	"github.com/MRSharff/distributed-services-with-go/server"
-	"log"
+	"github.com/MRSharff/distributed-services-with-go/trace"
+)
+
+// Exit statuses: a clean shutdown exits 0, a failure to start or serve exits
+// 1, and a shutdown that didn't finish cleanly, because requests were still
+// in flight at the deadline or the log failed to close, exits 2.
+const (
+	exitOK       = 0
+	exitFailed   = 1
+	exitShutdown = 2
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	os.Exit(run())
+}
+
+func run() int {
+	config, file, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server:", err)
+		return exitFailed
+	}
+	logger, err := newLogger(config.Log.Level, config.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server:", err)
+		return exitFailed
+	}
+	logger.Info("effective config", "file", file, "config", config)
+	tracer, err := newTracer(config.Trace.Exporter, config.Trace.OTLPEndpoint, logger)
+	if err != nil {
+		logger.Error("set up tracing", "error", err)
+		return exitFailed
+	}
+	defer tracer.Close()
+
+	// the first SIGINT or SIGTERM starts a graceful shutdown. serve stops
+	// the signals being caught once it does, so a second one kills the
+	// process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		logger.Error("listen", "error", err)
+		return exitFailed
+	}
+	var diagLn net.Listener
+	if config.DiagnosticsAddr != "" {
+		if diagLn, err = net.Listen("tcp", config.DiagnosticsAddr); err != nil {
+			_ = ln.Close()
+			logger.Error("listen", "error", err)
+			return exitFailed
+		}
+	}
+	return serve(ctx, stop, config, logger, tracer, ln, diagLn)
+}
+
+// serve serves the log on ln, and diagnostics on diagLn if it isn't nil,
+// opening the log in the data dir meanwhile, until ctx is done or serving
+// fails. It then calls stop, drains the in-flight requests, closes the log
+// and returns the exit status.
+func serve(ctx context.Context, stop func(), config Config, logger *slog.Logger, tracer *trace.Tracer, ln, diagLn net.Listener) int {
+	dataDir := config.DataDir
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		logger.Error("create directory", "error", err)
+		_ = ln.Close()
+		if diagLn != nil {
+			_ = diagLn.Close()
+		}
+		return exitFailed
+	}
+	registry := metrics.NewRegistry()
+	// serve health checks while the log recovers its segments, which can
+	// take a while for a big log
+	pending := &server.PendingLog{}
+	srv := server.NewHTTPServer(ln.Addr().String(), server.Config{
+		CommitLog: pending,
+		DataDir:   dataDir,
+		Metrics:   registry,
+		Logger:    logger,
+		Tracer:    tracer,
+	})
+	servers := []*http.Server{srv}
+	listeners := []net.Listener{ln}
+	if diagLn != nil {
+		servers = append(servers, server.NewDiagnosticsServer(diagLn.Addr().String()))
+		listeners = append(listeners, diagLn)
+	}
+	serveErr := make(chan error, len(servers))
+	for i, s := range servers {
+		go func(s *http.Server, l net.Listener) {
+			logger.Info("listening", "addr", s.Addr)
+			if err := s.Serve(l); err != http.ErrServerClosed {
+				serveErr <- fmt.Errorf("serve %s: %w", s.Addr, err)
+			}
+		}(s, listeners[i])
+	}
+
+	type opened struct {
+		log *commitlog.Log
+		err error
+	}
+	openc := make(chan opened, 1)
+	go func() {
+		c, err := config.loadLogConfig()
+		if err != nil {
+			openc <- opened{nil, err}
+			return
+		}
+		c.Metrics = registry
+		c.Tier.OnError = func(err error) {
+			logger.Warn("offload failed, retrying after the next roll", "error", err)
+		}
+		start := time.Now()
+		clog, err := commitlog.NewLog(dataDir, c)
+		if err == nil {
+			logger.Info("opened log", "data_dir", dataDir, "duration", time.Since(start))
+		}
+		openc <- opened{clog, err}
+	}()
+
+	status := exitOK
+	var clog *commitlog.Log
+	recovering := true
+	select {
+	case o := <-openc:
+		recovering = false
+		if o.err != nil {
+			logger.Error("open log", "error", o.err)
+			status = exitFailed
+			break
+		}
+		clog = o.log
+		pending.Open(clog)
+		select {
+		case <-ctx.Done():
+		case err := <-serveErr:
+			logger.Error("serve", "error", err)
+			status = exitFailed
+		}
+	case <-ctx.Done():
+	case err := <-serveErr:
+		logger.Error("serve", "error", err)
+		status = exitFailed
+	}
+	stop()
+
+	logger.Info("shutting down", "timeout", config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			logger.Error("drain requests", "addr", s.Addr, "error", err)
+			_ = s.Close()
+			status = maxStatus(status, exitShutdown)
+		}
+	}
+
+	if recovering {
+		// wait for the log to open so its index files are closed, and
+		// truncated, properly
+		if o := <-openc; o.err == nil {
+			clog = o.log
+		}
+	}
+	if clog != nil {
+		if err := clog.Close(); err != nil {
+			logger.Error("close log", "error", err)
+			status = maxStatus(status, exitShutdown)
+		}
+	}
+	logger.Info("stopped", "status", status)
+	return status
+}
+
+func maxStatus(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("bad log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("bad log format %q", format)
+}
+
+// newTracer returns the tracer for the named exporter, or nil if tracing is
+// off.
+func newTracer(exporter, endpoint string, logger *slog.Logger) (*trace.Tracer, error) {
+	c := trace.TracerConfig{
+		OnError: func(err error) { logger.Warn("export spans", "error", err) },
+	}
+	switch exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		c.Exporter = trace.NewWriterExporter(os.Stdout)
+	case "otlp":
+		c.Exporter = trace.NewOTLPExporter(trace.OTLPConfig{Endpoint: endpoint})
+	default:
+		return nil, fmt.Errorf("bad trace exporter %q", exporter)
+	}
+	return trace.NewTracer(c), nil
 }
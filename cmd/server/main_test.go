@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	commitlog "github.com/MRSharff/distributed-services-with-go/log"
+)
+
+func TestServeShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		// finish is whether the in-flight request's body is sent in time,
+		// and status the exit status that's expected
+		finish bool
+		status int
+	}{
+		{name: "drained", timeout: 10 * time.Second, finish: true, status: exitOK},
+		{name: "deadline", timeout: 50 * time.Millisecond, status: exitShutdown},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "server-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			config := defaultConfig()
+			config.DataDir = dir
+			config.ShutdownTimeout = Duration(tt.timeout)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			diagLn, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			addr, diagAddr := "http://"+ln.Addr().String(), "http://"+diagLn.Addr().String()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			status := make(chan int, 1)
+			go func() { status <- serve(ctx, cancel, config, logger, nil, ln, diagLn) }()
+			// a client that doesn't keep connections alive, so every
+			// request finds out whether the server is still accepting
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			require.Eventually(t, func() bool {
+				res, err := client.Get(addr + "/readyz")
+				if err != nil {
+					return false
+				}
+				res.Body.Close()
+				return res.StatusCode == http.StatusOK
+			}, 5*time.Second, 10*time.Millisecond)
+			res, err := client.Post(addr+"/records", api.ContentTypeJSON,
+				strings.NewReader(`{"record":{"value":"Zmlyc3Q="}}`))
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			// start a produce and wait for its handler to be reading the
+			// body, which the goroutine dump shows
+			body, w := io.Pipe()
+			type response struct {
+				status int
+				offset uint64
+				err    error
+			}
+			responses := make(chan response, 1)
+			go func() {
+				res, err := client.Post(addr+"/records", api.ContentTypeJSON, body)
+				if err != nil {
+					responses <- response{err: err}
+					return
+				}
+				defer res.Body.Close()
+				b, err := ioutil.ReadAll(res.Body)
+				produced := &api.ProduceResponse{}
+				if err == nil {
+					err = protojson.Unmarshal(b, produced)
+				}
+				responses <- response{status: res.StatusCode, offset: produced.Offset, err: err}
+			}()
+			_, err = w.Write([]byte(`{"record":`))
+			require.NoError(t, err)
+			require.Eventually(t, func() bool {
+				res, err := client.Get(diagAddr + "/debug/goroutines")
+				if err != nil {
+					return false
+				}
+				defer res.Body.Close()
+				b, err := ioutil.ReadAll(res.Body)
+				return err == nil && strings.Contains(string(b), "server.readMessage")
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// shutting down stops new requests, but lets the one in
+			// flight finish if it does so in time
+			cancel()
+			require.Eventually(t, func() bool {
+				_, err := client.Get(addr + "/healthz")
+				return err != nil
+			}, 5*time.Second, 10*time.Millisecond)
+			if tt.finish {
+				_, err = w.Write([]byte(`{"value":"c2Vjb25k"}}`))
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+				res := <-responses
+				require.NoError(t, res.err)
+				require.Equal(t, http.StatusOK, res.status)
+				require.Equal(t, uint64(1), res.offset)
+			}
+			require.Equal(t, tt.status, <-status)
+			w.Close()
+			if !tt.finish {
+				require.Error(t, (<-responses).err)
+			}
+			// the diagnostics server stopped too
+			_, err = client.Get(diagAddr + "/debug/version")
+			require.Error(t, err)
+
+			// the log was closed, releasing its lock, with every record
+			// produced in it
+			lc, err := config.loadLogConfig()
+			require.NoError(t, err)
+			clog, err := commitlog.NewLog(dir, lc)
+			require.NoError(t, err)
+			defer clog.Close()
+			want := []string{"first"}
+			if tt.finish {
+				want = append(want, "second")
+			}
+			highest, err := clog.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(want)-1), highest)
+			for i, value := range want {
+				record, err := clog.Read(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, value, string(record.Value))
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML that config files need: comments,
+// [table] headers and key = value pairs, where keys may be dotted and values
+// are strings, integers, floats or booleans. Arrays, inline tables, dates
+// and multi-line strings aren't supported and are reported as errors.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	for i, line := range strings.Split(string(data), "\n") {
+		lineno := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: arrays of tables aren't supported", lineno)
+			}
+			keys, rest, err := parseTOMLKey(line[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			if !strings.HasPrefix(rest, "]") || !isComment(rest[1:]) {
+				return nil, fmt.Errorf("line %d: bad table header", lineno)
+			}
+			if table, err = tomlTable(root, keys); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			continue
+		}
+		keys, rest, err := parseTOMLKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		if !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		t, err := tomlTable(table, keys[:len(keys)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		key := keys[len(keys)-1]
+		if _, ok := t[key]; ok {
+			return nil, fmt.Errorf("line %d: %q is set twice", lineno, key)
+		}
+		t[key] = value
+	}
+	return root, nil
+}
+
+// tomlTable returns the table at the dotted path keys, creating it if
+// needed.
+func tomlTable(t map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		v, ok := t[key]
+		if !ok {
+			v = make(map[string]interface{})
+			t[key] = v
+		}
+		next, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%q is a value, not a table", key)
+		}
+		t = next
+	}
+	return t, nil
+}
+
+// parseTOMLKey parses the possibly dotted key at the start of s into its
+// parts, and returns the rest of s after it and any whitespace. Parts can be
+// bare, double-quoted or single-quoted, and quoted ones can hold dots.
+func parseTOMLKey(s string) (keys []string, rest string, err error) {
+	rest = strings.TrimSpace(s)
+	for {
+		var key string
+		switch {
+		case strings.HasPrefix(rest, `"`):
+			end := closingQuote(rest)
+			if end < 0 {
+				return nil, "", fmt.Errorf("bad key %s", rest)
+			}
+			if key, err = strconv.Unquote(rest[:end+1]); err != nil {
+				return nil, "", fmt.Errorf("bad key %s", rest[:end+1])
+			}
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "'"):
+			end := strings.IndexByte(rest[1:], '\'')
+			if end < 0 {
+				return nil, "", fmt.Errorf("bad key %s", rest)
+			}
+			key, rest = rest[1:end+1], rest[end+2:]
+		default:
+			n := strings.IndexFunc(rest, func(c rune) bool {
+				return !(c == '_' || c == '-' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z')
+			})
+			if n < 0 {
+				n = len(rest)
+			}
+			if n == 0 {
+				return nil, "", fmt.Errorf("expected a key in %q", s)
+			}
+			key, rest = rest[:n], rest[n:]
+		}
+		keys = append(keys, key)
+		rest = strings.TrimSpace(rest)
+		if !strings.HasPrefix(rest, ".") {
+			return keys, rest, nil
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
+
+// closingQuote returns the index of the quote that closes the basic string s
+// starts with, skipping escaped ones, or -1 if there isn't one.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == '"' {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := closingQuote(s)
+		if end < 0 || !isComment(s[end+1:]) {
+			return nil, fmt.Errorf("bad string %s", s)
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad string %s", s[:end+1])
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 || !isComment(s[end+2:]) {
+			return nil, fmt.Errorf("bad string %s", s)
+		}
+		return s[1 : end+1], nil
+	}
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if v, ok, err := parseTOMLNumber(s); ok {
+		return v, err
+	}
+	return nil, fmt.Errorf("unsupported value %q", s)
+}
+
+// parseTOMLNumber parses an integer or a float, and returns false if s isn't
+// written like either. As in TOML, and unlike in Go, a leading zero doesn't
+// make an integer octal: it isn't allowed. Integers can be written in hex,
+// octal or binary with a 0x, 0o or 0b prefix.
+func parseTOMLNumber(s string) (interface{}, bool, error) {
+	digits := strings.TrimLeft(s, "+-")
+	if digits == "" || len(s)-len(digits) > 1 {
+		return nil, false, nil
+	}
+	switch digits {
+	case "inf", "nan":
+		f, err := strconv.ParseFloat(s, 64)
+		return f, true, err
+	}
+	if digits[0] < '0' || digits[0] > '9' || strings.Contains(s, "__") ||
+		strings.HasSuffix(s, "_") {
+		return nil, false, nil
+	}
+	for prefix, base := range map[string]int{"0x": 16, "0o": 8, "0b": 2} {
+		if strings.HasPrefix(s, prefix) {
+			n, err := strconv.ParseInt(strings.ReplaceAll(s[2:], "_", ""), base, 64)
+			if err != nil {
+				return nil, true, fmt.Errorf("bad integer %s", s)
+			}
+			return n, true, nil
+		}
+	}
+	plain := strings.ReplaceAll(s, "_", "")
+	if d := strings.TrimLeft(plain, "+-"); len(d) > 1 && d[0] == '0' && '0' <= d[1] && d[1] <= '9' {
+		return nil, true, fmt.Errorf("bad number %s: leading zeros aren't allowed", s)
+	}
+	if !strings.ContainsAny(plain, ".eE") {
+		n, err := strconv.ParseInt(plain, 10, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("bad integer %s", s)
+		}
+		return n, true, nil
+	}
+	f, err := strconv.ParseFloat(plain, 64)
+	if err != nil {
+		return nil, true, fmt.Errorf("bad float %s", s)
+	}
+	return f, true, nil
+}
+
+// isComment reports whether s, the rest of a line, is blank or a comment.
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
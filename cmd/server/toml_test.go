@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, tt := range []struct {
+		name, toml string
+		want       map[string]interface{}
+		err        string
+	}{
+		{name: "bare keys", toml: "a = 1\nb-c_d = true", want: map[string]interface{}{"a": int64(1), "b-c_d": true}},
+		{name: "dotted keys", toml: "a . b = 'x'", want: map[string]interface{}{"a": map[string]interface{}{"b": "x"}}},
+		{name: "quoted keys hold dots", toml: `"a.b" = 1` + "\n'c.d' = 2", want: map[string]interface{}{"a.b": int64(1), "c.d": int64(2)}},
+		{name: "quoted parts of dotted keys", toml: `a."b.c" = 1`, want: map[string]interface{}{"a": map[string]interface{}{"b.c": int64(1)}}},
+		{name: "quoted keys hold equals", toml: `"a=b" = 1`, want: map[string]interface{}{"a=b": int64(1)}},
+		{name: "tables", toml: "[a]\nb = 1\n[ \"c.d\" . e ] # comment\nf = 2", want: map[string]interface{}{
+			"a":   map[string]interface{}{"b": int64(1)},
+			"c.d": map[string]interface{}{"e": map[string]interface{}{"f": int64(2)}},
+		}},
+		{name: "strings", toml: `a = "x # y" # comment` + "\nb = 'c:\\d'\nc = \"q\\\"\"", want: map[string]interface{}{
+			"a": "x # y", "b": `c:\d`, "c": `q"`,
+		}},
+		{name: "integers", toml: "a = 0\nb = -17\nc = 1_000 # comment\nd = 0x1F\ne = 0o755\nf = 0b101", want: map[string]interface{}{
+			"a": int64(0), "b": int64(-17), "c": int64(1000), "d": int64(31), "e": int64(493), "f": int64(5),
+		}},
+		{name: "floats", toml: "a = 1.5\nb = 1e3\nc = -0.25\nd = inf", want: map[string]interface{}{
+			"a": 1.5, "b": 1000.0, "c": -0.25, "d": math.Inf(1),
+		}},
+		{name: "leading zeros aren't octal", toml: "a = 0755", err: "line 1: bad number 0755: leading zeros aren't allowed"},
+		{name: "integers are 64-bit", toml: "a = 9223372036854775808", err: "line 1: bad integer 9223372036854775808"},
+		{name: "bad underscores", toml: "a = 1__0", err: `line 1: unsupported value "1__0"`},
+		{name: "arrays", toml: "a = [1]", err: `line 1: unsupported value "[1]"`},
+		{name: "arrays of tables", toml: "[[a]]", err: "line 1: arrays of tables aren't supported"},
+		{name: "unterminated key", toml: `"a = 1`, err: `line 1: bad key "a = 1`},
+		{name: "missing value", toml: "\na", err: "line 2: expected key = value"},
+		{name: "bad header", toml: "[a] b", err: "line 1: bad table header"},
+		{name: "set twice", toml: "a = 1\na = 2", err: `line 2: "a" is set twice`},
+		{name: "value as table", toml: "a = 1\na.b = 2", err: `line 2: "a" is a value, not a table`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.toml))
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -1,15 +1,15 @@
 module github.com/MRSharff/distributed-services-with-go
 
-go 1.17
+go 1.22
 
 require (
 	github.com/stretchr/testify v1.7.1
-	github.com/tysonmote/gommap v0.0.1
 	google.golang.org/protobuf v1.28.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
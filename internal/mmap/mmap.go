@@ -0,0 +1,118 @@
+// Package mmap maps files into memory with the system calls the syscall
+// package exposes. It covers what the log needs: mapping a file read-only or
+// read-write, syncing writes back to it, and mapping a file again after it
+// has grown.
+package mmap
+
+import "errors"
+
+// Mode is how a file is mapped.
+type Mode int
+
+const (
+	// ReadOnly maps the file for reading. Writing to its bytes faults.
+	ReadOnly Mode = iota
+	// ReadWrite maps the file shared, so writes to its bytes change the file.
+	ReadWrite
+)
+
+// ErrUnmapped is returned by the methods of a Map that was unmapped.
+var ErrUnmapped = errors.New("mmap: file is not mapped")
+
+// Map is a file, or its first bytes, mapped into memory.
+type Map struct {
+	fd     uintptr
+	mode   Mode
+	b      []byte
+	closed bool
+}
+
+// New maps the first size bytes of the file open on fd. The file must be
+// open for reading, and for writing too if mode is ReadWrite, and must be at
+// least size bytes long. A size of zero maps nothing, and Bytes is empty
+// until Remap grows the mapping.
+func New(fd uintptr, size int, mode Mode) (*Map, error) {
+	m := &Map{fd: fd, mode: mode}
+	if err := m.mmap(size); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Bytes returns the mapped memory. The slice is only valid until the next
+// Remap or Unmap; using it after those faults.
+func (m *Map) Bytes() []byte {
+	return m.b
+}
+
+// Mode returns how the file is mapped.
+func (m *Map) Mode() Mode {
+	return m.mode
+}
+
+// Sync writes the changes made through the mapping back to the file and
+// waits for them to reach it. A read-only mapping has nothing to sync.
+func (m *Map) Sync() error {
+	if m.closed {
+		return ErrUnmapped
+	}
+	if m.mode == ReadOnly || len(m.b) == 0 {
+		return nil
+	}
+	return msync(m.b)
+}
+
+// Remap maps the first size bytes of the file again, typically after the
+// file was grown so the mapping can cover the new bytes. Changes made
+// through the old mapping are kept, since they're in the file's pages, but
+// slices returned by Bytes before are no longer valid.
+func (m *Map) Remap(size int) error {
+	if m.closed {
+		return ErrUnmapped
+	}
+	if err := m.munmap(); err != nil {
+		return err
+	}
+	return m.mmap(size)
+}
+
+// Unmap releases the mapping. Changes made through it still reach the file,
+// but only Sync waits for them to. Unmapping twice is a no-op.
+func (m *Map) Unmap() error {
+	if m.closed {
+		return nil
+	}
+	if err := m.munmap(); err != nil {
+		return err
+	}
+	m.closed = true
+	return nil
+}
+
+func (m *Map) mmap(size int) error {
+	if size < 0 {
+		return errors.New("mmap: negative size")
+	}
+	if size == 0 {
+		// mmap refuses empty mappings
+		m.b = nil
+		return nil
+	}
+	b, err := mmap(m.fd, size, m.mode)
+	if err != nil {
+		return err
+	}
+	m.b = b
+	return nil
+}
+
+func (m *Map) munmap() error {
+	if len(m.b) == 0 {
+		return nil
+	}
+	if err := munmap(m.b); err != nil {
+		return err
+	}
+	m.b = nil
+	return nil
+}
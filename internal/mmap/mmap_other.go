@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package mmap
+
+import "errors"
+
+// On other systems nothing can be mapped; callers are expected to check for
+// errors.ErrUnsupported and fall back to reading the file.
+
+func mmap(fd uintptr, size int, mode Mode) ([]byte, error) { return nil, errors.ErrUnsupported }
+func munmap(b []byte) error                                { return errors.ErrUnsupported }
+func msync(b []byte) error                                 { return errors.ErrUnsupported }
@@ -0,0 +1,50 @@
+package mmap
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMap(t *testing.T) {
+	f, err := ioutil.TempFile("", "mmap_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// an empty file maps to nothing until it grows
+	m, err := New(f.Fd(), 0, ReadWrite)
+	require.NoError(t, err)
+	require.Empty(t, m.Bytes())
+	require.NoError(t, m.Sync())
+
+	require.NoError(t, f.Truncate(5))
+	require.NoError(t, m.Remap(5))
+	copy(m.Bytes(), "hello")
+	require.NoError(t, m.Sync())
+
+	// writes made before a remap are kept
+	require.NoError(t, f.Truncate(11))
+	require.NoError(t, m.Remap(11))
+	require.Equal(t, "hello", string(m.Bytes()[:5]))
+	copy(m.Bytes()[5:], " world")
+	require.NoError(t, m.Sync())
+	require.NoError(t, m.Unmap())
+	require.NoError(t, m.Unmap())
+	require.Equal(t, ErrUnmapped, m.Sync())
+	require.Equal(t, ErrUnmapped, m.Remap(11))
+
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+
+	// a read-only mapping sees the file's contents and has nothing to sync
+	ro, err := New(f.Fd(), 11, ReadOnly)
+	require.NoError(t, err)
+	require.Equal(t, ReadOnly, ro.Mode())
+	require.Equal(t, "hello world", string(ro.Bytes()))
+	require.NoError(t, ro.Sync())
+	require.NoError(t, ro.Unmap())
+}
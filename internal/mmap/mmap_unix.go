@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd
+
+package mmap
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func mmap(fd uintptr, size int, mode Mode) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if mode == ReadWrite {
+		prot |= syscall.PROT_WRITE
+	}
+	b, err := syscall.Mmap(int(fd), 0, size, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return b, nil
+}
+
+func munmap(b []byte) error {
+	return os.NewSyscallError("munmap", syscall.Munmap(b))
+}
+
+func msync(b []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), syscall.MS_SYNC)
+	if errno != 0 {
+		return os.NewSyscallError("msync", errno)
+	}
+	return nil
+}
@@ -1,9 +1,91 @@
 package log
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/MRSharff/distributed-services-with-go/metrics"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	Encryption struct {
+		// Keyring enables encryption at rest when set. Segments created
+		// while it is set are encrypted with its active key; existing plain
+		// segments stay plain until they are re-encrypted.
+		Keyring *Keyring
+	}
+	Tier struct {
+		// Store enables tiered storage when set. Once a segment is closed
+		// and more than LocalSegments segments are on disk, the oldest
+		// closed segment is uploaded to Store and deleted locally. That
+		// happens in the background, so appends don't wait for it.
+		Store ObjectStore
+		// LocalSegments is the number of segments, including the active
+		// one, that are kept on local disk.
+		LocalSegments int
+		// CacheDir is where segments fetched back from Store are kept
+		// while they're read. Defaults to the "cache" directory in the
+		// log's Dir.
+		CacheDir string
+		// CacheSegments is the number of fetched segments kept in
+		// CacheDir.
+		CacheSegments int
+		// OnError, if set, is called with the error when offloading a
+		// segment fails. The segment stays on local disk, and offloading
+		// it is tried again after the next roll.
+		OnError func(error)
+	}
+	Producer struct {
+		// IdleTimeout is how long the log remembers a producer that
+		// appends nothing. Once it's forgotten, its retries aren't
+		// recognized any more, and its next record can have any
+		// sequence, like its first. Defaults to a day.
+		IdleTimeout time.Duration
+	}
+	Transaction struct {
+		// Timeout is how long a transaction can go without records being
+		// appended to it before it's aborted. Defaults to a minute.
+		Timeout time.Duration
+	}
+	// ReadOnly opens the log for tools that only read it. Its directory is
+	// locked shared rather than exclusively, so any number of read-only
+	// opens can run alongside each other but none alongside a writable one.
+	// Nothing in the directory is changed, not even to recover from a
+	// crash, which is left to the next writable open, and the methods that
+	// would write return ErrReadOnly. It doesn't support tiered storage.
+	ReadOnly bool
+	// FS is the filesystem the log keeps its files in. Defaults to OSFS.
+	// Tiered storage's object store and the offline tools in inspect.go
+	// always use the OS's filesystem.
+	FS FS
+	// Metrics is where the log registers its metrics. The log keeps them in
+	// a registry of its own if it's nil.
+	Metrics *metrics.Registry
+}
+
+// fs returns the filesystem the log's files are in.
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return OSFS
+	}
+	return c.FS
+}
+
+// Validate checks the segment limits are usable. NewLog fills in defaults for
+// the zero values rather than calling it; it's for configs that come from
+// users, like the server's.
+func (c Config) Validate() error {
+	if c.Segment.MaxStoreBytes <= lenWidth {
+		return fmt.Errorf("MaxStoreBytes must be more than %d bytes, the size of a record's length prefix", lenWidth)
+	}
+	// a partial entry's worth of index would never be used
+	if c.Segment.MaxIndexBytes < entWidth || c.Segment.MaxIndexBytes%entWidth != 0 {
+		return fmt.Errorf("MaxIndexBytes must be a multiple of %d bytes, the size of an index entry", entWidth)
+	}
+	return nil
 }
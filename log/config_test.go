@@ -0,0 +1,23 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 100
+	require.NoError(t, c.Validate())
+
+	c.Segment.MaxIndexBytes = 1024
+	require.EqualError(t, c.Validate(), "MaxIndexBytes must be a multiple of 12 bytes, the size of an index entry")
+	c.Segment.MaxIndexBytes = 0
+	require.Error(t, c.Validate())
+
+	c.Segment.MaxIndexBytes = entWidth
+	c.Segment.MaxStoreBytes = lenWidth
+	require.EqualError(t, c.Validate(), "MaxStoreBytes must be more than 8 bytes, the size of a record's length prefix")
+}
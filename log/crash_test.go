@@ -0,0 +1,517 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// The crash tests run a workload against a log on a crashFS, failing the
+// workload's file operations one at a time, then reopen the log as it would
+// be found after the crash and check that nothing it acknowledged was lost.
+
+var (
+	errInjected = errors.New("injected fault")
+	errCrashed  = errors.New("process crashed")
+)
+
+// opKind is the kind of file operation a fault is injected into.
+type opKind int
+
+const (
+	opWrite opKind = iota // Write, WriteAt and Truncate
+	opSync                // Sync of a file or a mapping
+	opOther               // everything else, including reads
+	numOpKinds
+)
+
+// fault is what happens at the operation a fault is injected into. After any
+// fault the process is considered dead: every later operation fails.
+type fault int
+
+const (
+	// faultShortWrite writes half of the data and fails; the files are
+	// then reopened as the process left them.
+	faultShortWrite fault = iota
+	// faultSyncError fails an fsync, then loses power.
+	faultSyncError
+	// faultPowerLoss loses power before the operation: the files are
+	// reopened with only what was synced to them.
+	faultPowerLoss
+)
+
+func (f fault) String() string {
+	return [...]string{"short write", "sync error", "power loss"}[f]
+}
+
+// ops returns the number of operations out of ops, counted by kind, that
+// the fault can be injected into.
+func (f fault) ops(ops [numOpKinds]int) int {
+	switch f {
+	case faultShortWrite:
+		return ops[opWrite]
+	case faultSyncError:
+		return ops[opSync]
+	}
+	return ops[opWrite] + ops[opSync] + ops[opOther]
+}
+
+// injects reports whether the fault is injected into an operation of the
+// given kind.
+func (f fault) injects(kind opKind) bool {
+	switch f {
+	case faultShortWrite:
+		return kind == opWrite
+	case faultSyncError:
+		return kind == opSync
+	}
+	return true
+}
+
+// crashFS is a memFS that remembers what was synced to each file, so it can
+// simulate losing power. Creating, renaming and removing files are treated as
+// durable straight away, as they are on a journaling filesystem.
+type crashFS struct {
+	mem *memFS
+	// durable holds the files' contents as of their last sync
+	durable map[string][]byte
+
+	// ops counts the operations of each kind, and faultOps those the
+	// fault can be injected into. It's injected into operation failAt of
+	// those, if failAt isn't 0.
+	ops      [numOpKinds]int
+	faultOps int
+	fault    fault
+	failAt   int
+	dead     bool
+}
+
+func newCrashFS() *crashFS {
+	return &crashFS{mem: NewMemFS().(*memFS), durable: make(map[string][]byte)}
+}
+
+// op counts an operation and decides whether it fails. It returns a non-nil
+// error for an operation that mustn't be carried out, and true for a write
+// that should be cut short.
+func (c *crashFS) op(kind opKind) (short bool, err error) {
+	if c.dead {
+		return false, errCrashed
+	}
+	c.ops[kind]++
+	if c.failAt == 0 || !c.fault.injects(kind) {
+		return false, nil
+	}
+	if c.faultOps++; c.faultOps != c.failAt {
+		return false, nil
+	}
+	c.dead = true
+	if c.fault == faultShortWrite {
+		return true, nil
+	}
+	return false, errInjected
+}
+
+// restart returns the filesystem as the next process finds it after the
+// crash.
+func (c *crashFS) restart() *crashFS {
+	if c.fault == faultShortWrite {
+		// the crashed process's locks went with it
+		for _, d := range c.mem.files {
+			d.locks = nil
+		}
+		return &crashFS{mem: c.mem, durable: c.durable}
+	}
+	mem := NewMemFS().(*memFS)
+	for dir := range c.mem.dirs {
+		mem.dirs[dir] = true
+	}
+	durable := make(map[string][]byte)
+	for name, b := range c.durable {
+		mem.files[name] = &memData{b: append([]byte(nil), b...), mode: 0644}
+		durable[name] = b
+	}
+	return &crashFS{mem: mem, durable: durable}
+}
+
+// sync records the file's current contents as durable.
+func (c *crashFS) sync(name string) {
+	d := c.mem.files[name]
+	if d == nil {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	c.durable[name] = append([]byte(nil), d.b...)
+}
+
+func (c *crashFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := c.op(opOther); err != nil {
+		return nil, err
+	}
+	f, err := c.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.durable[f.Name()]; !ok {
+		c.durable[f.Name()] = nil
+	}
+	return &crashFile{fs: c, f: f.(*memFile)}, nil
+}
+
+func (c *crashFS) Stat(name string) (os.FileInfo, error) {
+	if _, err := c.op(opOther); err != nil {
+		return nil, err
+	}
+	return c.mem.Stat(name)
+}
+
+func (c *crashFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if _, err := c.op(opOther); err != nil {
+		return nil, err
+	}
+	return c.mem.ReadDir(name)
+}
+
+func (c *crashFS) Remove(name string) error {
+	if _, err := c.op(opOther); err != nil {
+		return err
+	}
+	delete(c.durable, path.Clean(name))
+	return c.mem.Remove(name)
+}
+
+func (c *crashFS) RemoveAll(name string) error {
+	if _, err := c.op(opOther); err != nil {
+		return err
+	}
+	name = path.Clean(name)
+	for file := range c.durable {
+		if file == name || isWithin(file, name) {
+			delete(c.durable, file)
+		}
+	}
+	return c.mem.RemoveAll(name)
+}
+
+func (c *crashFS) Rename(oldname, newname string) error {
+	if _, err := c.op(opOther); err != nil {
+		return err
+	}
+	if err := c.mem.Rename(oldname, newname); err != nil {
+		return err
+	}
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	if b, ok := c.durable[oldname]; ok {
+		delete(c.durable, oldname)
+		c.durable[newname] = b
+	}
+	return nil
+}
+
+func (c *crashFS) MkdirAll(name string, perm os.FileMode) error {
+	if _, err := c.op(opOther); err != nil {
+		return err
+	}
+	return c.mem.MkdirAll(name, perm)
+}
+
+func (c *crashFS) Map(f File, writable bool) (Mapping, error) {
+	if _, err := c.op(opOther); err != nil {
+		return nil, err
+	}
+	cf := f.(*crashFile)
+	m, err := c.mem.Map(cf.f, writable)
+	if err != nil {
+		return nil, err
+	}
+	return &crashMapping{Mapping: m, file: cf}, nil
+}
+
+// SyncDir only counts the operation: the directory changes are durable
+// straight away.
+func (c *crashFS) SyncDir(name string) error {
+	_, err := c.op(opOther)
+	return err
+}
+
+func (c *crashFS) Lock(f File, exclusive bool) error {
+	if _, err := c.op(opOther); err != nil {
+		return err
+	}
+	return c.mem.Lock(f.(*crashFile).f, exclusive)
+}
+
+type crashFile struct {
+	fs *crashFS
+	f  *memFile
+}
+
+func (f *crashFile) Read(p []byte) (int, error) {
+	if _, err := f.fs.op(opOther); err != nil {
+		return 0, err
+	}
+	return f.f.Read(p)
+}
+
+func (f *crashFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.fs.op(opOther); err != nil {
+		return 0, err
+	}
+	return f.f.ReadAt(p, off)
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	short, err := f.fs.op(opWrite)
+	if err != nil {
+		return 0, err
+	}
+	if short {
+		n, _ := f.f.Write(p[:len(p)/2])
+		return n, errInjected
+	}
+	return f.f.Write(p)
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	short, err := f.fs.op(opWrite)
+	if err != nil {
+		return 0, err
+	}
+	if short {
+		n, _ := f.f.WriteAt(p[:len(p)/2], off)
+		return n, errInjected
+	}
+	return f.f.WriteAt(p, off)
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	short, err := f.fs.op(opWrite)
+	if err != nil {
+		return err
+	}
+	if short {
+		return errInjected
+	}
+	return f.f.Truncate(size)
+}
+
+func (f *crashFile) Sync() error {
+	if _, err := f.fs.op(opSync); err != nil {
+		return err
+	}
+	f.fs.sync(f.f.Name())
+	return f.f.Sync()
+}
+
+func (f *crashFile) Close() error {
+	if _, err := f.fs.op(opOther); err != nil {
+		return err
+	}
+	return f.f.Close()
+}
+
+func (f *crashFile) Stat() (os.FileInfo, error) {
+	if _, err := f.fs.op(opOther); err != nil {
+		return nil, err
+	}
+	return f.f.Stat()
+}
+
+func (f *crashFile) Name() string { return f.f.Name() }
+
+// crashMapping syncs its file's contents, which include the writes made
+// through it, like msync does.
+type crashMapping struct {
+	Mapping
+	file *crashFile
+}
+
+func (m *crashMapping) Sync() error {
+	if _, err := m.file.fs.op(opSync); err != nil {
+		return err
+	}
+	m.file.fs.sync(m.file.Name())
+	return m.Mapping.Sync()
+}
+
+const (
+	crashRecords = 26
+	// crashTruncateAt is when the workload truncates the log, and
+	// crashLowest the offset it truncates up to.
+	crashTruncateAt = 14
+	crashLowest     = 5
+)
+
+func crashConfig(fsys FS) Config {
+	c := Config{FS: fsys}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.MaxIndexBytes = entWidth * 4
+	return c
+}
+
+// crashValue is the value of the record appended at off.
+func crashValue(off uint64) string {
+	return fmt.Sprintf("record %d", off)
+}
+
+// crashWorkload opens the log, appends records, syncing after every third,
+// truncates it part way through and closes it, stopping at the first error.
+// It returns the number of records acknowledged by a successful Sync or
+// Close, and whether Truncate was called.
+func crashWorkload(fsys FS) (acked uint64, truncated bool) {
+	log, err := NewLog("/log", crashConfig(fsys))
+	if err != nil {
+		return 0, false
+	}
+	for off := uint64(0); off < crashRecords; off++ {
+		if _, err = log.Append(&api.Record{Value: []byte(crashValue(off))}); err != nil {
+			return acked, truncated
+		}
+		if off%3 == 2 {
+			if err = log.Sync(); err != nil {
+				return acked, truncated
+			}
+			acked = off + 1
+		}
+		if off == crashTruncateAt {
+			truncated = true
+			if err = log.Truncate(crashLowest); err != nil {
+				return acked, truncated
+			}
+		}
+	}
+	if err = log.Close(); err != nil {
+		return acked, truncated
+	}
+	return crashRecords, truncated
+}
+
+func TestCrashRecovery(t *testing.T) {
+	// count the operations of a run without faults, including those done
+	// by NewLog and Close, so crashing while opening and closing the log
+	// is covered too
+	dry := newCrashFS()
+	require.NoError(t, dry.MkdirAll("/log", 0755))
+	dry.ops = [numOpKinds]int{}
+	acked, _ := crashWorkload(dry)
+	require.Equal(t, uint64(crashRecords), acked)
+
+	for _, f := range []fault{faultShortWrite, faultSyncError, faultPowerLoss} {
+		total := f.ops(dry.ops)
+		require.NotZero(t, total)
+		if f == faultPowerLoss {
+			// and lose power after closing the log too
+			total++
+		}
+		for failAt := 1; failAt <= total; failAt++ {
+			name := fmt.Sprintf("%s at operation %d", f, failAt)
+			fsys := newCrashFS()
+			require.NoError(t, fsys.MkdirAll("/log", 0755))
+			fsys.fault, fsys.failAt = f, failAt
+			acked, truncated := crashWorkload(fsys)
+			checkRecovered(t, name, fsys.restart(), acked, truncated)
+		}
+	}
+}
+
+// checkRecovered reopens the log after a crash and checks that every
+// acknowledged record that wasn't truncated is there, and that every offset
+// the log reports holds the record appended at it.
+func checkRecovered(t *testing.T, name string, fsys *crashFS, acked uint64, truncated bool) {
+	t.Helper()
+	log, err := NewLog("/log", crashConfig(fsys))
+	require.NoError(t, err, name)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err, name)
+	next := log.activeSegment.nextOffset
+	require.LessOrEqual(t, lowest, next, name)
+	require.GreaterOrEqual(t, next, acked, "%s: lost acknowledged records", name)
+	// Truncate removes the segments that end at or before crashLowest
+	switch {
+	case !truncated:
+		require.Equal(t, uint64(0), lowest, "%s: lost records that weren't truncated", name)
+	case acked > crashLowest+1:
+		require.LessOrEqual(t, lowest, uint64(crashLowest+1), "%s: truncated too much", name)
+	}
+	for off := lowest; off < next; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err, "%s: reading offset %d of [%d, %d)", name, off, lowest, next)
+		require.Equal(t, off, record.Offset, name)
+		require.Equal(t, crashValue(off), string(record.Value), name)
+	}
+	_, err = log.Read(next)
+	require.Error(t, err, name)
+
+	// the recovered log carries on from where it left off
+	off, err := log.Append(&api.Record{Value: []byte(crashValue(next))})
+	require.NoError(t, err, name)
+	require.Equal(t, next, off, name)
+	require.NoError(t, log.Close(), name)
+}
+
+// crashReencrypt opens the log crashWorkload left with a keyring, re-encrypts
+// its segments and closes it, stopping at the first error.
+func crashReencrypt(fsys FS, keyring *Keyring) {
+	c := crashConfig(fsys)
+	c.Encryption.Keyring = keyring
+	log, err := NewLog("/log", c)
+	if err != nil {
+		return
+	}
+	if err = log.Reencrypt(); err != nil {
+		return
+	}
+	_ = log.Close()
+}
+
+func TestCrashReencrypt(t *testing.T) {
+	keyring := NewKeyring()
+	require.NoError(t, keyring.Add("k1", bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, keyring.SetActive("k1"))
+	// setup leaves a plain log, written without faults, to re-encrypt
+	setup := func() *crashFS {
+		fsys := newCrashFS()
+		require.NoError(t, fsys.MkdirAll("/log", 0755))
+		acked, _ := crashWorkload(fsys)
+		require.Equal(t, uint64(crashRecords), acked)
+		fsys.ops = [numOpKinds]int{}
+		return fsys
+	}
+
+	dry := setup()
+	crashReencrypt(dry, keyring)
+	for _, f := range []fault{faultShortWrite, faultSyncError, faultPowerLoss} {
+		total := f.ops(dry.ops)
+		require.NotZero(t, total)
+		for failAt := 1; failAt <= total; failAt++ {
+			name := fmt.Sprintf("%s at operation %d", f, failAt)
+			fsys := setup()
+			fsys.fault, fsys.failAt = f, failAt
+			crashReencrypt(fsys, keyring)
+
+			// every record is still there, whether its segment was
+			// re-encrypted or not
+			c := crashConfig(fsys.restart())
+			c.Encryption.Keyring = keyring
+			log, err := NewLog("/log", c)
+			require.NoError(t, err, name)
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err, name)
+			require.LessOrEqual(t, lowest, uint64(crashLowest+1), name)
+			for off := lowest; off < crashRecords; off++ {
+				record, err := log.Read(off)
+				require.NoError(t, err, "%s: reading offset %d", name, off)
+				require.Equal(t, crashValue(off), string(record.Value), name)
+			}
+			require.NoError(t, log.Reencrypt(), name)
+			require.NoError(t, log.Close(), name)
+		}
+	}
+}
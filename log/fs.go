@@ -0,0 +1,231 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/MRSharff/distributed-services-with-go/internal/mmap"
+)
+
+// FS is the filesystem the log keeps its segments and state in. OSFS is the
+// real one; NewMemFS returns one held in memory, for tests and for logs that
+// don't need to outlive the process.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the directory's entries sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	MkdirAll(name string, perm os.FileMode) error
+	// Map maps the file's contents into memory, for writing too if
+	// writable. After the file changes size the mapping must be remapped.
+	Map(f File, writable bool) (Mapping, error)
+	// Lock takes an advisory lock on the file without waiting for it, one
+	// that excludes every other lock if exclusive and only exclusive ones
+	// otherwise. It returns errLockHeld if the lock is held elsewhere.
+	// Closing the file releases it.
+	Lock(f File, exclusive bool) error
+	// SyncDir commits the directory's entries to stable storage, so that
+	// the files created, renamed or removed in it stay that way.
+	SyncDir(name string) error
+}
+
+// File is an open file of an FS. *os.File satisfies it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Mapping is a file's contents mapped into memory. Writes to Bytes change the
+// file; Sync makes sure they've reached it.
+type Mapping interface {
+	Bytes() []byte
+	Sync() error
+	// Remap maps the file again at its current size, keeping the writes
+	// made so far. Slices Bytes returned before are no longer valid.
+	Remap() error
+	// Unmap releases the mapping without syncing it.
+	Unmap() error
+}
+
+// OSFS is the operating system's filesystem.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// don't return a nil *os.File in a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) ReadDir(name string) ([]os.FileInfo, error)   { return ioutil.ReadDir(name) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (osFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) SyncDir(name string) error                    { return syncDir(name) }
+
+// Map memory-maps files that have a descriptor, and falls back to copying
+// the contents of those that don't, or when the system can't map files.
+func (osFS) Map(f File, writable bool) (Mapping, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return copyMap(f, writable)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	mode := mmap.ReadOnly
+	if writable {
+		mode = mmap.ReadWrite
+	}
+	m, err := mmap.New(fd.Fd(), int(info.Size()), mode)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return copyMap(f, writable)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &osMapping{Map: m, f: f}, nil
+}
+
+// Lock takes a flock(2) lock, which is held by the open file rather than the
+// process, so two opens in one process exclude each other too. Where the
+// system has no flock, and for files without a descriptor, nothing is locked.
+func (osFS) Lock(f File, exclusive bool) error {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	return flock(fd.Fd(), exclusive)
+}
+
+type osMapping struct {
+	*mmap.Map
+	f File
+}
+
+func (m *osMapping) Remap() error {
+	info, err := m.f.Stat()
+	if err != nil {
+		return err
+	}
+	return m.Map.Remap(int(info.Size()))
+}
+
+// copyMapping stands in for a memory map by copying the file's contents into
+// memory and writing them back on Sync.
+type copyMapping struct {
+	f        File
+	b        []byte
+	writable bool
+}
+
+func copyMap(f File, writable bool) (Mapping, error) {
+	m := &copyMapping{f: f, writable: writable}
+	if err := m.read(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *copyMapping) read() error {
+	info, err := m.f.Stat()
+	if err != nil {
+		return err
+	}
+	m.b = make([]byte, info.Size())
+	if _, err = m.f.ReadAt(m.b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (m *copyMapping) Bytes() []byte { return m.b }
+
+func (m *copyMapping) Sync() error {
+	if !m.writable {
+		return nil
+	}
+	_, err := m.f.WriteAt(m.b, 0)
+	return err
+}
+
+// Remap writes the copy back before reading the resized file, since a real
+// mapping's writes would already be in it. Bytes past a shrunk file's end
+// are dropped, as they would be with a real mapping.
+func (m *copyMapping) Remap() error {
+	info, err := m.f.Stat()
+	if err != nil {
+		return err
+	}
+	if m.writable {
+		b := m.b
+		if int64(len(b)) > info.Size() {
+			b = b[:info.Size()]
+		}
+		if _, err = m.f.WriteAt(b, 0); err != nil {
+			return err
+		}
+	}
+	return m.read()
+}
+
+func (m *copyMapping) Unmap() error {
+	m.b = nil
+	return nil
+}
+
+// readFile reads the named file, like os.ReadFile.
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFileAtomic replaces the named file with b, writing and syncing a
+// temporary file first and renaming it into place, so a crash leaves either
+// the old contents or the new ones. The directory is synced after the rename
+// for the new ones to stay.
+func writeFileAtomic(fsys FS, name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := fsys.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	if err = fsys.Rename(tmp, name); err != nil {
+		return err
+	}
+	return fsys.SyncDir(path.Dir(name))
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package log
+
+// flock does nothing where the system has no flock(2); nothing stops two
+// processes from opening the same log there.
+func flock(fd uintptr, exclusive bool) error {
+	return nil
+}
+
+// syncDir does nothing: directories can't be synced on their own there.
+func syncDir(name string) error {
+	return nil
+}
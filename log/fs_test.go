@@ -0,0 +1,98 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	_, err := fsys.OpenFile("/data/a", os.O_RDWR|os.O_CREATE, 0644)
+	require.True(t, os.IsNotExist(err), "the directory doesn't exist yet")
+	require.NoError(t, fsys.MkdirAll("/data/sub", 0755))
+
+	f, err := fsys.OpenFile("/data/a", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("world"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = f.ReadAt(b, 6)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(b))
+	_, err = f.ReadAt(b, 8)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, f.Close())
+	_, err = f.Write([]byte("!"))
+	require.Error(t, err)
+
+	// writes through a mapping are seen by the file
+	f, err = fsys.OpenFile("/data/a", os.O_RDWR, 0)
+	require.NoError(t, err)
+	m, err := fsys.Map(f, true)
+	require.NoError(t, err)
+	copy(m.Bytes(), "HELLO")
+	require.NoError(t, m.Sync())
+	require.NoError(t, f.Truncate(5))
+	require.NoError(t, m.Remap())
+	require.Equal(t, "HELLO", string(m.Bytes()))
+	require.NoError(t, m.Unmap())
+	b, err = ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(b))
+	require.NoError(t, f.Close())
+
+	require.NoError(t, fsys.Rename("/data/a", "/data/b"))
+	infos, err := fsys.ReadDir("/data")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, "b", infos[0].Name())
+	require.Equal(t, int64(5), infos[0].Size())
+	require.Equal(t, "sub", infos[1].Name())
+	require.True(t, infos[1].IsDir())
+
+	require.Error(t, fsys.Remove("/data"), "the directory isn't empty")
+	require.NoError(t, fsys.RemoveAll("/data"))
+	_, err = fsys.Stat("/data/b")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLogOnMemFS(t *testing.T) {
+	c := Config{FS: NewMemFS()}
+	c.Segment.MaxStoreBytes = 64
+	require.NoError(t, c.FS.MkdirAll("/log", 0755))
+	log, err := NewLog("/log", c)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog("/log", c)
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	for off := uint64(0); off <= highest; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(record.Value))
+	}
+
+	require.NoError(t, log.Truncate(1))
+	_, err = log.Read(0)
+	require.Error(t, err)
+	require.NoError(t, log.Remove())
+	_, err = c.FS.Stat("/log")
+	require.True(t, os.IsNotExist(err))
+}
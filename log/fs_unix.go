@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd
+
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+func flock(fd uintptr, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(fd), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
+
+// syncDir syncs the directory, so the files created, renamed or deleted in it
+// are too.
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
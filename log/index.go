@@ -4,19 +4,10 @@ package log
 // We do not handle ungraceful shutdowns to keep the code simple.
 
 import (
+	"fmt"
 	"io"
-	"os"
 )
 
-// The book has tyonstate in place of tysonmote but there was an error when
-// downloading that package.
-// go: WriteALogPackage/log imports
-//	github.com/tysontate/gommap: github.com/tysontate/gommap@v0.0.1: parsing go.mod:
-//	module declares its path as: github.com/tysonmote/gommap
-//	        but was required as: github.com/tysontate/gommap
-// I'd like to see if I can make my own solution for mmap and learn from that.
-import "github.com/tysonmote/gommap"
-
 // Width constants define the number of bytes that make up each index entry
 var (
 	// entry offsets are uint32s which are 4 bytes
@@ -30,38 +21,53 @@ var (
 	entWidth = offWidth + posWidth
 )
 
+// minIndexBytes is the size an empty index file first grows to, and the
+// least it grows by after that. It's a multiple of entWidth.
+const minIndexBytes = 1024 * 12
+
 type index struct {
 	// the persisted file
-	file *os.File
+	file File
 
-	mmap gommap.MMap
+	// mapping is the file mapped into memory by the log's FS, and mmap its
+	// bytes
+	mapping Mapping
+	mmap    []byte
 
 	// the size of the index (and where to write the next entry appended to the index)
 	size uint64
+
+	// maxBytes is the most the file grows to, and sealed whether the index
+	// was sealed and mapped read-only
+	maxBytes uint64
+	sealed   bool
+
+	// readOnly is set for the indexes of read-only logs, which are mapped
+	// read-only from the start and never trimmed
+	readOnly bool
+
+	fs FS
 }
 
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f File, c Config) (*index, error) {
 	idx := &index{
-		file: f,
+		file:     f,
+		maxBytes: c.Segment.MaxIndexBytes,
+		readOnly: c.ReadOnly,
+		fs:       c.fs(),
 	}
-	info, err := os.Stat(f.Name())
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(info.Size())
 
-	// grow the file to the max index size before memory-mapping the file (why?)
-	// Why? Once it is memory mapped, we cannot resize the file.
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
-		return nil, err
-	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED,
-	); err != nil {
+	// the file is only mapped as far as it goes; Write grows it, and the
+	// mapping with it, as entries are appended
+	if idx.mapping, err = idx.fs.Map(f, !idx.readOnly); err != nil {
 		return nil, err
 	}
+	idx.mmap = idx.mapping.Bytes()
 	return idx, nil
 }
 
@@ -78,7 +84,7 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 		out = uint32(in) // todo: Why do we immediately assign in to out
 	}
 	pos = uint64(out) * entWidth // todo: And then immediately recast it back to a uint64 to use
-	if outOfBounds := i.size < pos+entWidth; outOfBounds {
+	if outOfBounds := i.size < pos+entWidth || uint64(len(i.mmap)) < pos+entWidth; outOfBounds {
 		return 0, 0, io.EOF
 	}
 	out = enc.Uint32(i.mmap[pos : pos+offWidth])
@@ -87,8 +93,13 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 }
 
 func (i *index) Write(off uint32, pos uint64) error {
+	if i.sealed {
+		return fmt.Errorf("index %s is sealed", i.Name())
+	}
 	if uint64(len(i.mmap)) < i.size+entWidth {
-		return io.EOF
+		if err := i.grow(); err != nil {
+			return err
+		}
 	}
 	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
@@ -96,27 +107,88 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
-func (i *index) Name() string {
-	return i.file.Name()
+// grow doubles the file, at least by minIndexBytes and at most to maxBytes,
+// and remaps it. It returns io.EOF if the index is full.
+func (i *index) grow() error {
+	size := 2 * uint64(len(i.mmap))
+	if size < uint64(len(i.mmap))+minIndexBytes {
+		size = uint64(len(i.mmap)) + minIndexBytes
+	}
+	if size > i.maxBytes {
+		size = i.maxBytes
+	}
+	if size < i.size+entWidth {
+		return io.EOF
+	}
+	if err := i.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if err := i.mapping.Remap(); err != nil {
+		return err
+	}
+	i.mmap = i.mapping.Bytes()
+	return nil
 }
 
-// Close ensures the memory-mapped file has synced its data to the persisted file
-// and that the persisted file has flushed its contents to stable storage. It then
-// truncates the persisted file to the amount of data that's actually in it and
-// closes the file.
-func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+// Sync commits the entries written so far to stable storage.
+func (i *index) Sync() error {
+	if err := i.mapping.Sync(); err != nil {
 		return err
 	}
-	if err := i.file.Sync(); err != nil {
+	return i.file.Sync()
+}
+
+// seal trims the file to the entries written and maps it again read-only,
+// for a segment that won't be appended to any more.
+func (i *index) seal() error {
+	if i.sealed {
+		return nil
+	}
+	if i.readOnly {
+		i.sealed = true
+		return nil
+	}
+	if err := i.trim(); err != nil {
+		return err
+	}
+	var err error
+	if i.mapping, err = i.fs.Map(i.file, false); err != nil {
 		return err
 	}
+	i.mmap = i.mapping.Bytes()
+	i.sealed = true
+	return nil
+}
 
-	// We grew the file past the size of the index so we could get a fully memory-mapped
-	// file when we created the index. Now we need to truncate the file to the
-	// true size of the index when we close it.
+// trim syncs and unmaps the file, then cuts off the room it grew past the
+// entries written and syncs that too.
+func (i *index) trim() error {
+	if err := i.mapping.Sync(); err != nil {
+		return err
+	}
+	i.mmap = nil
+	if err := i.mapping.Unmap(); err != nil {
+		return err
+	}
 	if err := i.file.Truncate(int64(i.size)); err != nil {
 		return err
 	}
+	return i.file.Sync()
+}
+
+func (i *index) Name() string {
+	return i.file.Name()
+}
+
+// Close trims the file to the entries written, unless the index is sealed
+// and already was, and closes it.
+func (i *index) Close() error {
+	if i.sealed {
+		if err := i.mapping.Unmap(); err != nil {
+			return err
+		}
+	} else if err := i.trim(); err != nil {
+		return err
+	}
 	return i.file.Close()
 }
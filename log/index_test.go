@@ -58,3 +58,48 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexGrowAndSeal(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * minIndexBytes
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	// the file grows as entries are written rather than up front
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+	entries := c.Segment.MaxIndexBytes / entWidth
+	for i := uint64(0); i < entries; i++ {
+		require.NoError(t, idx.Write(uint32(i), i*10))
+		if i == 0 {
+			info, err = f.Stat()
+			require.NoError(t, err)
+			require.Equal(t, int64(minIndexBytes), info.Size())
+		}
+	}
+	require.Equal(t, io.EOF, idx.Write(uint32(entries), 0), "the index is full")
+	for i := uint64(0); i < entries; i++ {
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), off)
+		require.Equal(t, i*10, pos)
+	}
+
+	// a sealed index is trimmed, still readable and can't be written to
+	idx.size -= entWidth
+	require.NoError(t, idx.seal())
+	info, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(idx.size), info.Size())
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(entries-2), off)
+	require.Equal(t, (entries-2)*10, pos)
+	require.Error(t, idx.Write(uint32(entries-1), 0))
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,401 @@
+package log
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// The functions in this file look inside a data directory without opening it
+// as a Log, which needs the directory to pass its checks against the
+// manifest and, unless it's read-only, recovers from a crash and creates a
+// segment if there isn't one. They're meant for offline tools, and lock the
+// directory the way a read-only Log does, or a writable one to repair it, so
+// they fail with a LockedError while a server has the log open.
+
+// SegmentInfo describes a segment's files on disk.
+type SegmentInfo struct {
+	BaseOffset uint64
+	// NextOffset is the offset after the segment's last valid index entry.
+	NextOffset uint64
+	StoreBytes int64
+	IndexBytes int64
+	// KeyID is the key the segment is encrypted with, empty if it's plain.
+	KeyID string
+}
+
+// Records returns the number of records in the segment.
+func (i SegmentInfo) Records() uint64 {
+	return i.NextOffset - i.BaseOffset
+}
+
+// Inconsistency is a problem Verify found in a segment.
+type Inconsistency struct {
+	BaseOffset uint64
+	Problem    string
+}
+
+func (i Inconsistency) Error() string {
+	return fmt.Sprintf("segment %d: %s", i.BaseOffset, i.Problem)
+}
+
+// indexEntry is an entry of an index file.
+type indexEntry struct {
+	off uint32
+	pos uint64
+}
+
+// segmentFiles is what a data directory holds for one base offset.
+type segmentFiles struct {
+	baseOffset             uint64
+	store, index           string
+	hasStore, hasIndex     bool
+	storeBytes, indexBytes int64
+}
+
+// listSegmentFiles pairs up the store and index files in dir by base offset.
+func listSegmentFiles(dir string) ([]*segmentFiles, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byOffset := make(map[uint64]*segmentFiles)
+	for _, file := range files {
+		baseOffset, ext, ok := parseSegmentName(file.Name())
+		if !ok {
+			continue
+		}
+		sf, ok := byOffset[baseOffset]
+		if !ok {
+			sf = &segmentFiles{
+				baseOffset: baseOffset,
+				store:      path.Join(dir, objectName(baseOffset, ".store")),
+				index:      path.Join(dir, objectName(baseOffset, ".index")),
+			}
+			byOffset[baseOffset] = sf
+		}
+		if ext == ".store" {
+			sf.hasStore, sf.storeBytes = true, file.Size()
+		} else {
+			sf.hasIndex, sf.indexBytes = true, file.Size()
+		}
+	}
+	var segments []*segmentFiles
+	for _, sf := range byOffset {
+		segments = append(segments, sf)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].baseOffset < segments[j].baseOffset
+	})
+	return segments, nil
+}
+
+// scanStore walks the frames of a store file and returns the positions of
+// the records in it, skipping the header of an encrypted store. torn is the
+// number of bytes at the end of the file that don't make up a whole frame,
+// as left behind by a write that was cut short.
+func scanStore(name string) (positions []uint64, keyID string, torn int64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	size := uint64(info.Size())
+	var pos uint64
+	lenBuf := make([]byte, lenWidth)
+	for pos+lenWidth <= size {
+		if _, err = f.ReadAt(lenBuf, int64(pos)); err != nil {
+			return nil, "", 0, err
+		}
+		n := enc.Uint64(lenBuf)
+		if n > size-pos-lenWidth {
+			break
+		}
+		if pos == 0 && n >= uint64(len(segmentHeaderMagic)) {
+			p := make([]byte, n)
+			if _, err = f.ReadAt(p, lenWidth); err != nil {
+				return nil, "", 0, err
+			}
+			if id, ok := decodeSegmentHeader(p); ok {
+				keyID = id
+				pos += lenWidth + n
+				continue
+			}
+		}
+		positions = append(positions, pos)
+		pos += lenWidth + n
+	}
+	return positions, keyID, int64(size - pos), nil
+}
+
+// readIndexEntries returns the entries of an index file. An index that
+// wasn't closed cleanly is still padded with zeros past its last entry, so
+// the entries are cut off at the first one that doesn't follow on from the
+// previous one or that points past the end of the store.
+func readIndexEntries(name string, storeSize int64) (entries []indexEntry, trailing int64, err error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var i uint64
+	for ; (i+1)*entWidth <= uint64(len(b)); i++ {
+		e := indexEntry{
+			off: enc.Uint32(b[i*entWidth : i*entWidth+offWidth]),
+			pos: enc.Uint64(b[i*entWidth+offWidth : (i+1)*entWidth]),
+		}
+		if uint64(e.off) != i || e.pos+lenWidth > uint64(storeSize) ||
+			(i > 0 && e.pos <= entries[i-1].pos) {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, int64(uint64(len(b)) - i*entWidth), nil
+}
+
+// Segments describes the segments in the given data directory.
+func Segments(dir string) ([]SegmentInfo, error) {
+	lock, err := lockDir(OSFS, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []SegmentInfo
+	for _, sf := range files {
+		info := SegmentInfo{
+			BaseOffset: sf.baseOffset,
+			NextOffset: sf.baseOffset,
+			StoreBytes: sf.storeBytes,
+			IndexBytes: sf.indexBytes,
+		}
+		if sf.hasStore {
+			if _, info.KeyID, _, err = scanStore(sf.store); err != nil {
+				return nil, err
+			}
+		}
+		if sf.hasIndex {
+			entries, _, err := readIndexEntries(sf.index, sf.storeBytes)
+			if err != nil {
+				return nil, err
+			}
+			info.NextOffset += uint64(len(entries))
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Verify checks that every segment in the data directory has both of its
+// files and that each index entry points at the matching record of its
+// store, and returns the problems it finds.
+func Verify(dir string) ([]Inconsistency, error) {
+	lock, err := lockDir(OSFS, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Inconsistency
+	report := func(sf *segmentFiles, format string, args ...interface{}) {
+		problems = append(problems, Inconsistency{
+			BaseOffset: sf.baseOffset,
+			Problem:    fmt.Sprintf(format, args...),
+		})
+	}
+	var prevNext uint64
+	for i, sf := range files {
+		if !sf.hasStore {
+			report(sf, "store file is missing")
+			continue
+		}
+		if !sf.hasIndex {
+			report(sf, "index file is missing")
+			continue
+		}
+		positions, _, torn, err := scanStore(sf.store)
+		if err != nil {
+			return nil, err
+		}
+		if torn > 0 {
+			report(sf, "store ends with %d bytes of a partially written record", torn)
+		}
+		entries, trailing, err := readIndexEntries(sf.index, sf.storeBytes)
+		if err != nil {
+			return nil, err
+		}
+		if trailing > 0 {
+			report(sf, "index has %d bytes after its last valid entry", trailing)
+		}
+		for j, e := range entries {
+			if j >= len(positions) {
+				break
+			}
+			if e.pos != positions[j] {
+				report(sf, "index entry %d points at position %d, record %d is at %d",
+					j, e.pos, j, positions[j])
+				break
+			}
+		}
+		if len(entries) != len(positions) {
+			report(sf, "index has %d entries but store has %d records",
+				len(entries), len(positions))
+		}
+		if i > 0 && sf.baseOffset < prevNext {
+			report(sf, "overlaps the previous segment, which ends at offset %d", prevNext)
+		}
+		prevNext = sf.baseOffset + uint64(len(entries))
+	}
+	return problems, nil
+}
+
+// RepairIndex rebuilds the index of the segment with the given base offset
+// from its store. A partially written record at the end of the store is cut
+// off, since it was never acknowledged. If that leaves a sealed segment with
+// fewer records than the manifest says it has, the manifest is updated so the
+// log still opens; the offsets lost between the segment and the next one then
+// read as out of range.
+func RepairIndex(dir string, baseOffset uint64) error {
+	lock, err := lockDir(OSFS, dir, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	storeName := path.Join(dir, objectName(baseOffset, ".store"))
+	indexName := path.Join(dir, objectName(baseOffset, ".index"))
+	positions, _, torn, err := scanStore(storeName)
+	if err != nil {
+		return err
+	}
+	if torn > 0 {
+		if err = cutFile(storeName, torn); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, uint64(len(positions))*entWidth)
+	for i, pos := range positions {
+		at := uint64(i) * entWidth
+		enc.PutUint32(b[at:at+offWidth], uint32(i))
+		enc.PutUint64(b[at+offWidth:at+entWidth], pos)
+	}
+	if err = writeFileAtomic(OSFS, indexName, b); err != nil {
+		return err
+	}
+	return setManifestEnd(OSFS, dir, baseOffset, baseOffset+uint64(len(positions)))
+}
+
+// cutFile cuts n bytes off the end of the named file and syncs it.
+func cutFile(name string, n int64) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = f.Truncate(info.Size() - n)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Dump calls fn with each record in the data directory whose offset is in
+// [from, to), oldest to newest. The config is only used for its keyring.
+func Dump(dir string, c Config, from, to uint64, fn func(*api.Record) error) error {
+	lock, err := lockDir(OSFS, dir, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, sf := range files {
+		if !sf.hasStore || !sf.hasIndex {
+			continue
+		}
+		if err = dumpSegment(sf, c, from, to, fn); err != nil {
+			return fmt.Errorf("segment %d: %w", sf.baseOffset, err)
+		}
+	}
+	return nil
+}
+
+func dumpSegment(sf *segmentFiles, c Config, from, to uint64, fn func(*api.Record) error) error {
+	entries, _, err := readIndexEntries(sf.index, sf.storeBytes)
+	if err != nil {
+		return err
+	}
+	if sf.baseOffset >= to || sf.baseOffset+uint64(len(entries)) <= from {
+		return nil
+	}
+	_, keyID, _, err := scanStore(sf.store)
+	if err != nil {
+		return err
+	}
+	var aead cipher.AEAD
+	if keyID != "" {
+		if c.Encryption.Keyring == nil {
+			return fmt.Errorf("encrypted with key %q but no keyring is configured", keyID)
+		}
+		if aead, err = c.Encryption.Keyring.aead(keyID); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(sf.store)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i, e := range entries {
+		off := sf.baseOffset + uint64(i)
+		if off < from || off >= to {
+			continue
+		}
+		p, err := readFrameAt(f, e.pos)
+		if err != nil {
+			return err
+		}
+		record, err := decodeRecord(aead, off, p)
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrameAt reads the length-prefixed frame at pos of a store file.
+func readFrameAt(r io.ReaderAt, pos uint64) ([]byte, error) {
+	size := make([]byte, lenWidth)
+	if _, err := r.ReadAt(size, int64(pos)); err != nil {
+		return nil, err
+	}
+	p := make([]byte, enc.Uint64(size))
+	if _, err := r.ReadAt(p, int64(pos+lenWidth)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
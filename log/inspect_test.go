@@ -0,0 +1,140 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	infos, err := Segments(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, uint64(0), infos[0].BaseOffset)
+	require.Equal(t, uint64(3), infos[0].NextOffset)
+	require.Equal(t, int64(entWidth*3), infos[0].IndexBytes)
+	require.Equal(t, uint64(3), infos[1].BaseOffset)
+	require.Equal(t, uint64(2), infos[1].Records())
+
+	problems, err := Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	var dumped []uint64
+	err = Dump(dir, c, 2, 4, func(record *api.Record) error {
+		require.Equal(t, []byte("hello world"), record.Value)
+		dumped = append(dumped, record.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, dumped)
+
+	// simulate a crash: the index is left padded out to MaxIndexBytes and
+	// the store ends with half a record
+	indexName := path.Join(dir, "3.index")
+	storeName := path.Join(dir, "3.store")
+	require.NoError(t, os.Truncate(indexName, int64(entWidth*3)))
+	f, err := os.OpenFile(storeName, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, '{'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	require.Equal(t, uint64(3), problems[0].BaseOffset)
+
+	require.NoError(t, RepairIndex(dir, 3))
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	read, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), read.Offset)
+	require.NoError(t, log.Close())
+
+	// a lost index can be rebuilt from scratch
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	require.Equal(t, []Inconsistency{{BaseOffset: 0, Problem: "index file is missing"}}, problems)
+	require.NoError(t, RepairIndex(dir, 0))
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestRepairSealedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 6 records make 3 full segments and an empty active one
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// tear the last record of sealed segment 2, which the log won't open
+	// with, since the manifest says the segment ends after it
+	storeName := path.Join(dir, objectName(2, ".store"))
+	info, err := os.Stat(storeName)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(storeName, info.Size()-1))
+	_, err = NewLog(dir, c)
+	requireProblems(t, err,
+		"segment 2 ends at offset 3 but the manifest says 4",
+		"offsets 3 to 3 are missing between segments 2 and 4",
+	)
+
+	require.NoError(t, RepairIndex(dir, 2))
+	problems, err := Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	m, err := readManifest(OSFS, dir)
+	require.NoError(t, err)
+	require.Equal(t, manifestSegment{BaseOffset: 2, Sealed: true, NextOffset: 3}, m.Segments[1])
+
+	// the torn record is lost, the others can be read
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, off := range []uint64{0, 1, 2, 4, 5} {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+}
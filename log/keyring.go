@@ -0,0 +1,164 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Keyring holds the keys used to encrypt segment store files at rest.
+//
+// Every key has an ID. The ID of the key a segment was encrypted with is kept
+// in the segment's header, so we can rotate the Active key without losing
+// the ability to read segments written under older keys.
+type Keyring struct {
+	// Active is the ID of the key newly created segments are encrypted with.
+	Active string
+
+	keys map[string][]byte
+}
+
+// keyringFile is the on-disk format of a keyring, e.g.
+//
+//	{
+//	  "active": "2022-06",
+//	  "keys": {
+//	    "2022-05": "<base64 encoded AES key>",
+//	    "2022-06": "<base64 encoded AES key>"
+//	  }
+//	}
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads a keyring from the JSON file at the given path.
+func LoadKeyring(name string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var kf keyringFile
+	if err = json.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("parse keyring %s: %w", name, err)
+	}
+	k := NewKeyring()
+	for id, encoded := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("parse keyring %s: key %q: %w", name, id, err)
+		}
+		if err = k.Add(id, key); err != nil {
+			return nil, fmt.Errorf("parse keyring %s: %w", name, err)
+		}
+	}
+	if kf.Active != "" {
+		if err = k.SetActive(kf.Active); err != nil {
+			return nil, fmt.Errorf("parse keyring %s: %w", name, err)
+		}
+	}
+	return k, nil
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// Add adds a key to the keyring. The key must be 16, 24 or 32 bytes long to
+// select AES-128, AES-192 or AES-256.
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" {
+		return fmt.Errorf("key id must not be empty")
+	}
+	if len(id) > maxKeyIDLen {
+		return fmt.Errorf("key id %q is longer than %d bytes", id, maxKeyIDLen)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("key %q: %w", id, err)
+	}
+	k.keys[id] = key
+	return nil
+}
+
+// SetActive makes the key with the given ID the one new segments are
+// encrypted with.
+func (k *Keyring) SetActive(id string) error {
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("unknown key %q", id)
+	}
+	k.Active = id
+	return nil
+}
+
+// aead returns the AES-GCM cipher for the key with the given ID.
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// maxKeyIDLen bounds the key IDs so a segment header stays small.
+const maxKeyIDLen = 64
+
+// segmentHeaderMagic prefixes the header frame that begins every encrypted
+// store file. Plain stores begin with a JSON encoded record, so the header
+// can't be mistaken for a record.
+var segmentHeaderMagic = []byte("LOGSEG01")
+
+// encodeSegmentHeader returns the payload of the header frame for a store
+// encrypted with the given key.
+func encodeSegmentHeader(keyID string) []byte {
+	return append(append([]byte{}, segmentHeaderMagic...), keyID...)
+}
+
+// decodeSegmentHeader returns the key ID held by a header frame, and false
+// if the frame isn't a header.
+func decodeSegmentHeader(p []byte) (keyID string, ok bool) {
+	if len(p) < len(segmentHeaderMagic) ||
+		string(p[:len(segmentHeaderMagic)]) != string(segmentHeaderMagic) {
+		return "", false
+	}
+	return string(p[len(segmentHeaderMagic):]), true
+}
+
+// seal encrypts a record. The record's offset is used as additional data so
+// a record can't be moved to another offset without failing authentication.
+// The returned frame is the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, offset uint64, p []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, p, offsetAD(offset)), nil
+}
+
+// open decrypts a frame produced by seal.
+func open(aead cipher.AEAD, offset uint64, frame []byte) ([]byte, error) {
+	if len(frame) < aead.NonceSize() {
+		return nil, fmt.Errorf("decrypt record %d: frame too short", offset)
+	}
+	nonce, ciphertext := frame[:aead.NonceSize()], frame[aead.NonceSize():]
+	p, err := aead.Open(nil, nonce, ciphertext, offsetAD(offset))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt record %d: %w", offset, err)
+	}
+	return p, nil
+}
+
+func offsetAD(offset uint64) []byte {
+	ad := make([]byte, 8)
+	enc.PutUint64(ad, offset)
+	return ad
+}
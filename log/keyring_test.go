@@ -0,0 +1,186 @@
+package log
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	name := path.Join(dir, "keyring.json")
+	err = ioutil.WriteFile(name, []byte(fmt.Sprintf(
+		`{"active": "k1", "keys": {"k1": %q}}`,
+		base64.StdEncoding.EncodeToString(key),
+	)), 0600)
+	require.NoError(t, err)
+
+	k, err := LoadKeyring(name)
+	require.NoError(t, err)
+	require.Equal(t, "k1", k.Active)
+	require.Equal(t, key, k.keys["k1"])
+
+	// the active key has to be in the keyring
+	err = ioutil.WriteFile(name, []byte(`{"active": "k2", "keys": {}}`), 0600)
+	require.NoError(t, err)
+	_, err = LoadKeyring(name)
+	require.Error(t, err)
+
+	// keys have to be valid AES keys
+	k = NewKeyring()
+	require.Error(t, k.Add("short", []byte("too short")))
+}
+
+func TestLogEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyring := NewKeyring()
+	require.NoError(t, keyring.Add("k1", bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, keyring.Add("k2", bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, keyring.SetActive("k1"))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Encryption.Keyring = keyring
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	value := []byte("the secret payload")
+	for i := uint64(0); i < 5; i++ {
+		off, err := log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.True(t, len(log.segments) > 1)
+	requireReadable(t, log, value)
+	require.NoError(t, log.Close())
+
+	// the records must not be stored in the clear
+	requireNotInStores(t, dir, value)
+
+	// the key ID is read from the segment headers, so the log can be read
+	// after the active key is rotated
+	require.NoError(t, keyring.SetActive("k2"))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	requireReadable(t, log, value)
+	for _, s := range log.segments {
+		require.Equal(t, "k1", s.keyID)
+	}
+
+	require.NoError(t, log.Reencrypt())
+	for _, s := range log.segments {
+		require.Equal(t, "k2", s.keyID)
+	}
+	requireReadable(t, log, value)
+	off, err := log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+	requireNotInStores(t, dir, value)
+
+	// after re-encryption the retired key isn't needed anymore
+	rotated := NewKeyring()
+	require.NoError(t, rotated.Add("k2", bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, rotated.SetActive("k2"))
+	c.Encryption.Keyring = rotated
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	requireReadable(t, log, value)
+	require.NoError(t, log.Close())
+
+	// encrypted segments can't be opened without a keyring
+	c.Encryption.Keyring = nil
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+func TestReencryptFullSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// plain segments filled right up to MaxStoreBytes
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	value := bytes.Repeat([]byte("v"), 100)
+	for len(log.segments) < 3 {
+		_, err = log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+	for _, s := range log.segments[:2] {
+		require.True(t, s.IsMaxed())
+	}
+	require.NoError(t, log.Close())
+
+	// their encrypted copies are bigger, but re-encrypting them still
+	// keeps each segment's records together
+	keyring := NewKeyring()
+	require.NoError(t, keyring.Add("k1", bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, keyring.SetActive("k1"))
+	c.Encryption.Keyring = keyring
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	bases := make([]uint64, len(log.segments))
+	for i, s := range log.segments {
+		bases[i] = s.baseOffset
+	}
+	require.NoError(t, log.Reencrypt())
+	for i, s := range log.segments {
+		require.Equal(t, "k1", s.keyID)
+		require.Equal(t, bases[i], s.baseOffset)
+	}
+	requireReadable(t, log, value)
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	requireNotInStores(t, dir, value)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	requireReadable(t, log, value)
+	require.NoError(t, log.Close())
+}
+
+func requireReadable(t *testing.T, log *Log, value []byte) {
+	t.Helper()
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	for off := uint64(0); off <= highest; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, read.Value)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+func requireNotInStores(t *testing.T, dir string, value []byte) {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	encoded := []byte(base64.StdEncoding.EncodeToString(value))
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(b, encoded), file.Name())
+	}
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// lockFile is locked by whoever has the log's directory open: exclusively by
+// NewLog, and shared by NewLog in read-only mode and by the offline tools in
+// inspect.go, so that two processes can't both write, and map, the same
+// files. The exclusive holder writes its PID into it to be named by the
+// error of those that find it locked.
+const lockFile = "lock"
+
+var errLockHeld = errors.New("lock is held")
+
+// ErrReadOnly is returned by the methods of a log opened with
+// Config.ReadOnly that would write to it.
+var ErrReadOnly = errors.New("log is open read-only")
+
+// LockedError is returned by NewLog, and the offline tools, when another
+// process has the log's directory open in a way that excludes them.
+type LockedError struct {
+	Dir string
+	// PID is the process that has the log open for writing, or 0 if it
+	// isn't known.
+	PID int
+	// ReadOnly is set when the log is only open read-only, by one or more
+	// processes, which excludes opening it for writing.
+	ReadOnly bool
+}
+
+func (e *LockedError) Error() string {
+	switch {
+	case e.ReadOnly:
+		return fmt.Sprintf("log directory %s is open read-only by another process", e.Dir)
+	case e.PID != 0:
+		return fmt.Sprintf("log directory %s is locked by process %d", e.Dir, e.PID)
+	default:
+		return fmt.Sprintf("log directory %s is locked by another process", e.Dir)
+	}
+}
+
+// lockDir locks the directory, exclusively or shared, and returns the lock
+// file, closing which releases the lock. Only an exclusive lock creates the
+// file: readers mustn't write to the directory, which might not even be a
+// log's, so they need a log to have been opened for writing there first.
+func lockDir(fsys FS, dir string, exclusive bool) (File, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := fsys.OpenFile(path.Join(dir, lockFile), flag, 0644)
+	if !exclusive && os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s has no lock file, so no log has been opened for writing there: %w", dir, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = fsys.Lock(f, exclusive); err != nil {
+		if errors.Is(err, errLockHeld) {
+			err = lockedError(fsys, f, dir, exclusive)
+		}
+		_ = f.Close()
+		return nil, err
+	}
+	if exclusive {
+		if err = f.Truncate(0); err == nil {
+			_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// lockedError describes who holds the lock that f couldn't take.
+func lockedError(fsys FS, f File, dir string, exclusive bool) error {
+	// if a shared lock can be had, the lock is only held by readers, and the
+	// PID in the file is a writer's that has gone
+	if exclusive && fsys.Lock(f, false) == nil {
+		return &LockedError{Dir: dir, ReadOnly: true}
+	}
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return &LockedError{Dir: dir, PID: pid}
+}
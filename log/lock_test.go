@@ -0,0 +1,143 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestLock(t *testing.T) {
+	for name, fsys := range map[string]FS{"os": OSFS, "mem": NewMemFS()} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "lock-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			require.NoError(t, fsys.MkdirAll(dir, 0755))
+
+			c := Config{FS: fsys}
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			// the writer excludes everyone else, and is named
+			readOnly := c
+			readOnly.ReadOnly = true
+			for _, c := range []Config{c, readOnly} {
+				_, err = NewLog(dir, c)
+				var locked *LockedError
+				require.True(t, errors.As(err, &locked), "got %v", err)
+				require.Equal(t, LockedError{Dir: dir, PID: os.Getpid()}, *locked)
+			}
+			require.NoError(t, log.Close())
+
+			// readers only exclude writers
+			reader, err := NewLog(dir, readOnly)
+			require.NoError(t, err)
+			other, err := NewLog(dir, readOnly)
+			require.NoError(t, err)
+			_, err = NewLog(dir, c)
+			var locked *LockedError
+			require.True(t, errors.As(err, &locked), "got %v", err)
+			require.Equal(t, LockedError{Dir: dir, ReadOnly: true}, *locked)
+			require.NoError(t, reader.Close())
+			require.NoError(t, other.Close())
+
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			require.NoError(t, log.Close())
+		})
+	}
+}
+
+func TestInspectLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// readers don't create the lock file, in what might not be a log's
+	// directory
+	_, err = Verify(dir)
+	require.True(t, errors.Is(err, os.ErrNotExist), "got %v", err)
+	_, err = NewLog(dir, Config{ReadOnly: true})
+	require.True(t, errors.Is(err, os.ErrNotExist), "got %v", err)
+	require.Empty(t, readDir(t, dir))
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = Verify(dir)
+	require.Equal(t, &LockedError{Dir: dir, PID: os.Getpid()}, err)
+	require.NoError(t, log.Close())
+
+	c := Config{ReadOnly: true}
+	reader, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer reader.Close()
+	_, err = Verify(dir)
+	require.NoError(t, err)
+	require.Equal(t, &LockedError{Dir: dir, ReadOnly: true}, RepairIndex(dir, 0))
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 3 records make a full segment and an active one with a record, the
+	// active one left as a crash would, with its index not trimmed and a
+	// torn record at the end of its store
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Sync())
+	require.NoError(t, log.lock.Close())
+	f, err := os.OpenFile(path.Join(dir, objectName(2, ".store")), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	before := readDir(t, dir)
+
+	c.ReadOnly = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(record.Value))
+	}
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, log.Truncate(1))
+	_, err = log.BeginTransaction()
+	require.Equal(t, ErrReadOnly, err)
+	require.NoError(t, log.Close())
+
+	require.Equal(t, before, readDir(t, dir))
+}
+
+// readDir returns the contents of the files in dir by name.
+func readDir(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	contents := make(map[string][]byte)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		require.NoError(t, err)
+		contents[file.Name()] = b
+	}
+	return contents
+}
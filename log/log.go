@@ -1,17 +1,18 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
+	"math"
 	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/metrics"
+	"github.com/MRSharff/distributed-services-with-go/trace"
 )
 
 type Log struct {
@@ -24,6 +25,45 @@ type Log struct {
 	// append writes to the activeSegment
 	activeSegment *segment
 	segments      []*segment
+
+	// remote holds the segments offloaded to tiered storage, oldest to
+	// newest. They're all older than the local segments. cacheMu guards
+	// fetching them back into the cache.
+	remote    []*remoteSegment
+	cacheMu   sync.Mutex
+	cacheTick uint64
+
+	// offloadReq wakes the goroutine that offloads segments to tiered
+	// storage, which stops when offloadStop is closed and then closes
+	// offloadDone. offloadMu is held while it offloads, and by whatever
+	// removes or rewrites segments, so that isn't done to a segment being
+	// uploaded. It's locked before mu.
+	offloadMu   sync.Mutex
+	offloadReq  chan struct{}
+	offloadStop chan struct{}
+	offloadDone chan struct{}
+
+	metrics *logMetrics
+
+	// producers maps producer IDs to the last few records they appended,
+	// so appends retried by producers aren't written twice.
+	producers map[string]producerState
+	// transactions holds the open transactions by ID, and aborted the
+	// offsets of the abort markers of the aborted ones whose records are
+	// still in the log, so ReadCommitted can hide them.
+	transactions map[string]*transactionState
+	aborted      map[string]uint64
+
+	// lock is the directory's lock file, held while the log is open
+	lock File
+
+	// removing are the base offsets of the segments whose files are being
+	// deleted, which the manifest lists while they are
+	removing []uint64
+	// reencrypting is the base offset of the segment whose re-encrypted
+	// copy is being moved over its files, which the manifest records while
+	// it is
+	reencrypting *uint64
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -36,69 +76,253 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Producer.IdleTimeout == 0 {
+		c.Producer.IdleTimeout = 24 * time.Hour
+	}
+	if c.Transaction.Timeout == 0 {
+		c.Transaction.Timeout = time.Minute
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
 	}
-	return l, l.setup()
+	registry := c.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	l.metrics = newLogMetrics(l, registry)
+	return l, l.open()
+}
+
+// open locks the log's directory, failing if another process has it open,
+// and sets the log up from it.
+func (l *Log) open() (err error) {
+	if l.lock, err = lockDir(l.Config.fs(), l.Dir, !l.Config.ReadOnly); err != nil {
+		return err
+	}
+	if err = l.setup(); err != nil {
+		_ = l.lock.Close()
+	}
+	return err
 }
 
 // set up the segments that already exist on the disk or bootstrap the initial
 // segment if the log is new and has no existing segments
 func (l *Log) setup() error {
-	// fetch the list of segments on disk
-	files, err := ioutil.ReadDir(l.Dir)
-	if err != nil {
+	if l.Config.ReadOnly && l.Config.Tier.Store != nil {
+		return errors.New("a read-only log can't use tiered storage")
+	}
+	if err := l.finishReencrypt(); err != nil {
 		return err
 	}
-
-	// parse the base offsets
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+	if err := l.loadSegments(); err != nil {
+		return err
 	}
-
-	// sort oldest to newest
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	if l.Config.ReadOnly {
+		if l.segments == nil {
+			return fmt.Errorf("%s holds no segments to read", l.Dir)
+		}
+		// there's no appending, so the newest segment is sealed too
+		if err := l.activeSegment.seal(); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip the dup
-		i++
+		l.setupState()
+		return nil
+	}
+	if err := l.setupRemote(); err != nil {
+		return err
 	}
 	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+		// continue after the offloaded segments, if there are any
+		off := l.Config.Segment.InitialOffset
+		if n := len(l.remote); n > 0 && l.remote[n-1].nextOffset > off {
+			off = l.remote[n-1].nextOffset
+		}
+		if err := l.newSegment(off); err != nil {
+			return err
+		}
+	} else if l.activeSegment.IsMaxed() {
+		// the log stopped while rolling past a full segment; like roll, sync
+		// it before the new segment follows it
+		if err := l.activeSegment.Sync(); err != nil {
+			return err
+		}
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
 			return err
 		}
 	}
+	if err := l.writeManifest(l.segments); err != nil {
+		return err
+	}
+	l.setupState()
+	l.startOffloading()
 	return nil
 }
 
 // Append appends a record to the log
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext is like Append, but if ctx carries a trace span the append,
+// and the segment roll if it fills the active segment, are traced as its
+// children.
+//
+// A record with a TransactionId is appended to that transaction, which must
+// be open. See BeginTransaction.
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (off uint64, err error) {
+	ctx, span := trace.Start(ctx, "log.Append")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	offs, dups, err := l.appendRecords(ctx, []*api.Record{record})
+	if err != nil {
+		return 0, err
+	}
+	if dups > 0 {
+		span.SetAttributes(trace.Bool("log.duplicate", true))
+	}
+	span.SetAttributes(
+		trace.Int64("log.offset", int64(offs[0])),
+		trace.Int("log.record_bytes", len(record.Value)),
+	)
+	return offs[0], nil
+}
+
+// AppendBatch appends the records in order and returns their offsets. Every
+// record is checked before any is appended, so if one is rejected none are.
+// Records their producer appended already, as when a batch is retried,
+// aren't appended again; they get their original offsets.
+func (l *Log) AppendBatch(ctx context.Context, records []*api.Record) (offs []uint64, err error) {
+	ctx, span := trace.Start(ctx, "log.AppendBatch")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	span.SetAttributes(trace.Int("log.records", len(records)))
+	offs, dups, err := l.appendRecords(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(trace.Int("log.duplicates", dups))
+	return offs, nil
+}
+
+// appendRecords checks the records and appends the ones that aren't
+// duplicates, returning the offsets of all of them and how many were
+// duplicates.
+func (l *Log) appendRecords(ctx context.Context, records []*api.Record) ([]uint64, int, error) {
+	if l.Config.ReadOnly {
+		return nil, 0, ErrReadOnly
+	}
+	start := time.Now()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.expireTransactions(ctx, start); err != nil {
+		return nil, 0, err
+	}
+	offs, dups, err := l.checkSequences(records)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := 0
+	for i, record := range records {
+		if dups[i] {
+			n++
+			continue
+		}
+		if err = l.checkTransaction(record); err != nil {
+			return nil, 0, err
+		}
+	}
+	for i, record := range records {
+		if dups[i] {
+			l.metrics.duplicates.Inc()
+			continue
+		}
+		if offs[i], err = l.append(ctx, record, start); err != nil {
+			return nil, 0, err
+		}
+	}
+	l.metrics.appendDuration.Observe(time.Since(start).Seconds())
+	return offs, n, nil
+}
+
+// append writes the record to the active segment, updates the producers and
+// transactions, and rolls the segment if it's full. The caller must hold the
+// write lock.
+func (l *Log) append(ctx context.Context, record *api.Record, now time.Time) (uint64, error) {
+	if l.activeSegment.IsMaxed() {
+		// rolling after the last append failed
+		if err := l.roll(ctx, l.activeSegment.nextOffset); err != nil {
+			return 0, err
+		}
+	}
+	storeSize := l.activeSegment.store.size
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.track(record, off, now)
+	l.metrics.appends.Inc()
+	l.metrics.appendedBytes.Add(float64(l.activeSegment.store.size - storeSize))
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		err = l.roll(ctx, off+1)
 	}
 	return off, err
 }
 
+// Sync commits the records appended so far to stable storage, so they
+// survive the machine crashing. Appends are only buffered, so until Sync
+// or Close returns, a crash can lose them; the segments the log rolled
+// past were synced when it did.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.activeSegment.Sync()
+}
+
+// roll syncs the full active segment and replaces it with a new one starting
+// at off, then has old segments offloaded if tiered storage is configured.
+// The caller must hold the write lock.
+func (l *Log) roll(ctx context.Context, off uint64) (err error) {
+	_, span := trace.Start(ctx, "log.rollSegment")
+	span.SetAttributes(trace.Int64("log.base_offset", int64(off)))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	l.metrics.segmentRolls.Inc()
+	if err = l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	if err = l.newSegment(off); err != nil {
+		return err
+	}
+	if err = l.writeManifest(l.segments); err != nil {
+		return err
+	}
+	if err = l.writeStateSnapshot(); err != nil {
+		return err
+	}
+	l.requestOffload()
+	return nil
+}
+
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	start := time.Now()
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	defer func() {
+		l.metrics.readDuration.Observe(time.Since(start).Seconds())
+	}()
+	return l.read(off)
+}
+
+// read returns the record at the given offset. The caller must hold at least
+// the read lock.
+func (l *Log) read(off uint64) (*api.Record, error) {
 	var s *segment
 	for _, seg := range l.segments {
 		if seg.baseOffset <= off && off < seg.nextOffset {
@@ -106,30 +330,71 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 			break
 		}
 	}
+	if s == nil {
+		for _, rs := range l.remote {
+			if rs.baseOffset <= off && off < rs.nextOffset {
+				return l.readRemote(rs, off)
+			}
+		}
+	}
 	if s == nil || s.nextOffset <= off {
-		return nil, fmt.Errorf("offset out of range: %d", off)
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 	return s.Read(off)
 }
 
-// Close iterates over the segments and closes them.
+// Close stops offloading segments, snapshots the producers' and
+// transactions' state, then iterates over the segments and closes them.
 func (l *Log) Close() error {
+	l.stopOffloading()
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if !l.Config.ReadOnly {
+		if err := l.writeStateSnapshot(); err != nil {
+			return err
+		}
+		if err := l.writeManifest(l.segments); err != nil {
+			return err
+		}
+	}
 	for _, seg := range l.segments {
 		if err := seg.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	l.cacheMu.Lock()
+	defer l.cacheMu.Unlock()
+	for _, rs := range l.remote {
+		if err := rs.uncache(); err != nil {
+			return err
+		}
+	}
+	// the directory is free for another process once the files are closed
+	return l.lock.Close()
 }
 
-// Remove closes the log and then removes its data.
+// Remove closes the log and then removes its data, including the segments
+// offloaded to tiered storage.
 func (l *Log) Remove() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	for _, rs := range l.remote {
+		if err := l.removeRemote(rs); err != nil {
+			return err
+		}
+	}
+	if l.Config.Tier.CacheDir != "" {
+		if err := l.Config.fs().RemoveAll(l.Config.Tier.CacheDir); err != nil {
+			return err
+		}
+	}
+	return l.Config.fs().RemoveAll(l.Dir)
 }
 
 // Reset removes the log and then creates a new log to replace it.
@@ -137,12 +402,15 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	return l.open()
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if len(l.remote) > 0 {
+		return l.remote[0].baseOffset, nil
+	}
 	return l.segments[0].baseOffset, nil
 }
 
@@ -161,19 +429,54 @@ func (l *Log) HighestOffset() (uint64, error) {
 // This should be called periodically to remove old segments whose data we
 // have hopefully processed by then and don't need anymore.
 func (l *Log) Truncate(lowest uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var segments []*segment
-	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+	l.metrics.truncations.Inc()
+	var remote []*remoteSegment
+	for _, rs := range l.remote {
+		if rs.nextOffset <= lowest+1 {
+			if err := l.removeRemote(rs); err != nil {
 				return err
 			}
+			l.metrics.removedSegments.Inc()
+			continue
+		}
+		remote = append(remote, rs)
+	}
+	l.remote = remote
+	var segments, removed []*segment
+	for _, s := range l.segments {
+		if s.nextOffset <= lowest+1 {
+			removed = append(removed, s)
 			continue
 		}
 		segments = append(segments, s)
 	}
+	// drop the segments from the manifest, and list them as being removed,
+	// before removing their files, so that files a crash leaves behind are
+	// known to be leftovers
+	if len(removed) > 0 {
+		for _, s := range removed {
+			l.removing = append(l.removing, s.baseOffset)
+		}
+		if err := l.writeManifest(segments); err != nil {
+			return err
+		}
+	}
 	l.segments = segments
+	for _, s := range removed {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.metrics.removedSegments.Inc()
+	}
+	l.removing = nil
+	l.pruneAborted()
 	return nil
 }
 
@@ -184,18 +487,133 @@ func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	readers := make([]io.Reader, len(l.segments))
-	for i, seg := range l.segments {
+	var readers []io.Reader
+	for _, rs := range l.remote {
+		readers = append(readers, &remoteReader{
+			store: l.Config.Tier.Store,
+			name:  objectName(rs.baseOffset, ".store"),
+		})
+	}
+	for _, seg := range l.segments {
 		// wrap the segment stores to satisfy io.Reader interface and to
 		// ensure that we begin  reading from the origin of the store and read
 		// its entire file.
-		readers[i] = &originReader{seg.store, 0}
+		readers = append(readers, &originReader{seg.store, 0})
 	}
 
 	// concatenate the segments' stores.
 	return io.MultiReader(readers...)
 }
 
+// Reencrypt rewrites every segment that isn't encrypted with the keyring's
+// active key, including plain segments, so that retired keys can be removed
+// from the keyring. Segments offloaded to tiered storage are left as they
+// are.
+//
+// Each segment is rewritten into a temporary directory inside Dir and then
+// renamed over the original files.
+func (l *Log) Reencrypt() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keyring := l.Config.Encryption.Keyring
+	if keyring == nil || keyring.Active == "" {
+		return fmt.Errorf("reencrypt: no active key configured")
+	}
+	fsys := l.Config.fs()
+	tmpDir := path.Join(l.Dir, reencryptDir)
+	if err := fsys.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		// a swap that failed part way leaves the rest of the copy for
+		// opening the log to finish
+		if l.reencrypting == nil {
+			fsys.RemoveAll(tmpDir)
+		}
+	}()
+
+	for i, s := range l.segments {
+		if s.keyID == keyring.Active {
+			continue
+		}
+		if err := l.reencryptSegment(i, tmpDir); err != nil {
+			return fmt.Errorf("reencrypt segment %d: %w", s.baseOffset, err)
+		}
+	}
+	return nil
+}
+
+// reencryptSegment copies the records of the i'th segment into a new segment
+// in tmpDir and moves the new segment's files over the old one's. The copy is
+// synced and the manifest records the swap before the first file is moved,
+// so that if the log stops part way through, opening it finishes the swap
+// rather than finding the new index next to the old store.
+func (l *Log) reencryptSegment(i int, tmpDir string) error {
+	s := l.segments[i]
+	// encrypting adds a header and overhead to every record, so the copy of
+	// a full plain segment is bigger than MaxStoreBytes and has to hold
+	// more than a new segment would
+	c := l.Config
+	c.Segment.MaxStoreBytes = math.MaxUint64
+	tmp, err := newSegment(tmpDir, s.baseOffset, c)
+	if err != nil {
+		return err
+	}
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if err != nil {
+			return err
+		}
+		if _, err = tmp.Append(record); err != nil {
+			return err
+		}
+	}
+	fsys := l.Config.fs()
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = fsys.SyncDir(tmpDir); err != nil {
+		return err
+	}
+	base := s.baseOffset
+	l.reencrypting = &base
+	if err = l.writeManifest(l.segments); err != nil {
+		return err
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	if err = fsys.Rename(tmp.index.Name(), s.index.Name()); err != nil {
+		return err
+	}
+	if err = fsys.Rename(tmp.store.Name(), s.store.Name()); err != nil {
+		return err
+	}
+	if err = fsys.SyncDir(l.Dir); err != nil {
+		return err
+	}
+	rewritten, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	if l.activeSegment == s {
+		l.activeSegment = rewritten
+	} else if err = rewritten.seal(); err != nil {
+		return err
+	}
+	l.segments[i] = rewritten
+	l.reencrypting = nil
+	return l.writeManifest(l.segments)
+}
+
 type originReader struct {
 	*store
 	off int64
@@ -209,13 +627,17 @@ func (o *originReader) Read(p []byte) (int, error) {
 
 // newSegment creates a new segment, appends that segment to the log's slice of
 // segments, and makes the new segment the active segment so that subsequent
-// append calls write to it.
+// append calls write to it. The old active segment is sealed.
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
+	prev := l.activeSegment
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	if prev != nil {
+		return prev.seal()
+	}
 	return nil
 }
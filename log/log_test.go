@@ -1,13 +1,16 @@
 package log
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
 	"testing"
 
 	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/trace"
 )
 
 func TestLog(t *testing.T) {
@@ -17,6 +20,7 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"traced append":                     testTracedAppend,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -103,3 +107,130 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+// TestAppendFillsIndex appends past indexes whose MaxIndexBytes isn't a
+// multiple of an entry's width, which used to fail with io.EOF when the last
+// partial entry's worth ran out.
+func TestAppendFillsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := uint64(0); i < 50; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.Len(t, log.segments, 7)
+	for _, s := range log.segments {
+		// every byte of the store belongs to an indexed record
+		end, err := s.recordEnd(s.nextOffset - 1)
+		require.NoError(t, err)
+		require.Equal(t, s.store.size, end)
+	}
+	for off := uint64(0); off < 50; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+// spanRecorder is a trace.Exporter that keeps the spans it's given.
+type spanRecorder struct {
+	spans []trace.SpanData
+}
+
+func (r *spanRecorder) Export(spans []trace.SpanData) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func testTracedAppend(t *testing.T, log *Log) {
+	rec := &spanRecorder{}
+	tracer := trace.NewTracer(trace.TracerConfig{Exporter: rec})
+	ctx, root := tracer.Start(context.Background(), "produce")
+
+	// the record fills the 32 byte store, so the append rolls the segment
+	off, err := log.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	root.End()
+	require.NoError(t, tracer.Close())
+
+	require.Len(t, rec.spans, 3)
+	roll, appnd := rec.spans[0], rec.spans[1]
+	require.Equal(t, "log.rollSegment", roll.Name)
+	require.Equal(t, appnd.SpanContext, roll.Parent)
+	require.Equal(t, "log.Append", appnd.Name)
+	require.Equal(t, root.SpanContext(), appnd.Parent)
+	require.Contains(t, appnd.Attributes, trace.Int64("log.offset", int64(off)))
+	require.Contains(t, roll.Attributes, trace.Int64("log.base_offset", int64(off+1)))
+}
+
+// benchSegments are the segment sizes the benchmarks run with: small
+// segments roll often, large ones rarely.
+var benchSegments = []struct {
+	name                         string
+	maxStoreBytes, maxIndexBytes uint64
+}{
+	{"64KiB", 64 << 10, entWidth * 4096},
+	{"16MiB", 16 << 20, entWidth * 1 << 20},
+}
+
+// benchValueSizes are the record value sizes the benchmarks run with.
+var benchValueSizes = []int{64, 1 << 10, 16 << 10}
+
+// benchLogs runs fn once for every combination of value and segment size,
+// with a log in a fresh directory.
+func benchLogs(b *testing.B, fn func(b *testing.B, log *Log, value []byte)) {
+	for _, size := range benchValueSizes {
+		for _, seg := range benchSegments {
+			b.Run(fmt.Sprintf("value=%dB/segment=%s", size, seg.name), func(b *testing.B) {
+				dir, err := ioutil.TempDir("", "log-bench")
+				require.NoError(b, err)
+				defer os.RemoveAll(dir)
+				c := Config{}
+				c.Segment.MaxStoreBytes = seg.maxStoreBytes
+				c.Segment.MaxIndexBytes = seg.maxIndexBytes
+				log, err := NewLog(dir, c)
+				require.NoError(b, err)
+				defer log.Close()
+				b.SetBytes(int64(size))
+				fn(b, log, make([]byte, size))
+			})
+		}
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	benchLogs(b, func(b *testing.B, log *Log, value []byte) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := log.Append(&api.Record{Value: value}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchLogs(b, func(b *testing.B, log *Log, value []byte) {
+		const records = 10000
+		for i := 0; i < records; i++ {
+			if _, err := log.Append(&api.Record{Value: value}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := log.Read(uint64(i % records)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
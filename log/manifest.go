@@ -0,0 +1,376 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifestFile lists the log's local segments, so that opening the log can
+// tell a segment that's missing or shorter than it was from one that was
+// never there, and the leftovers of an interrupted removal from a stray
+// segment.
+const manifestFile = "manifest.json"
+
+// reencryptDir is where Reencrypt writes the re-encrypted copy of a segment
+// before moving it over the segment's files.
+const reencryptDir = "reencrypt.tmp"
+
+type manifest struct {
+	Segments []manifestSegment `json:"segments"`
+	// Removing are the base offsets of segments dropped from the log whose
+	// files were being deleted when the manifest was written.
+	Removing []uint64 `json:"removing,omitempty"`
+	// Reencrypting is the base offset of a segment whose re-encrypted copy
+	// in reencryptDir was complete and was being moved over its files.
+	Reencrypting *uint64 `json:"reencrypting,omitempty"`
+}
+
+// manifestSegment is a segment the log had when the manifest was written.
+// NextOffset is only known for sealed segments; the active one grows.
+type manifestSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	Sealed     bool   `json:"sealed"`
+	NextOffset uint64 `json:"next_offset,omitempty"`
+}
+
+// DataDirError is returned by NewLog when the data directory doesn't hold
+// what the manifest says it should, or holds files the log doesn't know, so
+// that they're looked into rather than loaded as best the log can.
+type DataDirError struct {
+	Dir      string
+	Problems []string
+}
+
+func (e *DataDirError) Error() string {
+	return fmt.Sprintf("data directory %s: %s", e.Dir, strings.Join(e.Problems, "; "))
+}
+
+// dirFiles are the names other than segment files that the log keeps in its
+// directory. Hidden files aren't the log's either but are let be, like the
+// server's readiness probes, which write to the directory while it's opened
+// and leave their file behind if they crash.
+var dirFiles = map[string]bool{
+	lockFile:              true,
+	manifestFile:          true,
+	manifestFile + ".tmp": true,
+	stateFile:             true,
+	stateFile + ".tmp":    true,
+	reencryptDir:          true,
+	"cache":               true,
+}
+
+// parseSegmentName returns the base offset and extension of a segment file's
+// name, and false if it isn't one. The offset has to be written the way the
+// log writes it, so a name like 007.store isn't taken for segment 7.
+func parseSegmentName(name string) (baseOffset uint64, ext string, ok bool) {
+	ext = path.Ext(name)
+	if ext != ".store" && ext != ".index" {
+		return 0, "", false
+	}
+	baseOffset, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil || objectName(baseOffset, ext) != name {
+		return 0, "", false
+	}
+	return baseOffset, ext, true
+}
+
+func readManifest(fsys FS, dir string) (*manifest, error) {
+	b, err := readFile(fsys, path.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	return m, nil
+}
+
+// writeManifest replaces the manifest with one listing segments, the last of
+// them active. The active segment is synced first, so that the files of a
+// segment the manifest names survive a crash. The caller must hold the
+// write lock.
+func (l *Log) writeManifest(segments []*segment) error {
+	m := manifest{Segments: []manifestSegment{}, Removing: l.removing, Reencrypting: l.reencrypting}
+	for i, s := range segments {
+		ms := manifestSegment{BaseOffset: s.baseOffset}
+		if i < len(segments)-1 {
+			ms.Sealed, ms.NextOffset = true, s.nextOffset
+		}
+		m.Segments = append(m.Segments, ms)
+	}
+	if n := len(segments); n > 0 {
+		if err := segments[n-1].Sync(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.Config.fs(), path.Join(l.Dir, manifestFile), b)
+}
+
+// dirSegment is a segment's files found in the data directory.
+type dirSegment struct {
+	baseOffset         uint64
+	hasStore, hasIndex bool
+}
+
+// scanDir pairs up the segment files in the data directory by base offset,
+// oldest first, and returns the names of the files it doesn't know.
+func (l *Log) scanDir() (segments []*dirSegment, unknown []string, err error) {
+	files, err := l.Config.fs().ReadDir(l.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	byOffset := make(map[uint64]*dirSegment)
+	for _, file := range files {
+		baseOffset, ext, ok := parseSegmentName(file.Name())
+		if !ok {
+			if !dirFiles[file.Name()] && !strings.HasPrefix(file.Name(), ".") {
+				unknown = append(unknown, file.Name())
+			}
+			continue
+		}
+		ds, ok := byOffset[baseOffset]
+		if !ok {
+			ds = &dirSegment{baseOffset: baseOffset}
+			byOffset[baseOffset] = ds
+			segments = append(segments, ds)
+		}
+		if ext == ".store" {
+			ds.hasStore = true
+		} else {
+			ds.hasIndex = true
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].baseOffset < segments[j].baseOffset
+	})
+	return segments, unknown, nil
+}
+
+// loadSegments opens the segments in the data directory, checking them
+// against the manifest:
+//
+//   - segments older than the manifest's first must be ones it lists as
+//     being removed: truncating and offloading the log record the segments
+//     they drop before deleting their files, so the files a crash leaves
+//     behind are deleted now. Any other is reported rather than deleted;
+//   - segments newer than the manifest's last were created by a roll that
+//     didn't get as far as writing the manifest, and the newest of them can
+//     be missing a file it hadn't created yet;
+//   - every other segment must be in the manifest with both its files, and
+//     a sealed one must end where the manifest says.
+//
+// A directory written before the log kept a manifest is taken to have had
+// one listing every segment but the newest. Afterwards the segments have to
+// follow on from each other without overlapping or leaving a gap, except
+// after a sealed segment that ends where the manifest says: the log never
+// leaves a gap there, so it was RepairIndex dropping records that can't be
+// read any more.
+func (l *Log) loadSegments() error {
+	found, unknown, err := l.scanDir()
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown file %s", name))
+	}
+	listed := make(map[uint64]manifestSegment)
+	removing := make(map[uint64]bool)
+	var first, last uint64
+	m, err := readManifest(l.Config.fs(), l.Dir)
+	switch {
+	case err == nil:
+		for _, ms := range m.Segments {
+			listed[ms.BaseOffset] = ms
+		}
+		for _, base := range m.Removing {
+			removing[base] = true
+		}
+	case os.IsNotExist(err):
+		for i, ds := range found {
+			if i < len(found)-1 {
+				listed[ds.baseOffset] = manifestSegment{BaseOffset: ds.baseOffset}
+			}
+		}
+	default:
+		return err
+	}
+	if len(listed) > 0 {
+		first, last = ^uint64(0), 0
+		for base := range listed {
+			if base < first {
+				first = base
+			}
+			if base > last {
+				last = base
+			}
+		}
+	}
+
+	var leftovers, open []*dirSegment
+	for i, ds := range found {
+		_, isListed := listed[ds.baseOffset]
+		complete := ds.hasStore && ds.hasIndex
+		switch {
+		case len(listed) > 0 && ds.baseOffset < first:
+			if !removing[ds.baseOffset] {
+				problems = append(problems, fmt.Sprintf(
+					"segment %d is older than the manifest's first and wasn't being removed", ds.baseOffset))
+			}
+			leftovers = append(leftovers, ds)
+			continue
+		case isListed:
+			delete(listed, ds.baseOffset)
+		case len(listed) > 0 && ds.baseOffset < last:
+			problems = append(problems, fmt.Sprintf("segment %d isn't in the manifest", ds.baseOffset))
+		case !complete && i < len(found)-1:
+			problems = append(problems, fmt.Sprintf("segment %d is missing a file but isn't the newest", ds.baseOffset))
+		}
+		if isListed && !ds.hasStore {
+			problems = append(problems, fmt.Sprintf("segment %d is missing its store file", ds.baseOffset))
+		}
+		if isListed && !ds.hasIndex {
+			problems = append(problems, fmt.Sprintf("segment %d is missing its index file", ds.baseOffset))
+		}
+		open = append(open, ds)
+	}
+	var missing []uint64
+	for base := range listed {
+		missing = append(missing, base)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	for _, base := range missing {
+		problems = append(problems, fmt.Sprintf("segment %d is in the manifest but has no files", base))
+	}
+	if len(problems) > 0 {
+		return &DataDirError{Dir: l.Dir, Problems: problems}
+	}
+
+	// a read-only log just doesn't open them
+	for _, ds := range leftovers {
+		if l.Config.ReadOnly {
+			break
+		}
+		for _, ext := range []string{".index", ".store"} {
+			err := l.Config.fs().Remove(path.Join(l.Dir, objectName(ds.baseOffset, ext)))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for _, ds := range open {
+		if l.Config.ReadOnly && !(ds.hasStore && ds.hasIndex) {
+			// it can't have records yet, and opening it would create
+			// the missing file
+			continue
+		}
+		if err = l.newSegment(ds.baseOffset); err != nil {
+			return err
+		}
+	}
+
+	if m != nil {
+		for _, ms := range m.Segments {
+			listed[ms.BaseOffset] = ms
+		}
+	}
+	for i, s := range l.segments {
+		ms := listed[s.baseOffset]
+		if ms.Sealed && s.nextOffset != ms.NextOffset {
+			problems = append(problems, fmt.Sprintf(
+				"segment %d ends at offset %d but the manifest says %d",
+				s.baseOffset, s.nextOffset, ms.NextOffset))
+		}
+		if i == 0 {
+			continue
+		}
+		prev, prevMS := l.segments[i-1], listed[l.segments[i-1].baseOffset]
+		switch {
+		case prev.nextOffset > s.baseOffset:
+			problems = append(problems, fmt.Sprintf(
+				"segments %d and %d overlap", prev.baseOffset, s.baseOffset))
+		case prev.nextOffset < s.baseOffset && !(prevMS.Sealed && prev.nextOffset == prevMS.NextOffset):
+			problems = append(problems, fmt.Sprintf(
+				"offsets %d to %d are missing between segments %d and %d",
+				prev.nextOffset, s.baseOffset-1, prev.baseOffset, s.baseOffset))
+		}
+	}
+	if len(problems) > 0 {
+		for _, s := range l.segments {
+			_ = s.Close()
+		}
+		l.segments, l.activeSegment = nil, nil
+		return &DataDirError{Dir: l.Dir, Problems: problems}
+	}
+	return nil
+}
+
+// finishReencrypt finishes moving a re-encrypted segment's files into place
+// if the manifest says the log stopped while it was. The copy was complete
+// and synced before the first file was moved, so the files still in
+// reencryptDir replace the segment's; the ones that aren't were moved
+// already. Whatever else is in reencryptDir is an unfinished copy and is
+// deleted. A read-only log can't move the files, so it refuses to open.
+func (l *Log) finishReencrypt() error {
+	fsys := l.Config.fs()
+	m, err := readManifest(fsys, l.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if m != nil && m.Reencrypting != nil {
+		base := *m.Reencrypting
+		if l.Config.ReadOnly {
+			return &DataDirError{Dir: l.Dir, Problems: []string{fmt.Sprintf(
+				"segment %d was being re-encrypted; open the log writable to finish", base)}}
+		}
+		for _, ext := range []string{".index", ".store"} {
+			name := objectName(base, ext)
+			err := fsys.Rename(path.Join(l.Dir, reencryptDir, name), path.Join(l.Dir, name))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err = fsys.SyncDir(l.Dir); err != nil {
+			return err
+		}
+	}
+	if l.Config.ReadOnly {
+		return nil
+	}
+	return fsys.RemoveAll(path.Join(l.Dir, reencryptDir))
+}
+
+// setManifestEnd records that the sealed segment with the given base offset
+// now ends at nextOffset, for RepairIndex. A manifest that doesn't list the
+// segment as sealed, or doesn't exist, is left as it is.
+func setManifestEnd(fsys FS, dir string, baseOffset, nextOffset uint64) error {
+	m, err := readManifest(fsys, dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, ms := range m.Segments {
+		if ms.BaseOffset != baseOffset || !ms.Sealed || ms.NextOffset == nextOffset {
+			continue
+		}
+		m.Segments[i].NextOffset = nextOffset
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(fsys, path.Join(dir, manifestFile), b)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestManifest(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"legacy directory without a manifest": testManifestLegacy,
+		"leftovers of a removal are deleted":  testManifestLeftovers,
+		"stray old segments are reported":     testManifestStrayOldSegment,
+		"hidden files are ignored":            testManifestHiddenFiles,
+		"unknown files are reported":          testManifestUnknownFiles,
+		"missing segment files are reported":  testManifestMissingFiles,
+		"short sealed segments are reported":  testManifestShortSegment,
+		"overlapping segments are reported":   testManifestOverlap,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "manifest-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// 6 records make 3 full segments and an empty active one
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 6; i++ {
+				_, err = log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Close())
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+func testManifestLegacy(t *testing.T, dir string, c Config) {
+	require.NoError(t, os.Remove(path.Join(dir, manifestFile)))
+	// the newest segment can be missing a file, as after a crash while
+	// rolling
+	require.NoError(t, os.Remove(path.Join(dir, objectName(6, ".index"))))
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	_, err = os.Stat(path.Join(dir, manifestFile))
+	require.NoError(t, err)
+}
+
+func testManifestLeftovers(t *testing.T, dir string, c Config) {
+	// Truncate fails to delete the store of the segment it removes, as if
+	// it crashed after deleting the index
+	c.FS = failingRemove{FS: OSFS, name: path.Join(dir, objectName(0, ".store"))}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.EqualError(t, log.Truncate(1), "remove failed")
+	require.NoError(t, log.lock.Close())
+
+	c.FS = nil
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = os.Stat(path.Join(dir, objectName(0, ".store")))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testManifestStrayOldSegment(t *testing.T, dir string, c Config) {
+	// the files of a segment Truncate removed come back, as if copied in
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	store, err := ioutil.ReadFile(path.Join(dir, objectName(0, ".store")))
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, log.Close())
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, objectName(0, ".store")), store, 0644))
+
+	_, err = NewLog(dir, c)
+	requireProblems(t, err, "segment 0 is older than the manifest's first and wasn't being removed")
+	_, err = os.Stat(path.Join(dir, objectName(0, ".store")))
+	require.NoError(t, err)
+}
+
+func testManifestHiddenFiles(t *testing.T, dir string, c Config) {
+	// left behind by a readiness probe that crashed
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, ".readyz-123"), []byte("ok"), 0644))
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+// failingRemove fails to remove the named file.
+type failingRemove struct {
+	FS
+	name string
+}
+
+func (f failingRemove) Remove(name string) error {
+	if name == f.name {
+		return errors.New("remove failed")
+	}
+	return f.FS.Remove(name)
+}
+
+func testManifestUnknownFiles(t *testing.T, dir string, c Config) {
+	for _, name := range []string{"notes.txt", "02.store"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), nil, 0644))
+	}
+
+	_, err := NewLog(dir, c)
+	requireProblems(t, err, "unknown file 02.store", "unknown file notes.txt")
+}
+
+func testManifestMissingFiles(t *testing.T, dir string, c Config) {
+	require.NoError(t, os.Remove(path.Join(dir, objectName(2, ".index"))))
+	require.NoError(t, os.Remove(path.Join(dir, objectName(4, ".index"))))
+	require.NoError(t, os.Remove(path.Join(dir, objectName(4, ".store"))))
+
+	_, err := NewLog(dir, c)
+	requireProblems(t, err,
+		"segment 2 is missing its index file",
+		"segment 4 is in the manifest but has no files",
+	)
+}
+
+func testManifestShortSegment(t *testing.T, dir string, c Config) {
+	// drop the last record of segment 2
+	name := path.Join(dir, objectName(2, ".store"))
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, info.Size()-1))
+
+	_, err = NewLog(dir, c)
+	requireProblems(t, err,
+		"segment 2 ends at offset 3 but the manifest says 4",
+		"offsets 3 to 3 are missing between segments 2 and 4",
+	)
+}
+
+func testManifestOverlap(t *testing.T, dir string, c Config) {
+	// a segment that starts inside segment 2, as if a stray one were copied
+	// into the directory and the manifest
+	m := `{"segments":[` +
+		`{"base_offset":0,"sealed":true,"next_offset":2},` +
+		`{"base_offset":2,"sealed":true,"next_offset":4},` +
+		`{"base_offset":3,"sealed":true,"next_offset":3},` +
+		`{"base_offset":4,"sealed":true,"next_offset":6},` +
+		`{"base_offset":6,"sealed":false}]}`
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, manifestFile), []byte(m), 0644))
+	for _, ext := range []string{".store", ".index"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, objectName(3, ext)), nil, 0644))
+	}
+
+	_, err := NewLog(dir, c)
+	requireProblems(t, err, "segments 2 and 3 overlap")
+}
+
+func requireProblems(t *testing.T, err error, problems ...string) {
+	t.Helper()
+	var dirErr *DataDirError
+	require.True(t, errors.As(err, &dirErr), "got %v", err)
+	require.Equal(t, problems, dirErr.Problems)
+}
@@ -0,0 +1,444 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memFS is an FS held in memory. Files are shared by every handle opened on
+// them, and a mapping shares the file's bytes, so it behaves like a real
+// filesystem short of surviving the process.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+// NewMemFS returns an empty filesystem held in memory, holding only the root
+// directory.
+func NewMemFS() FS {
+	return &memFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, "/": true},
+	}
+}
+
+// memData is a file's contents.
+type memData struct {
+	mu      sync.RWMutex
+	b       []byte
+	mode    os.FileMode
+	modTime time.Time
+	// locks maps the handles holding a lock on the file to whether it's
+	// exclusive.
+	locks map[*memFile]bool
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[name] {
+		return nil, pathError("open", name, syscall.EISDIR)
+	}
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, os.ErrNotExist)
+	case !ok:
+		if !m.dirs[path.Dir(name)] {
+			return nil, pathError("open", name, os.ErrNotExist)
+		}
+		d = &memData{mode: perm, modTime: time.Now()}
+		m.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.b = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+	return &memFile{name: name, d: d, flag: flag}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[name] {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	d, ok := m.files[name]
+	if !ok {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+	return d.stat(path.Base(name)), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[name] {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	var infos []os.FileInfo
+	for file, d := range m.files {
+		if path.Dir(file) == name {
+			infos = append(infos, d.stat(path.Base(file)))
+		}
+	}
+	for dir := range m.dirs {
+		if dir != name && path.Dir(dir) == name {
+			infos = append(infos, memFileInfo{name: path.Base(dir), dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	if m.hasChildren(name) {
+		return pathError("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(name string) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+	delete(m.dirs, name)
+	for file := range m.files {
+		if isWithin(file, name) {
+			delete(m.files, file)
+		}
+	}
+	for dir := range m.dirs {
+		if isWithin(dir, name) {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[path.Dir(newname)] {
+		return pathError("rename", newname, os.ErrNotExist)
+	}
+	if d, ok := m.files[oldname]; ok {
+		if m.dirs[newname] {
+			return pathError("rename", newname, syscall.EISDIR)
+		}
+		delete(m.files, oldname)
+		m.files[newname] = d
+		return nil
+	}
+	if !m.dirs[oldname] {
+		return pathError("rename", oldname, os.ErrNotExist)
+	}
+	if _, ok := m.files[newname]; ok || m.hasChildren(newname) {
+		return pathError("rename", newname, os.ErrExist)
+	}
+	delete(m.dirs, oldname)
+	m.dirs[newname] = true
+	for file, d := range m.files {
+		if isWithin(file, oldname) {
+			delete(m.files, file)
+			m.files[newname+strings.TrimPrefix(file, oldname)] = d
+		}
+	}
+	for dir := range m.dirs {
+		if isWithin(dir, oldname) {
+			delete(m.dirs, dir)
+			m.dirs[newname+strings.TrimPrefix(dir, oldname)] = true
+		}
+	}
+	return nil
+}
+
+func (m *memFS) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := name; !m.dirs[dir]; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return pathError("mkdir", dir, syscall.ENOTDIR)
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+// SyncDir does nothing: the filesystem doesn't survive the process anyway.
+func (m *memFS) SyncDir(name string) error {
+	return nil
+}
+
+// Map shares the file's bytes with the mapping until the file is resized and
+// the mapping remapped. Nothing stops writes to a mapping that isn't
+// writable.
+func (m *memFS) Map(f File, writable bool) (Mapping, error) {
+	mf, ok := f.(*memFile)
+	if !ok {
+		return copyMap(f, writable)
+	}
+	mm := &memMapping{d: mf.d}
+	if err := mm.Remap(); err != nil {
+		return nil, err
+	}
+	return mm, nil
+}
+
+// Lock locks the file for the handle, like flock.
+func (m *memFS) Lock(f File, exclusive bool) error {
+	mf, ok := f.(*memFile)
+	if !ok {
+		return nil
+	}
+	d := mf.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for holder, holderExclusive := range d.locks {
+		if holder != mf && (exclusive || holderExclusive) {
+			return errLockHeld
+		}
+	}
+	if d.locks == nil {
+		d.locks = make(map[*memFile]bool)
+	}
+	d.locks[mf] = exclusive
+	return nil
+}
+
+// hasChildren reports whether anything is in the directory. The caller must
+// hold mu.
+func (m *memFS) hasChildren(dir string) bool {
+	for file := range m.files {
+		if isWithin(file, dir) {
+			return true
+		}
+	}
+	for d := range m.dirs {
+		if isWithin(d, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin reports whether name is below dir.
+func isWithin(name, dir string) bool {
+	return name != dir && strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+}
+
+type memMapping struct {
+	d *memData
+	b []byte
+}
+
+func (m *memMapping) Bytes() []byte { return m.b }
+func (m *memMapping) Sync() error   { return nil }
+func (m *memMapping) Unmap() error  { m.b = nil; return nil }
+
+func (m *memMapping) Remap() error {
+	m.d.mu.RLock()
+	defer m.d.mu.RUnlock()
+	m.b = m.d.b
+	return nil
+}
+
+func (d *memData) stat(name string) memFileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memFileInfo{name: name, size: int64(len(d.b)), mode: d.mode, modTime: d.modTime}
+}
+
+// resize grows or shrinks the file, zeroing any bytes it grows by. The caller
+// must hold mu.
+func (d *memData) resize(size int64) {
+	if size <= int64(cap(d.b)) {
+		old := len(d.b)
+		d.b = d.b[:size]
+		for i := old; i < len(d.b); i++ {
+			d.b[i] = 0
+		}
+		return
+	}
+	b := make([]byte, size)
+	copy(b, d.b)
+	d.b = b
+}
+
+// memFile is an open handle on a memFS file.
+type memFile struct {
+	name   string
+	d      *memData
+	flag   int
+	off    int64
+	closed bool
+}
+
+var errWriteAtInAppendMode = errors.New("WriteAt in append mode")
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return pathError(op, f.name, os.ErrClosed)
+	}
+	readOnly := f.flag&(os.O_WRONLY|os.O_RDWR) == 0
+	writeOnly := f.flag&os.O_WRONLY != 0
+	if (write && readOnly) || (!write && writeOnly) {
+		return pathError(op, f.name, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	if off >= int64(len(f.d.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.d.mu.Lock()
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.d.b))
+	}
+	n := f.d.writeAt(p, f.off)
+	f.d.mu.Unlock()
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, pathError("write", f.name, errWriteAtInAppendMode)
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	return f.d.writeAt(p, off), nil
+}
+
+// writeAt writes p at off, growing the file if needed. The caller must hold
+// mu.
+func (d *memData) writeAt(p []byte, off int64) int {
+	if end := off + int64(len(p)); end > int64(len(d.b)) {
+		d.resize(end)
+	}
+	d.modTime = time.Now()
+	return copy(d.b[off:], p)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	f.d.resize(size)
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, pathError("stat", f.name, os.ErrClosed)
+	}
+	return f.d.stat(path.Base(f.name)), nil
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return pathError("sync", f.name, os.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return pathError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	f.d.mu.Lock()
+	delete(f.d.locks, f)
+	f.d.mu.Unlock()
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return i.mode
+}
@@ -0,0 +1,134 @@
+package log
+
+import (
+	"github.com/MRSharff/distributed-services-with-go/metrics"
+)
+
+// logMetrics are the metrics the log keeps about itself.
+type logMetrics struct {
+	appends         *metrics.Counter
+	duplicates      *metrics.Counter
+	appendedBytes   *metrics.Counter
+	appendDuration  *metrics.Histogram
+	readDuration    *metrics.Histogram
+	segmentRolls    *metrics.Counter
+	truncations     *metrics.Counter
+	removedSegments *metrics.Counter
+	offloadFailures *metrics.Counter
+	transactions    *metrics.CounterVec
+}
+
+// newLogMetrics registers the log's metrics with r. The gauges are computed
+// from the log's state whenever the metrics are written.
+func newLogMetrics(l *Log, r *metrics.Registry) *logMetrics {
+	m := &logMetrics{
+		appends: r.NewCounter(
+			"log_appends_total",
+			"Records appended to the log.",
+		),
+		duplicates: r.NewCounter(
+			"log_duplicate_appends_total",
+			"Appends of a record its producer had appended already, which returned the original offset.",
+		),
+		appendedBytes: r.NewCounter(
+			"log_appended_bytes_total",
+			"Bytes appended to the log's store files, including record framing.",
+		),
+		appendDuration: r.NewHistogram(
+			"log_append_duration_seconds",
+			"Time taken to append a record or a batch of them, including rolling the segment.",
+			metrics.LatencyBuckets,
+		),
+		readDuration: r.NewHistogram(
+			"log_read_duration_seconds",
+			"Time taken to read a record.",
+			metrics.LatencyBuckets,
+		),
+		segmentRolls: r.NewCounter(
+			"log_segment_rolls_total",
+			"Times the active segment filled up and a new one was created.",
+		),
+		truncations: r.NewCounter(
+			"log_truncations_total",
+			"Calls to Truncate.",
+		),
+		removedSegments: r.NewCounter(
+			"log_truncated_segments_total",
+			"Segments removed by Truncate.",
+		),
+		offloadFailures: r.NewCounter(
+			"log_offload_failures_total",
+			"Failed attempts to offload segments to tiered storage, which are retried after the next roll.",
+		),
+		transactions: r.NewCounterVec(
+			"log_transactions_ended_total",
+			"Transactions ended, by outcome: commit, abort or timeout.",
+			"outcome",
+		),
+	}
+	r.NewGaugeFunc(
+		"log_open_transactions",
+		"Transactions begun and not yet committed or aborted.",
+		func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			return float64(len(l.transactions))
+		},
+	)
+	r.NewGaugeFunc(
+		"log_segments",
+		"Segments on local disk, including the active one.",
+		func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			return float64(len(l.segments))
+		},
+	)
+	r.NewGaugeFunc(
+		"log_remote_segments",
+		"Segments offloaded to tiered storage.",
+		func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			return float64(len(l.remote))
+		},
+	)
+	r.NewGaugeFunc(
+		"log_disk_bytes",
+		"Bytes held by the store and index files of the local segments.",
+		func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			var size uint64
+			for _, s := range l.segments {
+				size += s.store.size + s.index.size
+			}
+			return float64(size)
+		},
+	)
+	r.NewGaugeFunc(
+		"log_active_segment_store_fill_ratio",
+		"Size of the active segment's store relative to MaxStoreBytes.",
+		func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			if l.activeSegment == nil {
+				return 0
+			}
+			return float64(l.activeSegment.store.size) / float64(l.Config.Segment.MaxStoreBytes)
+		},
+	)
+	r.NewGaugeFunc(
+		"log_active_segment_index_fill_ratio",
+		"Size of the active segment's index relative to MaxIndexBytes.",
+		func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			if l.activeSegment == nil {
+				return 0
+			}
+			return float64(l.activeSegment.index.size) / float64(l.Config.Segment.MaxIndexBytes)
+		},
+	)
+	return m
+}
@@ -0,0 +1,49 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/metrics"
+)
+
+func TestLogMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	registry := metrics.NewRegistry()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Metrics = registry
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	rec := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(rec)
+		require.NoError(t, err)
+	}
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(1))
+
+	require.Equal(t, float64(3), log.metrics.appends.Value())
+	require.True(t, log.metrics.appendedBytes.Value() > 3*lenWidth)
+	require.Equal(t, uint64(3), log.metrics.appendDuration.Count())
+	require.Equal(t, uint64(1), log.metrics.readDuration.Count())
+	require.Equal(t, float64(1), log.metrics.segmentRolls.Value())
+	require.Equal(t, float64(1), log.metrics.truncations.Value())
+	require.Equal(t, float64(1), log.metrics.removedSegments.Value())
+
+	var b bytes.Buffer
+	_, err = registry.WriteTo(&b)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "\nlog_segments 1\n")
+	require.Contains(t, b.String(), "\nlog_active_segment_index_fill_ratio 0.5\n")
+}
@@ -0,0 +1,116 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore when the object doesn't
+// exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore is where the log offloads its closed segments when tiered
+// storage is enabled. Disk on the log's nodes is expensive and old segments
+// are rarely read, so we keep them somewhere cheaper and fetch them back on
+// demand.
+type ObjectStore interface {
+	// Put stores size bytes read from r under the given name, replacing any
+	// existing object.
+	Put(name string, r io.Reader, size int64) error
+	// Get returns a reader for the named object. The caller must close it.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the named object. Deleting a missing object is not an
+	// error.
+	Delete(name string) error
+	// List returns every object in the store, sorted by name.
+	List() ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes an object held by an ObjectStore.
+type ObjectInfo struct {
+	Name string
+	Size int64
+}
+
+// DirObjectStore is an ObjectStore that keeps its objects as files in a
+// local directory, e.g. one on a network mount.
+type DirObjectStore struct {
+	Dir string
+}
+
+var _ ObjectStore = (*DirObjectStore)(nil)
+
+// NewDirObjectStore returns an object store for the given directory,
+// creating it if it doesn't exist.
+func NewDirObjectStore(dir string) (*DirObjectStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirObjectStore{Dir: dir}, nil
+}
+
+// Put writes the object to a temporary file first and renames it into place,
+// so a failed Put never leaves a partial object behind.
+func (d *DirObjectStore) Put(name string, r io.Reader, size int64) error {
+	f, err := ioutil.TempFile(d.Dir, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if n != size {
+		_ = f.Close()
+		return io.ErrUnexpectedEOF
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path.Join(d.Dir, name))
+}
+
+func (d *DirObjectStore) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(d.Dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (d *DirObjectStore) Delete(name string) error {
+	err := os.Remove(path.Join(d.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DirObjectStore) List() ([]ObjectInfo, error) {
+	files, err := ioutil.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var objects []ObjectInfo
+	for _, file := range files {
+		// skip directories and the temporary files of in-flight puts
+		if file.IsDir() || file.Name()[0] == '.' {
+			continue
+		}
+		objects = append(objects, ObjectInfo{Name: file.Name(), Size: file.Size()})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
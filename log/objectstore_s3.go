@@ -0,0 +1,298 @@
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3ObjectStore.
+type S3Config struct {
+	// Endpoint is the base URL of the S3 compatible service, e.g.
+	// "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is prepended to every object name, so several logs can share a
+	// bucket.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client is the HTTP client used for requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// S3ObjectStore is an ObjectStore backed by a bucket of an S3 compatible
+// service. It uses path-style requests signed with AWS Signature Version 4,
+// which every S3 compatible service we care about understands.
+type S3ObjectStore struct {
+	config S3Config
+	// now is overridden in tests
+	now func() time.Time
+}
+
+var _ ObjectStore = (*S3ObjectStore)(nil)
+
+func NewS3ObjectStore(c S3Config) (*S3ObjectStore, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	return &S3ObjectStore{config: c, now: time.Now}, nil
+}
+
+func (s *S3ObjectStore) Put(name string, r io.Reader, size int64) error {
+	req, err := s.newRequest(http.MethodPut, s.config.Prefix+name, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3ObjectStore) Get(name string) (io.ReadCloser, error) {
+	req, err := s.newRequest(http.MethodGet, s.config.Prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3ObjectStore) Delete(name string) error {
+	req, err := s.newRequest(http.MethodDelete, s.config.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// listBucketResult is the part of the ListObjectsV2 response we use.
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3ObjectStore) List() ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	query := url.Values{}
+	query.Set("list-type", "2")
+	if s.config.Prefix != "" {
+		query.Set("prefix", s.config.Prefix)
+	}
+	for {
+		req, err := s.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: decode list response: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Name: strings.TrimPrefix(c.Key, s.config.Prefix),
+				Size: c.Size,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// newRequest builds a signed request for the given key of the bucket, or for
+// the bucket itself if key is empty.
+func (s *S3ObjectStore) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	uri := "/" + awsEscape(s.config.Bucket, false)
+	if key != "" {
+		uri += "/" + awsEscape(key, true)
+	}
+	rawQuery := canonicalQuery(query)
+	target := s.config.Endpoint + uri
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, uri, rawQuery)
+	return req, nil
+}
+
+// do sends the request and turns error responses into errors.
+func (s *S3ObjectStore) do(req *http.Request) (*http.Response, error) {
+	res, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("s3: %s %s: %s: %s", req.Method, req.URL.Path, res.Status, msg)
+}
+
+// unsignedPayload tells the service not to check a hash of the body, so we
+// can stream segment files without reading them twice.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the AWS Signature Version 4 headers to the request.
+//
+// See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *S3ObjectStore) sign(req *http.Request, uri, rawQuery string) {
+	amzDate := s.now().UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	canonical, signedHeaders := canonicalRequest(req.Method, uri, rawQuery, []signedHeader{
+		{"host", req.URL.Host},
+		{"x-amz-content-sha256", unsignedPayload},
+		{"x-amz-date", amzDate},
+	}, unsignedPayload)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, credentialScope(amzDate, s.config.Region), signedHeaders,
+		signV4(s.config.SecretAccessKey, s.config.Region, amzDate, canonical),
+	))
+}
+
+// signedHeader is a header covered by a request's signature, its name lower
+// case.
+type signedHeader struct {
+	name, value string
+}
+
+// canonicalRequest returns the canonical form of a request, which is what's
+// signed, and the list of its signed headers. The headers must be sorted by
+// name, and payloadHash is the hex SHA-256 of the body or unsignedPayload.
+func canonicalRequest(method, uri, rawQuery string, headers []signedHeader, payloadHash string) (string, string) {
+	lines := []string{method, uri, rawQuery}
+	names := make([]string, 0, len(headers))
+	for _, h := range headers {
+		lines = append(lines, h.name+":"+strings.TrimSpace(h.value))
+		names = append(names, h.name)
+	}
+	signedHeaders := strings.Join(names, ";")
+	lines = append(lines, "", signedHeaders, payloadHash)
+	return strings.Join(lines, "\n"), signedHeaders
+}
+
+// credentialScope is the scope a signature made at amzDate is valid for.
+func credentialScope(amzDate, region string) string {
+	return amzDate[:8] + "/" + region + "/s3/aws4_request"
+}
+
+// signV4 returns the hex signature of a canonical request made at amzDate.
+func signV4(secret, region, amzDate, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope(amzDate, region),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query with its keys sorted, the way Signature
+// Version 4 expects it.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and
+// slashes too if keepSlash is false. url.PathEscape and url.QueryEscape
+// each leave a few characters alone that Signature Version 4 encodes.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,263 @@
+package log
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectStores(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, store ObjectStore){
+		"put, get and delete objects": testObjectPutGetDelete,
+		"list objects":                testObjectList,
+	} {
+		t.Run("dir "+scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "object-store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			store, err := NewDirObjectStore(dir)
+			require.NoError(t, err)
+			fn(t, store)
+		})
+		t.Run("s3 "+scenario, func(t *testing.T) {
+			fake := newFakeS3("logs", "secret")
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			store, err := NewS3ObjectStore(S3Config{
+				Endpoint:        srv.URL,
+				Bucket:          "logs",
+				Prefix:          "test/",
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "secret",
+			})
+			require.NoError(t, err)
+			fn(t, store)
+			require.NoError(t, fake.err())
+		})
+	}
+}
+
+// TestS3Signature checks requests are signed as in the examples of AWS's
+// documentation of Signature Version 4 for S3.
+func TestS3Signature(t *testing.T) {
+	const (
+		secret    = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+		amzDate   = "20130524T000000Z"
+		host      = "examplebucket.s3.amazonaws.com"
+		emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+	for _, tt := range []struct {
+		name, uri, rawQuery string
+		headers             []signedHeader
+		signedHeaders, want string
+	}{{
+		name: "get object",
+		uri:  "/test.txt",
+		headers: []signedHeader{
+			{"host", host},
+			{"range", "bytes=0-9"},
+			{"x-amz-content-sha256", emptyHash},
+			{"x-amz-date", amzDate},
+		},
+		signedHeaders: "host;range;x-amz-content-sha256;x-amz-date",
+		want:          "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41",
+	}, {
+		name:     "list objects",
+		uri:      "/",
+		rawQuery: "max-keys=2&prefix=J",
+		headers: []signedHeader{
+			{"host", host},
+			{"x-amz-content-sha256", emptyHash},
+			{"x-amz-date", amzDate},
+		},
+		signedHeaders: "host;x-amz-content-sha256;x-amz-date",
+		want:          "34b48302e7b5fa45bde8084f4b7868a86f0a534bc59db6670ed5711ef69dc6f7",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			canonical, signedHeaders := canonicalRequest(http.MethodGet, tt.uri, tt.rawQuery, tt.headers, emptyHash)
+			require.Equal(t, tt.signedHeaders, signedHeaders)
+			require.Equal(t, tt.want, signV4(secret, "us-east-1", amzDate, canonical))
+		})
+	}
+}
+
+func testObjectPutGetDelete(t *testing.T, store ObjectStore) {
+	want := []byte("hello world")
+	require.NoError(t, store.Put("0.store", bytes.NewReader(want), int64(len(want))))
+
+	r, err := store.Get("0.store")
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, want, got)
+
+	require.NoError(t, store.Delete("0.store"))
+	_, err = store.Get("0.store")
+	require.Equal(t, ErrObjectNotFound, err)
+
+	// deleting a missing object isn't an error
+	require.NoError(t, store.Delete("0.store"))
+}
+
+func testObjectList(t *testing.T, store ObjectStore) {
+	for _, name := range []string{"16.store", "0.store", "0.index"} {
+		require.NoError(t, store.Put(name, strings.NewReader(name), int64(len(name))))
+	}
+	objects, err := store.List()
+	require.NoError(t, err)
+	require.Equal(t, []ObjectInfo{
+		{Name: "0.index", Size: 7},
+		{Name: "0.store", Size: 7},
+		{Name: "16.store", Size: 8},
+	}, objects)
+}
+
+// fakeS3 is a local stand-in for an S3 compatible service. It keeps objects
+// in memory and understands just enough of the API for S3ObjectStore. It
+// runs on the server's goroutines, so rather than failing the test it
+// records what's wrong with the requests it gets, for err to report.
+type fakeS3 struct {
+	bucket  string
+	secret  string
+	mu      sync.Mutex
+	objects map[string][]byte
+	errs    []string
+}
+
+func newFakeS3(bucket, secret string) *fakeS3 {
+	return &fakeS3{bucket: bucket, secret: secret, objects: make(map[string][]byte)}
+}
+
+// err returns the problems found with the requests served so far.
+func (f *fakeS3) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(f.errs, "; "))
+}
+
+// fail records a problem with a request and rejects it. f.mu must be held.
+func (f *fakeS3) fail(w http.ResponseWriter, r *http.Request, format string, args ...interface{}) {
+	msg := r.Method + " " + r.URL.String() + ": " + fmt.Sprintf(format, args...)
+	f.errs = append(f.errs, msg)
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+var authorizationPattern = regexp.MustCompile(
+	`^AWS4-HMAC-SHA256 Credential=AKID/(\d{8})/us-east-1/s3/aws4_request, ` +
+		`SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=([0-9a-f]{64})$`,
+)
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.verify(r); err != nil {
+		f.fail(w, r, "%v", err)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if key == "" {
+		f.list(w, r)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.fail(w, r, "reading the body: %v", err)
+			return
+		}
+		if int64(len(b)) != r.ContentLength {
+			f.fail(w, r, "got %d bytes, but Content-Length is %d", len(b), r.ContentLength)
+			return
+		}
+		f.objects[key] = b
+	case http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(b)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify checks the request's signature the way S3 would, from the request
+// as it arrived.
+func (f *fakeS3) verify(r *http.Request) error {
+	m := authorizationPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("bad authorization %q", r.Header.Get("Authorization"))
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	if !strings.HasPrefix(amzDate, m[1]) {
+		return fmt.Errorf("x-amz-date %q isn't in the credential's day %s", amzDate, m[1])
+	}
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	canonical, _ := canonicalRequest(r.Method, r.URL.EscapedPath(), r.URL.RawQuery, []signedHeader{
+		{"host", r.Host},
+		{"x-amz-content-sha256", payloadHash},
+		{"x-amz-date", amzDate},
+	}, payloadHash)
+	if want := signV4(f.secret, "us-east-1", amzDate, canonical); m[2] != want {
+		return fmt.Errorf("signature %s doesn't match %s", m[2], want)
+	}
+	return nil
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+		f.fail(w, r, "expected a ListObjectsV2 request")
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// return one object per page to exercise continuation
+	var result listBucketResult
+	token := r.URL.Query().Get("continuation-token")
+	for i, key := range keys {
+		if key <= token {
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key  string
+			Size int64
+		}{key, int64(len(f.objects[key]))})
+		result.IsTruncated = i < len(keys)-1
+		result.NextContinuationToken = key
+		break
+	}
+	err := xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listBucketResult
+	}{listBucketResult: result})
+	if err != nil {
+		f.errs = append(f.errs, "encoding the listing: "+err.Error())
+	}
+}
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// producerWindow is how many of a producer's latest runs of records the log
+// remembers, so that a producer can have that many appends or batches in
+// flight and still have any of them deduplicated when it retries.
+const producerWindow = 5
+
+// producerState is what the log remembers about a producer: its latest runs
+// of records, oldest first, up to producerWindow of them, and when it last
+// appended one, which is when the log was opened for the records it replays.
+type producerState struct {
+	Runs       []producedRun `json:"runs"`
+	LastAppend time.Time     `json:"last_append"`
+}
+
+// producedRun is a run of a producer's records with consecutive sequences at
+// consecutive offsets, like the records of a batch: the first record's
+// sequence and offset, and how many records there are.
+type producedRun struct {
+	Sequence uint64 `json:"sequence"`
+	Offset   uint64 `json:"offset"`
+	Count    uint64 `json:"count"`
+}
+
+// last returns the sequence of the producer's last record.
+func (p producerState) last() uint64 {
+	r := p.Runs[len(p.Runs)-1]
+	return r.Sequence + r.Count - 1
+}
+
+// offset returns the offset of the producer's record with the sequence, if
+// it's one of the records the log remembers.
+func (p producerState) offset(seq uint64) (uint64, bool) {
+	for _, r := range p.Runs {
+		if r.Sequence <= seq && seq-r.Sequence < r.Count {
+			return r.Offset + seq - r.Sequence, true
+		}
+	}
+	return 0, false
+}
+
+// checkSequences looks the records' producers up to see which of the records
+// were appended already, as they are when a batch is retried. For each one
+// that was, it returns the original offset and true. A producer's records
+// that weren't must follow on from its last, with consecutive sequences;
+// the first record the log sees from a producer can have any sequence. It
+// returns an ErrSequenceGap for a record that skips ahead and an
+// ErrSequenceOutOfOrder for one that goes back further than the log
+// remembers. The caller must hold the write lock.
+func (l *Log) checkSequences(records []*api.Record) ([]uint64, []bool, error) {
+	offs := make([]uint64, len(records))
+	dups := make([]bool, len(records))
+	// next is the sequence a producer's next record must have once one of
+	// its records in the batch is new
+	next := make(map[string]uint64)
+	for i, record := range records {
+		id := record.ProducerId
+		if id == "" {
+			continue
+		}
+		last, ok := next[id]
+		if ok {
+			last--
+		} else if p, ok := l.producers[id]; !ok {
+			next[id] = record.Sequence + 1
+			continue
+		} else {
+			last = p.last()
+			if record.Sequence <= last {
+				if offs[i], dups[i] = p.offset(record.Sequence); dups[i] {
+					continue
+				}
+			}
+		}
+		switch {
+		case record.Sequence == last+1:
+			next[id] = record.Sequence + 1
+		case record.Sequence > last+1:
+			return nil, nil, api.ErrSequenceGap{ProducerID: id, Sequence: record.Sequence, Last: last}
+		default:
+			return nil, nil, api.ErrSequenceOutOfOrder{ProducerID: id, Sequence: record.Sequence, Last: last}
+		}
+	}
+	return offs, dups, nil
+}
+
+// trackSequence remembers the record as its producer's last, adding it to the
+// producer's last run if it follows on from it, and otherwise starting a new
+// run and dropping the oldest if there are more than producerWindow.
+func (l *Log) trackSequence(record *api.Record, off uint64, now time.Time) {
+	if record.ProducerId == "" {
+		return
+	}
+	p := l.producers[record.ProducerId]
+	p.LastAppend = now
+	if n := len(p.Runs); n > 0 {
+		if r := &p.Runs[n-1]; r.Sequence+r.Count == record.Sequence && r.Offset+r.Count == off {
+			r.Count++
+			l.producers[record.ProducerId] = p
+			return
+		}
+	}
+	runs := append(p.Runs, producedRun{Sequence: record.Sequence, Offset: off, Count: 1})
+	if n := len(runs); n > producerWindow {
+		runs = append([]producedRun(nil), runs[n-producerWindow:]...)
+	}
+	p.Runs = runs
+	l.producers[record.ProducerId] = p
+}
+
+// expireProducers forgets the producers that haven't appended for
+// Config.Producer.IdleTimeout, so that producers that come and go don't
+// grow the state without bound. The caller must hold the write lock.
+func (l *Log) expireProducers(now time.Time) {
+	for id, p := range l.producers {
+		if now.Sub(p.LastAppend) > l.Config.Producer.IdleTimeout {
+			delete(l.producers, id)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestIdempotentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	produce := func(l *Log, producer string, seq uint64) (uint64, error) {
+		return l.Append(&api.Record{Value: []byte("hello"), ProducerId: producer, Sequence: seq})
+	}
+	for seq := uint64(0); seq < 2; seq++ {
+		off, err := produce(log, "a", seq)
+		require.NoError(t, err)
+		require.Equal(t, seq, off)
+	}
+	// a retry of the last record returns its offset without appending
+	off, err := produce(log, "a", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	// producers are tracked separately, and records without a producer
+	// are always appended
+	off, err = produce(log, "b", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = produce(log, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = produce(log, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// so is a retry of an earlier record still in the producer's window
+	off, err = produce(log, "a", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "a", read.ProducerId)
+	require.Equal(t, uint64(1), read.Sequence)
+
+	// the state survives reopening the log, from the snapshot written when
+	// it's closed
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err = produce(log, "a", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// and is rebuilt from the records if the snapshot is lost, as it would
+	// be after a crash
+	off, err = produce(log, "b", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(path.Join(dir, stateFile)))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err = produce(log, "a", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = produce(log, "b", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+}
+
+func TestProducerWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	produce := func(l *Log, seq uint64) (uint64, error) {
+		return l.Append(&api.Record{Value: []byte("hello"), ProducerId: "a", Sequence: seq})
+	}
+	// a producer's first record can start anywhere. Every record is
+	// followed by another producer's, so each is a run of its own.
+	for seq := uint64(10); seq < 17; seq++ {
+		off, err := produce(log, seq)
+		require.NoError(t, err)
+		require.Equal(t, 2*(seq-10), off)
+		_, err = log.Append(&api.Record{Value: []byte("other")})
+		require.NoError(t, err)
+	}
+
+	check := func(l *Log) {
+		t.Helper()
+		// retries of any of the last producerWindow runs, as when several
+		// appends were in flight, return their offsets
+		for seq := uint64(17 - producerWindow); seq < 17; seq++ {
+			off, err := produce(l, seq)
+			require.NoError(t, err)
+			require.Equal(t, 2*(seq-10), off)
+		}
+		_, err := produce(l, 16-producerWindow)
+		require.Equal(t, api.ErrSequenceOutOfOrder{ProducerID: "a", Sequence: 16 - producerWindow, Last: 16}, err)
+		// the log won't skip over records that never reached it
+		_, err = produce(l, 18)
+		require.Equal(t, api.ErrSequenceGap{ProducerID: "a", Sequence: 18, Last: 16}, err)
+		highest, err := l.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(13), highest)
+	}
+	check(log)
+
+	// the window survives reopening the log, from the snapshot or, if it's
+	// lost, from the records
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(path.Join(dir, stateFile)))
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+}
+
+func TestAppendBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	batch := func(producer string, seqs ...uint64) []*api.Record {
+		records := make([]*api.Record, 0, len(seqs))
+		for _, seq := range seqs {
+			records = append(records, &api.Record{Value: []byte("hello"), ProducerId: producer, Sequence: seq})
+		}
+		return records
+	}
+	requireHighest := func(l *Log, want uint64) {
+		t.Helper()
+		highest, err := l.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, want, highest)
+	}
+
+	offs, err := log.AppendBatch(context.Background(), batch("a", 0, 1, 2))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offs)
+	// a retried batch gets its original offsets, even though it's more
+	// records than the producer window
+	offs, err = log.AppendBatch(context.Background(), batch("a", 0, 1, 2))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offs)
+	requireHighest(log, 2)
+	// and a batch that was partly appended has the rest appended, rolling
+	// the segment along the way
+	offs, err = log.AppendBatch(context.Background(), batch("a", 1, 2, 3, 4, 5))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3, 4, 5}, offs)
+	requireHighest(log, 5)
+
+	// a batch with a bad record appends none of them
+	_, err = log.AppendBatch(context.Background(), append(batch("b", 0), batch("a", 6, 8)...))
+	require.Equal(t, api.ErrSequenceGap{ProducerID: "a", Sequence: 8, Last: 6}, err)
+	_, err = log.AppendBatch(context.Background(), append(batch("a", 6), batch("a", 6)...))
+	require.Equal(t, api.ErrSequenceOutOfOrder{ProducerID: "a", Sequence: 6, Last: 6}, err)
+	open := batch("b", 0, 1)
+	open[1].TransactionId = "missing"
+	_, err = log.AppendBatch(context.Background(), open)
+	require.Equal(t, api.ErrTransactionNotFound{ID: "missing"}, err)
+	requireHighest(log, 5)
+
+	// the batch is remembered as a run, which is rebuilt from the records
+	// when the snapshot is lost
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(path.Join(dir, stateFile)))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	offs, err = log.AppendBatch(context.Background(), batch("a", 0, 1, 2, 3, 4, 5, 6))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6}, offs)
+	requireHighest(log, 6)
+}
+
+func TestProducerSnapshotOnRoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for seq := uint64(0); seq < 3; seq++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello"), ProducerId: "a", Sequence: seq})
+		require.NoError(t, err)
+	}
+
+	// the segment rolled after the second record, snapshotting the state
+	// up to it; opening the log replays the third record on top of it
+	snap, err := log.readStateSnapshot()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), snap.NextOffset)
+	require.Len(t, snap.Producers, 1)
+	require.Equal(t, []producedRun{{Sequence: 0, Offset: 0, Count: 2}}, snap.Producers["a"].Runs)
+
+	// flush the store, so the third record is on disk without the log
+	// being closed, and release the lock, as a crashed process would
+	require.NoError(t, log.activeSegment.store.flush())
+	require.NoError(t, log.lock.Close())
+	reopened, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, reopened.producers, 1)
+	require.Equal(t, []producedRun{{Sequence: 0, Offset: 0, Count: 3}}, reopened.producers["a"].Runs)
+}
+
+func TestProducerExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Producer.IdleTimeout = 200 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	produce := func(l *Log, producer string, seq uint64) (uint64, error) {
+		return l.Append(&api.Record{Value: []byte("hello"), ProducerId: producer, Sequence: seq})
+	}
+	_, err = produce(log, "a", 0)
+	require.NoError(t, err)
+	time.Sleep(2 * c.Producer.IdleTimeout)
+
+	// b's record rolls the segment, which expires a, and the snapshot
+	// only keeps b
+	_, err = produce(log, "b", 0)
+	require.NoError(t, err)
+	require.Len(t, log.producers, 1)
+	require.Contains(t, log.producers, "b")
+	snap, err := log.readStateSnapshot()
+	require.NoError(t, err)
+	require.Len(t, snap.Producers, 1)
+	require.Contains(t, snap.Producers, "b")
+
+	// a's next record is taken as its first, so it's appended whatever its
+	// sequence, even a retry's
+	off, err := produce(log, "a", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, log.Close())
+
+	// the producers still live survive reopening the log
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.producers, 2)
+	off, err = produce(log, "b", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
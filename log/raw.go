@@ -0,0 +1,127 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// ErrRawUnavailable is returned by ReadRaw for records that can't be sent as
+// they're stored: those of encrypted segments, which only the log can
+// decrypt, and of offloaded ones, which aren't on local disk.
+var ErrRawUnavailable = errors.New("records aren't available raw")
+
+// RawRecords is a run of consecutive records as their store keeps them: each
+// record framed by its length as a big-endian uint64 and JSON-encoded. It
+// reads from a file handle of its own, so it stays readable after the log
+// lock is released, even if the segment is removed meanwhile; Close releases
+// the handle.
+type RawRecords struct {
+	// Offset is the offset of the first record.
+	Offset uint64
+	// Positions are where each record's frame starts, relative to the start
+	// of the first.
+	Positions []uint64
+	// Size is the number of bytes WriteTo writes.
+	Size int64
+
+	file File
+	pos  int64
+}
+
+// ReadRaw returns the records from offset off on, as many as fit in maxBytes
+// but at least one, up to the end of the segment holding off.
+func (l *Log) ReadRaw(off, maxBytes uint64) (*RawRecords, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var s *segment
+	for _, seg := range l.segments {
+		if seg.baseOffset <= off && off < seg.nextOffset {
+			s = seg
+			break
+		}
+	}
+	if s == nil {
+		for _, rs := range l.remote {
+			if rs.baseOffset <= off && off < rs.nextOffset {
+				return nil, fmt.Errorf("offset %d is offloaded: %w", off, ErrRawUnavailable)
+			}
+		}
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if s.aead != nil {
+		return nil, fmt.Errorf("offset %d is encrypted: %w", off, ErrRawUnavailable)
+	}
+
+	_, start, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	r := &RawRecords{Offset: off, Positions: []uint64{0}, pos: int64(start)}
+	end, err := s.recordEnd(off)
+	if err != nil {
+		return nil, err
+	}
+	for next := off + 1; next < s.nextOffset; next++ {
+		nextEnd, err := s.recordEnd(next)
+		if err != nil {
+			return nil, err
+		}
+		if nextEnd-start > maxBytes {
+			break
+		}
+		r.Positions = append(r.Positions, end-start)
+		end = nextEnd
+	}
+	r.Size = int64(end - start)
+
+	// the file only has what the store has flushed. This flushes with
+	// just the read lock held, which the store allows for; see store.mu
+	if err = s.store.flushTo(end); err != nil {
+		return nil, err
+	}
+	if r.file, err = l.Config.fs().OpenFile(s.store.Name(), os.O_RDONLY, 0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// recordEnd returns the position in the store just past the record at off.
+// Records are contiguous, so that's where the next one starts, except for the
+// segment's last record.
+func (s *segment) recordEnd(off uint64) (uint64, error) {
+	if off+1 < s.nextOffset {
+		_, pos, err := s.index.Read(int64(off + 1 - s.baseOffset))
+		return pos, err
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return 0, err
+	}
+	size := make([]byte, lenWidth)
+	if _, err = s.store.ReadAt(size, int64(pos)); err != nil {
+		return 0, err
+	}
+	return pos + lenWidth + enc.Uint64(size), nil
+}
+
+// WriteTo writes the records to w. Copying from an *os.File to a TCP
+// connection, or to an http.ResponseWriter over one, lets the kernel send
+// the bytes with sendfile rather than copying them through the process.
+func (r *RawRecords) WriteTo(w io.Writer) (int64, error) {
+	if f, ok := r.file.(*os.File); ok {
+		if _, err := f.Seek(r.pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return io.Copy(w, io.LimitReader(f, r.Size))
+	}
+	return io.Copy(w, io.NewSectionReader(r.file, r.pos, r.Size))
+}
+
+// Close releases the records' file handle.
+func (r *RawRecords) Close() error {
+	return r.file.Close()
+}
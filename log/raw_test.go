@@ -0,0 +1,106 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestReadRaw(t *testing.T) {
+	for name, fsys := range map[string]FS{"os": OSFS, "mem": NewMemFS()} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "raw-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			require.NoError(t, fsys.MkdirAll(dir, 0755))
+
+			c := Config{FS: fsys}
+			c.Segment.MaxStoreBytes = 1024
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 5; i++ {
+				_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+
+			// the records still buffered are flushed for the file to hold them
+			raw, err := log.ReadRaw(1, 1<<20)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), raw.Offset)
+			require.Len(t, raw.Positions, 4)
+			records := readRawRecords(t, raw)
+			for i, record := range records {
+				require.Equal(t, uint64(i+1), record.Offset)
+				require.Equal(t, fmt.Sprintf("record %d", i+1), string(record.Value))
+			}
+
+			// maxBytes bounds the run, but a record is always returned
+			raw, err = log.ReadRaw(2, raw.Positions[1]+raw.Positions[1]/2)
+			require.NoError(t, err)
+			require.Len(t, raw.Positions, 1)
+			require.Equal(t, "record 2", string(readRawRecords(t, raw)[0].Value))
+			raw, err = log.ReadRaw(3, 0)
+			require.NoError(t, err)
+			require.Len(t, raw.Positions, 1)
+			require.Equal(t, "record 3", string(readRawRecords(t, raw)[0].Value))
+
+			_, err = log.ReadRaw(5, 1<<20)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+		})
+	}
+}
+
+func TestReadRawEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raw-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyring := NewKeyring()
+	require.NoError(t, keyring.Add("k1", bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, keyring.SetActive("k1"))
+	c := Config{}
+	c.Encryption.Keyring = keyring
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(&api.Record{Value: []byte("secret")})
+	require.NoError(t, err)
+
+	_, err = log.ReadRaw(0, 1<<20)
+	require.True(t, errors.Is(err, ErrRawUnavailable))
+}
+
+// readRawRecords decodes the records of raw, checking they're framed where
+// its positions say.
+func readRawRecords(t *testing.T, raw *RawRecords) []*api.Record {
+	t.Helper()
+	var b bytes.Buffer
+	n, err := raw.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, raw.Size, n)
+	require.NoError(t, raw.Close())
+
+	var records []*api.Record
+	p := b.Bytes()
+	for i, pos := range raw.Positions {
+		end := uint64(len(p))
+		if i+1 < len(raw.Positions) {
+			end = raw.Positions[i+1]
+		}
+		size := enc.Uint64(p[pos : pos+lenWidth])
+		require.Equal(t, end, pos+lenWidth+size)
+		record := &api.Record{}
+		require.NoError(t, json.Unmarshal(p[pos+lenWidth:end], record))
+		records = append(records, record)
+	}
+	return records
+}
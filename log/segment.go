@@ -1,8 +1,11 @@
 package log
 
 import (
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 
@@ -14,6 +17,11 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+
+	// keyID is the ID of the key the segment's records are encrypted with,
+	// empty if the segment is plain.
+	keyID string
+	aead  cipher.AEAD
 }
 
 // newSegment creates a new segment, typically used when the active segment hits
@@ -24,10 +32,14 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		config:     c,
 	}
 
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE|os.O_APPEND, os.O_RDWR|os.O_CREATE
+	if c.ReadOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
+	}
 	var err error
-	storeFile, err := os.OpenFile(
+	storeFile, err := c.fs().OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		storeFlag,
 		0644,
 	)
 	if err != nil {
@@ -36,9 +48,12 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(
+	if err = s.setupEncryption(); err != nil {
+		return nil, err
+	}
+	indexFile, err := c.fs().OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
+		indexFlag,
 		0644,
 	)
 	if err != nil {
@@ -47,6 +62,9 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if err = s.recover(); err != nil {
+		return nil, fmt.Errorf("segment %d: %w", baseOffset, err)
+	}
 
 	// Set the segments next offset to prepare for the next appended record.
 	off, _, err := s.index.Read(-1)
@@ -63,19 +81,162 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	return s, nil
 }
 
+// setupEncryption reads the key ID from the header of an existing store, or
+// writes a header to a new store when encryption is enabled.
+func (s *segment) setupEncryption() error {
+	keyring := s.config.Encryption.Keyring
+	if s.store.size > 0 {
+		if _, err := s.store.Read(0); errors.Is(err, io.EOF) {
+			// a crash cut the first frame short, so the store has no
+			// whole record to keep, nor a header
+			if s.config.ReadOnly {
+				s.store.size = 0
+			} else if err = s.store.truncate(0); err != nil {
+				return err
+			}
+		}
+	}
+	if s.store.size == 0 {
+		if keyring == nil || keyring.Active == "" || s.config.ReadOnly {
+			return nil
+		}
+		s.keyID = keyring.Active
+		if _, _, err := s.store.Append(encodeSegmentHeader(s.keyID)); err != nil {
+			return err
+		}
+	} else {
+		p, err := s.store.Read(0)
+		if err != nil {
+			return err
+		}
+		keyID, isEncrypted := decodeSegmentHeader(p)
+		if !isEncrypted {
+			return nil
+		}
+		if keyring == nil {
+			return fmt.Errorf(
+				"segment %d is encrypted with key %q but no keyring is configured",
+				s.baseOffset, keyID,
+			)
+		}
+		s.keyID = keyID
+	}
+	var err error
+	if s.aead, err = keyring.aead(s.keyID); err != nil {
+		return fmt.Errorf("segment %d: %w", s.baseOffset, err)
+	}
+	return nil
+}
+
+// recover cuts the segment back to its last whole record. A segment that
+// wasn't closed cleanly has an index still padded with zeros past its last
+// entry, up to the size it last grew to, and after a power loss either of
+// its files may have kept writes the other lost. The index is cut off at the first entry that
+// doesn't point at the record following the previous one, and the store
+// after the last indexed record.
+func (s *segment) recover() error {
+	start := uint64(0)
+	if s.keyID != "" {
+		header, err := s.store.Read(0)
+		if err != nil {
+			return err
+		}
+		start = lenWidth + uint64(len(header))
+	}
+	n := s.index.size / entWidth
+	// a cleanly closed segment's last entry points at the store's last
+	// record, so there's no need to check the others
+	if n > 0 {
+		if pos, end, ok := s.indexedRecord(n - 1); ok && pos >= start && end == s.store.size {
+			return nil
+		}
+	}
+	var valid uint64
+	end := start
+	for ; valid < n; valid++ {
+		pos, next, ok := s.indexedRecord(valid)
+		if !ok || pos != end {
+			break
+		}
+		end = next
+	}
+	s.index.size = valid * entWidth
+	if end < s.store.size {
+		if s.config.ReadOnly {
+			// leave the file for the next writable open to recover, and
+			// just not read past end
+			s.store.size = end
+			return nil
+		}
+		return s.store.truncate(end)
+	}
+	return nil
+}
+
+// indexedRecord returns the position and end of the record index entry i
+// points at, and false if the entry doesn't have the right offset or the
+// record isn't all in the store.
+func (s *segment) indexedRecord(i uint64) (pos, end uint64, ok bool) {
+	at := i * entWidth
+	off := enc.Uint32(s.index.mmap[at : at+offWidth])
+	pos = enc.Uint64(s.index.mmap[at+offWidth : at+entWidth])
+	if uint64(off) != i || pos+lenWidth > s.store.size || pos+lenWidth < pos {
+		return 0, 0, false
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+		return 0, 0, false
+	}
+	end = pos + lenWidth + enc.Uint64(size)
+	if end > s.store.size || end < pos {
+		return 0, 0, false
+	}
+	return pos, end, true
+}
+
+// Sync commits the segment's records to stable storage.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// seal maps the segment's files read-only once the log has moved on to a new
+// active segment.
+func (s *segment) seal() error {
+	if err := s.store.seal(s.config.fs()); err != nil {
+		return err
+	}
+	return s.index.seal()
+}
+
+// errSegmentFull is returned by segment.Append when the segment is maxed and
+// the record has to go to a new segment.
+var errSegmentFull = errors.New("segment is full")
+
 // Append writes the record to the segment and returns the newly appended
-// record's offset.
+// record's offset. It's all or nothing: a record whose index entry can't be
+// written is removed from the store again.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	if s.IsMaxed() {
+		return 0, errSegmentFull
+	}
 	cur := s.nextOffset
 	record.Offset = cur
 	p, err := json.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	if s.aead != nil {
+		if p, err = seal(s.aead, cur, p); err != nil {
+			return 0, err
+		}
+	}
 
-	_, pos, err := s.store.Append(p)
-	if err != nil {
-		return 0, err
+	pos := s.store.size
+	if _, _, err = s.store.Append(p); err != nil {
+		return 0, s.dropFrom(pos, err)
 	}
 
 	relativeOffset := uint32(s.nextOffset - s.baseOffset)
@@ -84,14 +245,25 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		relativeOffset,
 		pos,
 	); err != nil {
-		return 0, err
+		return 0, s.dropFrom(pos, err)
 	}
 
 	s.nextOffset++
 	return cur, nil
 }
 
-// Read returns the record for the given offset.
+// dropFrom cuts the store back to pos after appending a record failed with
+// err, so the store doesn't keep a record the index doesn't know about.
+func (s *segment) dropFrom(pos uint64, err error) error {
+	if terr := s.store.truncate(pos); terr != nil {
+		return fmt.Errorf("%w, and dropping the record failed: %v", err, terr)
+	}
+	return err
+}
+
+// Read returns the record for the given offset. A sealed segment's record is
+// decoded straight from its store's mapping, without a copy; decoding
+// copies what the record keeps, so it stays valid after the segment closes.
 func (s *segment) Read(off uint64) (*api.Record, error) {
 	relativeOffset := int64(off - s.baseOffset)
 	_, pos, err := s.index.Read(relativeOffset)
@@ -103,8 +275,20 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	if err != nil {
 		return nil, err
 	}
+	return decodeRecord(s.aead, off, p)
+}
+
+// decodeRecord unmarshals a record read from a store, decrypting it first if
+// the store is encrypted.
+func decodeRecord(aead cipher.AEAD, off uint64, p []byte) (*api.Record, error) {
+	if aead != nil {
+		var err error
+		if p, err = open(aead, off, p); err != nil {
+			return nil, err
+		}
+	}
 	record := &api.Record{}
-	err = json.Unmarshal(p, record)
+	err := json.Unmarshal(p, record)
 	return record, err
 }
 
@@ -118,7 +302,9 @@ func (s *segment) IsMaxed() bool {
 	maxStoreBytes := s.config.Segment.MaxStoreBytes
 	indexSize := s.index.size
 	maxIndexBytes := s.config.Segment.MaxIndexBytes
-	return storeSize >= maxStoreBytes || indexSize >= maxIndexBytes
+	// the index is full once another entry wouldn't fit, which is before
+	// it reaches a MaxIndexBytes that isn't a multiple of entWidth
+	return storeSize >= maxStoreBytes || indexSize+entWidth > maxIndexBytes
 }
 
 // Remove closes the segment and removes the index and store files.
@@ -126,10 +312,10 @@ func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.config.fs().Remove(s.index.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.config.fs().Remove(s.store.Name()); err != nil {
 		return err
 	}
 	return nil
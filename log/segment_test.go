@@ -1,9 +1,9 @@
 package log
 
 import (
+	"errors"
 	api "github.com/MRSharff/distributed-services-with-go/api/v1"
 	"github.com/stretchr/testify/require"
-	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -34,11 +34,15 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, want.Value, got.Value)
 	}
 
+	// a full segment refuses the record without storing any of it
+	storeSize := s.store.size
 	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, errSegmentFull, err)
+	require.Equal(t, storeSize, s.store.size)
 
 	// maxed index
 	require.True(t, s.IsMaxed())
+	require.NoError(t, s.Close())
 
 	c.Segment.MaxStoreBytes = uint64(len(want.Value) * 3)
 	c.Segment.MaxIndexBytes = 1024
@@ -54,3 +58,38 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+// failingTruncate fails to grow the index file.
+type failingTruncate struct {
+	File
+}
+
+func (failingTruncate) Truncate(int64) error { return errors.New("disk full") }
+
+func TestSegmentAppendIsAtomic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// the store write succeeds but the index can't grow to take the entry
+	file := s.index.file
+	s.index.file = failingTruncate{file}
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.EqualError(t, err, "disk full")
+	require.Equal(t, uint64(0), s.store.size)
+	require.Equal(t, uint64(0), s.nextOffset)
+
+	s.index.file = file
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	_, pos, err := s.index.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), pos)
+}
@@ -0,0 +1,273 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// A snapshot is a portable archive of a log. Unlike the raw store files that
+// Reader concatenates, it keeps the segment boundaries, so Restore can
+// rebuild an equivalent log from it. The layout is:
+//
+//	magic        "LOGSNAP1"
+//	header       lenWidth bytes of length, then the JSON encoded snapshotHeader
+//	records      for every record of every segment, oldest to newest:
+//	             lenWidth bytes of length, the JSON encoded api.Record, and
+//	             the record's CRC-32C
+//	checksum     the CRC-32C of everything before it
+//
+// Records are archived decrypted, so a snapshot can be restored without the
+// keyring of the log it was taken from.
+var snapshotMagic = []byte("LOGSNAP1")
+
+const snapshotVersion = 1
+
+type snapshotHeader struct {
+	Version  int               `json:"version"`
+	Segment  snapshotConfig    `json:"segment"`
+	Segments []snapshotSegment `json:"segments"`
+}
+
+type snapshotConfig struct {
+	MaxStoreBytes uint64 `json:"max_store_bytes"`
+	MaxIndexBytes uint64 `json:"max_index_bytes"`
+	InitialOffset uint64 `json:"initial_offset"`
+}
+
+type snapshotSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBadSnapshot is returned by Restore when the archive is malformed or
+// fails its checksums.
+var ErrBadSnapshot = errors.New("bad snapshot")
+
+// Snapshot writes an archive of the whole log, including any segments
+// offloaded to tiered storage, to w. Appends wait until the snapshot is
+// written.
+func (l *Log) Snapshot(w io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	header := snapshotHeader{
+		Version: snapshotVersion,
+		Segment: snapshotConfig{
+			MaxStoreBytes: l.Config.Segment.MaxStoreBytes,
+			MaxIndexBytes: l.Config.Segment.MaxIndexBytes,
+			InitialOffset: l.Config.Segment.InitialOffset,
+		},
+	}
+	for _, rs := range l.remote {
+		header.Segments = append(header.Segments, snapshotSegment{rs.baseOffset, rs.nextOffset})
+	}
+	for _, s := range l.segments {
+		header.Segments = append(header.Segments, snapshotSegment{s.baseOffset, s.nextOffset})
+	}
+
+	bw := bufio.NewWriter(w)
+	sum := crc32.New(crcTable)
+	sw := io.MultiWriter(bw, sum)
+	if _, err := sw.Write(snapshotMagic); err != nil {
+		return err
+	}
+	p, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err = writeFrame(sw, p); err != nil {
+		return err
+	}
+	for _, seg := range header.Segments {
+		for off := seg.BaseOffset; off < seg.NextOffset; off++ {
+			record, err := l.read(off)
+			if err != nil {
+				return err
+			}
+			if p, err = json.Marshal(record); err != nil {
+				return err
+			}
+			if err = writeFrame(sw, p); err != nil {
+				return err
+			}
+			if err = binary.Write(sw, enc, crc32.Checksum(p, crcTable)); err != nil {
+				return err
+			}
+		}
+	}
+	if err = binary.Write(bw, enc, sum.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore recreates the log archived by Snapshot in dir, which must not hold
+// a log already, and returns it opened with the archived segment config.
+//
+// The restored log isn't encrypted; run Reencrypt on it to encrypt it.
+func Restore(dir string, r io.Reader) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if ext := path.Ext(file.Name()); ext == ".store" || ext == ".index" {
+			return nil, fmt.Errorf("restore: %s already holds a log", dir)
+		}
+	}
+
+	sum := crc32.New(crcTable)
+	sr := &snapshotReader{r: bufio.NewReader(r), sum: sum}
+	c, err := sr.restore(dir)
+	if err != nil {
+		removeSegmentFiles(dir)
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+	return NewLog(dir, c)
+}
+
+type snapshotReader struct {
+	r   io.Reader
+	sum hash.Hash32
+}
+
+// Read reads from the archive and adds what it read to the checksum.
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.sum.Write(p[:n])
+	return n, err
+}
+
+func (sr *snapshotReader) restore(dir string) (Config, error) {
+	c := Config{}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(sr, magic); err != nil {
+		return c, err
+	}
+	if string(magic) != string(snapshotMagic) {
+		return c, fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	}
+	p, err := readFrame(sr)
+	if err != nil {
+		return c, err
+	}
+	var header snapshotHeader
+	if err = json.Unmarshal(p, &header); err != nil {
+		return c, fmt.Errorf("%w: header: %v", ErrBadSnapshot, err)
+	}
+	if header.Version != snapshotVersion {
+		return c, fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, header.Version)
+	}
+	c.Segment.MaxStoreBytes = header.Segment.MaxStoreBytes
+	c.Segment.MaxIndexBytes = header.Segment.MaxIndexBytes
+	c.Segment.InitialOffset = header.Segment.InitialOffset
+
+	for _, seg := range header.Segments {
+		if err = sr.restoreSegment(dir, seg, c); err != nil {
+			return c, err
+		}
+	}
+
+	want := sr.sum.Sum32()
+	var got uint32
+	if err = binary.Read(sr.r, enc, &got); err != nil {
+		return c, err
+	}
+	if got != want {
+		return c, fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+	return c, nil
+}
+
+func (sr *snapshotReader) restoreSegment(dir string, seg snapshotSegment, c Config) error {
+	s, err := newSegment(dir, seg.BaseOffset, c)
+	if err != nil {
+		return err
+	}
+	for off := seg.BaseOffset; off < seg.NextOffset; off++ {
+		p, err := readFrame(sr)
+		if err != nil {
+			_ = s.Close()
+			return err
+		}
+		var sum uint32
+		if err = binary.Read(sr, enc, &sum); err != nil {
+			_ = s.Close()
+			return err
+		}
+		if sum != crc32.Checksum(p, crcTable) {
+			_ = s.Close()
+			return fmt.Errorf("%w: record %d: checksum mismatch", ErrBadSnapshot, off)
+		}
+		record := &api.Record{}
+		if err = json.Unmarshal(p, record); err != nil {
+			_ = s.Close()
+			return fmt.Errorf("%w: record %d: %v", ErrBadSnapshot, off, err)
+		}
+		if record.Offset != off {
+			_ = s.Close()
+			return fmt.Errorf("%w: record %d has offset %d", ErrBadSnapshot, off, record.Offset)
+		}
+		if _, err = s.Append(record); err != nil {
+			_ = s.Close()
+			return err
+		}
+	}
+	return s.Close()
+}
+
+func writeFrame(w io.Writer, p []byte) error {
+	if err := binary.Write(w, enc, uint64(len(p))); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// maxSnapshotFrame guards against allocating absurd amounts of memory for a
+// corrupt length.
+const maxSnapshotFrame = 1 << 30
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size uint64
+	if err := binary.Read(r, enc, &size); err != nil {
+		return nil, err
+	}
+	if size > maxSnapshotFrame {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrBadSnapshot, size)
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// removeSegmentFiles cleans up after a failed restore.
+func removeSegmentFiles(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if ext := path.Ext(file.Name()); ext == ".store" || ext == ".index" {
+			_ = os.Remove(path.Join(dir, file.Name()))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// the restored log must keep the base offsets of the segments
+	require.NoError(t, log.Truncate(101))
+
+	var snapshot bytes.Buffer
+	require.NoError(t, log.Snapshot(&snapshot))
+
+	restoreDir, err := ioutil.TempDir("", "snapshot-test-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	restored, err := Restore(restoreDir, bytes.NewReader(snapshot.Bytes()))
+	require.NoError(t, err)
+
+	require.Equal(t, log.Config.Segment, restored.Config.Segment)
+	require.Equal(t, len(log.segments), len(restored.segments))
+	for i, s := range log.segments {
+		require.Equal(t, s.baseOffset, restored.segments[i].baseOffset)
+		require.Equal(t, s.nextOffset, restored.segments[i].nextOffset)
+	}
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	for off := lowest; off <= highest; off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Offset, got.Offset)
+	}
+
+	// a restored log is a regular log
+	off, err := restored.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+	require.NoError(t, restored.Close())
+
+	// restoring over an existing log fails
+	_, err = Restore(restoreDir, bytes.NewReader(snapshot.Bytes()))
+	require.Error(t, err)
+
+	// a corrupt snapshot fails its checksum and leaves nothing behind
+	corruptDir, err := ioutil.TempDir("", "snapshot-test-corrupt")
+	require.NoError(t, err)
+	defer os.RemoveAll(corruptDir)
+	corrupt := append([]byte{}, snapshot.Bytes()...)
+	corrupt[len(corrupt)-10] ^= 0xff
+	_, err = Restore(corruptDir, bytes.NewReader(corrupt))
+	require.True(t, errors.Is(err, ErrBadSnapshot), err)
+	files, err := ioutil.ReadDir(corruptDir)
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+}
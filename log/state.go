@@ -0,0 +1,107 @@
+package log
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// stateFile is where the log snapshots the state it keeps about its records:
+// its producers and transactions. The snapshot saves reading every record to
+// rebuild the state when the log is opened.
+const stateFile = "state.json"
+
+type stateSnapshot struct {
+	// NextOffset was the log's next offset when the snapshot was taken.
+	// The snapshot covers the records before it; the state of later ones
+	// is rebuilt from the records themselves.
+	NextOffset   uint64                      `json:"next_offset"`
+	Producers    map[string]producerState    `json:"producers"`
+	Transactions map[string]transactionState `json:"transactions"`
+	Aborted      map[string]uint64           `json:"aborted"`
+}
+
+// setupState rebuilds the producers and transactions from the snapshot and
+// the records appended after it, or from every local record if the snapshot
+// is missing or doesn't match the log, e.g. after a crash lost its tail.
+// Records offloaded to tiered storage aren't read, so a retry is only
+// recognized, and an aborted transaction only hidden, while the records are
+// on local disk.
+func (l *Log) setupState() {
+	l.producers = make(map[string]producerState)
+	l.transactions = make(map[string]*transactionState)
+	l.aborted = make(map[string]uint64)
+	from, next := l.segments[0].baseOffset, l.activeSegment.nextOffset
+	if snap, err := l.readStateSnapshot(); err == nil &&
+		from <= snap.NextOffset && snap.NextOffset <= next {
+		from = snap.NextOffset
+		for id, p := range snap.Producers {
+			if p.LastAppend.IsZero() {
+				// snapshotted before the log kept the time
+				p.LastAppend = time.Now()
+			}
+			l.producers[id] = p
+		}
+		for id, t := range snap.Transactions {
+			t := t
+			l.transactions[id] = &t
+		}
+		for id, off := range snap.Aborted {
+			l.aborted[id] = off
+		}
+	}
+	// the transactions' timeouts start over now, since we can't tell how
+	// long the log was closed for
+	now := time.Now()
+	for _, t := range l.transactions {
+		t.lastActive = now
+	}
+	for off := from; off < next; off++ {
+		record, err := l.read(off)
+		if err != nil {
+			// after a crash the index can point past the end of the
+			// store, whose buffered tail was lost. Those records can't
+			// be read, so they can't be retried against either.
+			break
+		}
+		l.track(record, off, now)
+	}
+}
+
+// track updates the state for a record that was appended.
+func (l *Log) track(record *api.Record, off uint64, now time.Time) {
+	l.trackSequence(record, off, now)
+	l.trackTransaction(record, off, now)
+}
+
+func (l *Log) readStateSnapshot() (*stateSnapshot, error) {
+	b, err := readFile(l.Config.fs(), path.Join(l.Dir, stateFile))
+	if err != nil {
+		return nil, err
+	}
+	snap := &stateSnapshot{}
+	return snap, json.Unmarshal(b, snap)
+}
+
+// writeStateSnapshot snapshots the state, replacing the last snapshot
+// atomically. Idle producers are expired first, so only the live ones are
+// kept. The caller must hold the write lock.
+func (l *Log) writeStateSnapshot() error {
+	l.expireProducers(time.Now())
+	snap := stateSnapshot{
+		NextOffset:   l.activeSegment.nextOffset,
+		Producers:    l.producers,
+		Transactions: make(map[string]transactionState, len(l.transactions)),
+		Aborted:      l.aborted,
+	}
+	for id, t := range l.transactions {
+		snap.Transactions[id] = *t
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.Config.fs(), path.Join(l.Dir, stateFile), b)
+}
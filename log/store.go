@@ -1,10 +1,10 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
-	"os"
+	"io"
 	"sync"
+	"sync/atomic"
 )
 
 // enc defines the encoding that we persist record sizes and index entries in
@@ -13,35 +13,61 @@ var enc = binary.BigEndian // todo: find a better name
 // lenWidth defines the number of bytes used to store the records length
 const lenWidth = 8 // todo: find a better name
 
+// bufferSize is how many bytes the store buffers before writing them to its
+// file.
+const bufferSize = 4096
+
 // store is a simple wrapper around a file with two APIs to append and read
 // bytes to and from the file
 type store struct {
-	*os.File
+	File
+
+	// mu serializes the writers: Append, Sync, truncate, seal and Close,
+	// and flushTo. Readers don't take it, except through flushTo: a reader
+	// holding only the log's read lock can flush the buffer, so flushed and
+	// buf can change under other readers at any time, not only while the
+	// log's writer holds its write lock.
 	mu sync.Mutex
 
 	// buf is used to improve performance by reducing the number of system calls.
 	// We can make many small writes to the buffer and then write the entire
-	// buffer to the file in one system call.
-	buf *bufio.Writer // todo: consider renaming to "writeBuffer", longer but more descriptive
+	// buffer to the file in one system call. It holds the bytes after the
+	// first flushed; bufMu guards it, and readers of those bytes read them
+	// from buf rather than forcing a flush.
+	bufMu sync.RWMutex
+	buf   []byte
+
+	// flushed is how many bytes of the store are in its file. It's published
+	// after the bytes are, so a reader that loads it can read that far
+	// straight from the file.
+	flushed atomic.Uint64
 
-	// The size of the store
+	// The size of the store, including what's still buffered
 	size uint64
+
+	// mapping is the file mapped read-only once the store is sealed, and
+	// mmap its bytes. A sealed store is never written to again, so reads
+	// are served from mmap without locking or copying.
+	mapping Mapping
+	mmap    []byte
 }
 
 // newStore creates a store for the given file.
-func newStore(f *os.File) (*store, error) {
+func newStore(f File) (*store, error) {
 	// The file might have existing data if the service has restarted, so we
 	// need to get the file's current size.
-	info, err := os.Stat(f.Name())
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(info.Size())
-	return &store{
+	s := &store{
 		File: f,
 		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+		buf:  make([]byte, 0, bufferSize),
+	}
+	s.flushed.Store(size)
+	return s, nil
 }
 
 // Append persists the given bytes to the store.
@@ -56,68 +82,219 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	if writeErr := binary.Write(s.buf, enc, uint64(len(p))); writeErr != nil {
-		// I really dislike shadowing errors, so I won't. Also, if we're going
-		// to use named return values, I feel like we should use them with the
-		// naked return
-		n, pos, err = 0, 0, writeErr
-		return
+	s.bufMu.Lock()
+	s.buf = enc.AppendUint64(s.buf, uint64(len(p)))
+	s.buf = append(s.buf, p...)
+	full := len(s.buf) >= bufferSize
+	s.bufMu.Unlock()
+	n = uint64(len(p)) + lenWidth
+	s.size += n
+	if full {
+		// if the write fails the record stays in the store, for the caller
+		// to retry flushing or drop with truncate
+		if err = s.flush(); err != nil {
+			return 0, 0, err
+		}
 	}
+	return n, pos, nil
+}
 
-	w, writeErr := s.buf.Write(p)
-	if writeErr != nil {
-		n, pos, err = 0, 0, writeErr
-		return
+// flush writes the buffered bytes to the file. The caller must hold mu.
+func (s *store) flush() error {
+	if len(s.buf) == 0 {
+		return nil
 	}
-	w += lenWidth
-	n = uint64(w)
-	s.size += n
-	return
+	// only writers change buf, and the caller is the writer, so buf can be
+	// read without bufMu while it's written out
+	w, err := s.File.Write(s.buf)
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	s.flushed.Add(uint64(w))
+	s.buf = s.buf[:copy(s.buf, s.buf[w:])]
+	return err
 }
 
-func (s *store) Read(pos uint64) ([]byte, error) {
+// flushTo makes sure the file holds the store's first end bytes, flushing the
+// buffer if some of them are still in it. Unlike the other flushes it's
+// called by readers, ReadRaw's, which only hold the log's read lock; mu keeps
+// it from racing the store's writers, and bufMu its readers.
+func (s *store) flushTo(end uint64) error {
+	if s.flushed.Load() >= end {
+		return nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.flush()
+}
 
-	// flush the writer buffer in case we're about to read a record that the
-	// buffer hasn't flushed to disk yet.
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
+// Read returns the record at pos.
+//
+// The record read from a sealed store is backed by its mapping rather than
+// copied: it must not be modified, and is only valid until the store is
+// closed. Callers that keep it longer than they hold the log's lock must
+// copy it.
+func (s *store) Read(pos uint64) ([]byte, error) {
+	if s.mmap != nil {
+		return s.readMapped(pos)
 	}
 
 	// find out how many bytes we have to read to get the whole record
 	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	if _, err := s.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
 
 	// fetch and return the record
 	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	if _, err := s.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
-// ReadAt implements io.ReaderAt
+// readMapped returns the record at pos in the sealed store's mapping.
+func (s *store) readMapped(pos uint64) ([]byte, error) {
+	size := uint64(len(s.mmap))
+	if pos > size || size-pos < lenWidth {
+		return nil, io.EOF
+	}
+	start := pos + lenWidth
+	n := enc.Uint64(s.mmap[pos:start])
+	if n > size-start {
+		return nil, io.EOF
+	}
+	// cap the slice so appending to it can't write over the next record
+	return s.mmap[start : start+n : start+n], nil
+}
+
+// ReadAt implements io.ReaderAt. Bytes that are still buffered are read from
+// the buffer, so reading doesn't flush it.
 func (s *store) ReadAt(dst []byte, offset int64) (int, error) {
 	// book has "off" instead of "offset"... really?
 	// apparently this implements io.ReaderAt and they also use "off"...
 	// whyyyyyy? to save 3 characters?? It's documented but really, off...
+	if s.mmap != nil {
+		if offset < 0 || offset >= int64(len(s.mmap)) {
+			return 0, io.EOF
+		}
+		n := copy(dst, s.mmap[offset:])
+		if n < len(dst) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if offset < 0 {
+		return 0, io.EOF
+	}
+	end := uint64(offset) + uint64(len(dst))
+	if end <= s.flushed.Load() {
+		return s.File.ReadAt(dst, offset)
+	}
+	return s.readBuffered(dst, uint64(offset))
+}
+
+// readBuffered reads bytes some of which were buffered when ReadAt looked.
+// They may have been flushed since, even all of them: flushTo lets readers
+// flush, so that can happen between ReadAt's check and bufMu being taken.
+func (s *store) readBuffered(dst []byte, offset uint64) (int, error) {
+	// flushed can't move while bufMu is held, so the file and the buffer
+	// agree on where one ends and the other starts
+	s.bufMu.RLock()
+	defer s.bufMu.RUnlock()
+	flushed := s.flushed.Load()
+	var n int
+	if offset < flushed {
+		inFile := flushed - offset
+		if inFile > uint64(len(dst)) {
+			inFile = uint64(len(dst))
+		}
+		var err error
+		if n, err = s.File.ReadAt(dst[:inFile], int64(offset)); err != nil {
+			return n, err
+		}
+	}
+	if n < len(dst) {
+		if at := offset + uint64(n) - flushed; at < uint64(len(s.buf)) {
+			n += copy(dst[n:], s.buf[at:])
+		}
+	}
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Sync flushes the write buffer and commits the file to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// truncate cuts the store back to size bytes, dropping a partially written
+// record left at its end by a crash, or a record appended that couldn't be
+// indexed. Bytes that are only buffered are dropped without touching the
+// file.
+func (s *store) truncate(size uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	if flushed := s.flushed.Load(); size >= flushed {
+		s.buf = s.buf[:size-flushed]
+	} else {
+		// everything before size is in the file already
+		if err := s.File.Truncate(int64(size)); err != nil {
+			return err
+		}
+		s.buf = s.buf[:0]
+		s.flushed.Store(size)
 	}
-	return s.File.ReadAt(dst, offset)
+	s.size = size
+	return nil
+}
+
+// seal flushes the store and maps it read-only, for a segment that won't be
+// appended to any more. Reads are served from the mapping after that.
+func (s *store) seal(fsys FS) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mapping != nil {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if s.size == 0 {
+		// there's nothing to map
+		return nil
+	}
+	m, err := fsys.Map(s.File, false)
+	if err != nil {
+		return err
+	}
+	s.mapping, s.mmap = m, m.Bytes()
+	return nil
 }
 
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.mapping != nil {
+		s.mmap = nil
+		if err := s.mapping.Unmap(); err != nil {
+			return err
+		}
+	}
 	// persist any buffered data before closing the file.
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
 		return err
 	}
 	return s.File.Close()
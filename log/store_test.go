@@ -1,8 +1,11 @@
 package log
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -27,7 +30,9 @@ func TestStoreAppendRead(t *testing.T) {
 	testRead(t, s)
 	testReadAt(t, s)
 
-	// verify that our service will recover its state after a restart
+	// verify that our service will recover its state after a restart; reads
+	// don't flush the buffer, so flush it first
+	require.NoError(t, s.Sync())
 	s, err = newStore(f)
 	require.NoError(t, err)
 	testRead(t, s)
@@ -72,6 +77,114 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	// reading buffered records leaves them buffered
+	testRead(t, s)
+	testReadAt(t, s)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+
+	// a read can span what's flushed and what's buffered
+	require.NoError(t, s.flush())
+	_, _, err = s.Append(testRecord)
+	require.NoError(t, err)
+	b := make([]byte, 2*width)
+	n, err := s.ReadAt(b, int64(2*width))
+	require.NoError(t, err)
+	require.Equal(t, int(2*width), n)
+	require.Equal(t, testRecord, b[lenWidth:width])
+	require.Equal(t, testRecord, b[width+lenWidth:])
+	n, err = s.ReadAt(b, int64(3*width))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int(width), n)
+
+	// readers don't wait for the writer, which flushes as the buffer fills
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := uint64(0); pos < 100*width; pos += width {
+				read, err := s.Read(pos % (4 * width))
+				require.NoError(t, err)
+				require.Equal(t, testRecord, read)
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		_, _, err = s.Append(testRecord)
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	require.NoError(t, s.Close())
+}
+
+func TestStoreReadFlushedMeanwhile(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_flushed_meanwhile_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+
+	// ReadAt found the bytes buffered, but a reader's flushTo flushed them
+	// before the buffer could be read
+	require.NoError(t, s.flushTo(3*width))
+	b := make([]byte, lenWidth)
+	n, err := s.readBuffered(b, width)
+	require.NoError(t, err)
+	require.Equal(t, lenWidth, n)
+	require.Equal(t, uint64(len(testRecord)), enc.Uint64(b))
+
+	// and partly flushed ones
+	_, _, err = s.Append(testRecord)
+	require.NoError(t, err)
+	b = make([]byte, 2*width)
+	n, err = s.readBuffered(b, 2*width)
+	require.NoError(t, err)
+	require.Equal(t, int(2*width), n)
+	require.Equal(t, testRecord, b[lenWidth:width])
+	require.Equal(t, testRecord, b[width+lenWidth:])
+}
+
+func TestStoreSeal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.seal(OSFS))
+	require.NotNil(t, s.mmap)
+
+	// reads are served from the mapping
+	testRead(t, s)
+	testReadAt(t, s)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, len(read), cap(read), "appending can't reach the next record")
+	_, err = s.Read(3 * width)
+	require.Equal(t, io.EOF, err)
+	_, err = s.Read(3*width - 1)
+	require.Equal(t, io.EOF, err)
+	n, err := s.ReadAt(make([]byte, 2*width), int64(2*width))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int(width), n)
+	require.NoError(t, s.Close())
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -120,3 +233,24 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, info.Size(), nil
 }
+
+func BenchmarkStoreAppend(b *testing.B) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("value=%dB", size), func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store_append_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+			s, err := newStore(f)
+			require.NoError(b, err)
+			defer s.Close()
+			p := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.Append(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// remoteSegment is a closed segment whose files were offloaded to the tier's
+// object store.
+type remoteSegment struct {
+	baseOffset, nextOffset uint64
+
+	// cached is the segment fetched back into the cache directory, nil if it
+	// isn't cached. lastRead orders the cached segments for eviction.
+	cached   *segment
+	lastRead uint64
+}
+
+// objectName returns the name a segment's store or index file is kept under
+// in the object store, which is the same name the file has on disk.
+func objectName(baseOffset uint64, ext string) string {
+	return fmt.Sprintf("%d%s", baseOffset, ext)
+}
+
+func (l *Log) cacheDir() string {
+	if l.Config.Tier.CacheDir != "" {
+		return l.Config.Tier.CacheDir
+	}
+	return path.Join(l.Dir, "cache")
+}
+
+// setupRemote lists the segments held by the object store. A segment counts
+// as offloaded once its index is uploaded, which happens after its store is
+// uploaded. Segments that are also on local disk were offloaded but the log
+// stopped before deleting them, so we keep using the local copy.
+func (l *Log) setupRemote() error {
+	l.remote = nil
+	if l.Config.Tier.Store == nil {
+		return nil
+	}
+	// the cache only lives as long as the log is open
+	if err := l.Config.fs().RemoveAll(l.cacheDir()); err != nil {
+		return err
+	}
+	if err := l.Config.fs().MkdirAll(l.cacheDir(), 0755); err != nil {
+		return err
+	}
+	objects, err := l.Config.Tier.Store.List()
+	if err != nil {
+		return err
+	}
+	local := make(map[uint64]bool)
+	for _, s := range l.segments {
+		local[s.baseOffset] = true
+	}
+	for _, object := range objects {
+		if path.Ext(object.Name) != ".index" {
+			continue
+		}
+		baseOffset, err := strconv.ParseUint(strings.TrimSuffix(object.Name, ".index"), 10, 0)
+		if err != nil || local[baseOffset] {
+			continue
+		}
+		l.remote = append(l.remote, &remoteSegment{
+			baseOffset: baseOffset,
+			nextOffset: baseOffset + uint64(object.Size)/entWidth,
+		})
+	}
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].baseOffset < l.remote[j].baseOffset
+	})
+	return nil
+}
+
+// startOffloading starts the goroutine that offloads segments in the
+// background, and has it offload any the log kept from before it was opened.
+func (l *Log) startOffloading() {
+	if l.Config.Tier.Store == nil || l.Config.ReadOnly {
+		return
+	}
+	l.offloadReq = make(chan struct{}, 1)
+	l.offloadStop = make(chan struct{})
+	l.offloadDone = make(chan struct{})
+	go l.runOffloading()
+	l.requestOffload()
+}
+
+// requestOffload wakes the offloading goroutine, if there is one, without
+// waiting for it.
+func (l *Log) requestOffload() {
+	select {
+	case l.offloadReq <- struct{}{}:
+	default:
+	}
+}
+
+// stopOffloading stops the offloading goroutine, waiting for an upload in
+// progress to finish. The caller mustn't hold the write lock.
+func (l *Log) stopOffloading() {
+	if l.offloadStop == nil {
+		return
+	}
+	close(l.offloadStop)
+	<-l.offloadDone
+	l.offloadStop = nil
+}
+
+func (l *Log) runOffloading() {
+	defer close(l.offloadDone)
+	for {
+		select {
+		case <-l.offloadStop:
+			return
+		case <-l.offloadReq:
+		}
+		if err := l.offload(); err != nil {
+			l.metrics.offloadFailures.Inc()
+			if l.Config.Tier.OnError != nil {
+				l.Config.Tier.OnError(err)
+			}
+		}
+	}
+}
+
+// offload uploads the oldest closed segments to the object store until only
+// Tier.LocalSegments segments are left on local disk. A closed segment's
+// files don't change, so they're uploaded without the log's lock, and the
+// write lock is only taken to swap the segment for its remote copy. It holds
+// offloadMu, which keeps the segment from being truncated or rewritten
+// while it's uploaded.
+func (l *Log) offload() error {
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+	keep := l.Config.Tier.LocalSegments
+	if keep < 1 {
+		keep = 1 // the active segment always stays local
+	}
+	for {
+		select {
+		case <-l.offloadStop:
+			return nil
+		default:
+		}
+		l.mu.RLock()
+		var s *segment
+		if len(l.segments) > keep {
+			s = l.segments[0]
+		}
+		l.mu.RUnlock()
+		if s == nil {
+			return nil
+		}
+		if err := l.upload(s); err != nil {
+			return fmt.Errorf("offload segment %d: %w", s.baseOffset, err)
+		}
+		l.mu.Lock()
+		err := l.dropOffloaded(s)
+		l.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("offload segment %d: %w", s.baseOffset, err)
+		}
+	}
+}
+
+// dropOffloaded replaces the uploaded segment, the oldest local one, with
+// its remote copy and deletes its files. The caller must hold the write
+// lock.
+func (l *Log) dropOffloaded(s *segment) error {
+	l.segments = l.segments[1:]
+	l.remote = append(l.remote, &remoteSegment{
+		baseOffset: s.baseOffset,
+		nextOffset: s.nextOffset,
+	})
+	// the local files go once the manifest no longer lists them, and lists
+	// them as being removed, so that a crash in between leaves files known
+	// to be leftovers
+	l.removing = append(l.removing, s.baseOffset)
+	if err := l.writeManifest(l.segments); err != nil {
+		return err
+	}
+	if err := s.Remove(); err != nil {
+		return err
+	}
+	l.removing = nil
+	return nil
+}
+
+// upload copies the sealed segment's files to the object store. Sealing
+// trimmed the index file to its entries, so it's uploaded as it is.
+func (l *Log) upload(s *segment) error {
+	// upload the index last, it's what marks the segment as offloaded
+	for _, name := range []string{s.store.Name(), s.index.Name()} {
+		if err := putFile(l.Config.fs(), l.Config.Tier.Store, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putFile(fsys FS, store ObjectStore, name string) error {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return store.Put(path.Base(name), f, info.Size())
+}
+
+// readRemote reads the record at the given offset from an offloaded segment,
+// fetching the segment into the cache first if needed. The caller must hold
+// at least the read lock.
+func (l *Log) readRemote(rs *remoteSegment, off uint64) (*api.Record, error) {
+	l.cacheMu.Lock()
+	defer l.cacheMu.Unlock()
+	if rs.cached == nil {
+		if err := l.fetch(rs); err != nil {
+			return nil, fmt.Errorf("fetch segment %d: %w", rs.baseOffset, err)
+		}
+	}
+	l.cacheTick++
+	rs.lastRead = l.cacheTick
+	if err := l.evict(rs); err != nil {
+		return nil, err
+	}
+	return rs.cached.Read(off)
+}
+
+// fetch downloads an offloaded segment into the cache directory and opens
+// it. The caller must hold cacheMu.
+func (l *Log) fetch(rs *remoteSegment) error {
+	for _, ext := range []string{".store", ".index"} {
+		if err := getFile(l.Config.fs(), l.Config.Tier.Store, l.cacheDir(), objectName(rs.baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	s, err := newSegment(l.cacheDir(), rs.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	rs.cached = s
+	return nil
+}
+
+func getFile(fsys FS, store ObjectStore, dir, name string) error {
+	r, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := fsys.OpenFile(path.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// evict removes the least recently read segments from the cache until at
+// most Tier.CacheSegments are cached, never evicting keep. The caller must
+// hold cacheMu.
+func (l *Log) evict(keep *remoteSegment) error {
+	max := l.Config.Tier.CacheSegments
+	if max < 1 {
+		max = 1
+	}
+	var cached []*remoteSegment
+	for _, rs := range l.remote {
+		if rs.cached != nil && rs != keep {
+			cached = append(cached, rs)
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].lastRead < cached[j].lastRead
+	})
+	for i := 0; i < len(cached)+1-max; i++ {
+		if err := cached[i].uncache(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uncache closes the cached copy of the segment and deletes its files.
+func (rs *remoteSegment) uncache() error {
+	if rs.cached == nil {
+		return nil
+	}
+	err := rs.cached.Remove()
+	rs.cached = nil
+	return err
+}
+
+// removeRemote deletes an offloaded segment from the object store. The index
+// goes first so a partial delete never looks like a segment to setupRemote.
+func (l *Log) removeRemote(rs *remoteSegment) error {
+	l.cacheMu.Lock()
+	err := rs.uncache()
+	l.cacheMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, ext := range []string{".index", ".store"} {
+		if err = l.Config.Tier.Store.Delete(objectName(rs.baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteReader lazily opens an object when it's first read, so Reader doesn't
+// download every offloaded segment up front.
+type remoteReader struct {
+	store ObjectStore
+	name  string
+	rc    io.ReadCloser
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if r.rc == nil {
+		rc, err := r.store.Get(r.name)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+	n, err := r.rc.Read(p)
+	if err == io.EOF {
+		_ = r.rc.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,178 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestTieredStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remoteDir, err := ioutil.TempDir("", "tier-test-remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remoteDir)
+
+	store, err := NewDirObjectStore(remoteDir)
+	require.NoError(t, err)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tier.Store = store
+	c.Tier.LocalSegments = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// 10 records make 5 full segments and an empty active one, of which the
+	// oldest 4 are offloaded in the background
+	for i := uint64(0); i < 10; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	waitOffloaded(t, log, 4)
+	require.Len(t, log.segments, 2)
+	objects, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, objects, 8)
+	_, err = os.Stat(path.Join(dir, objectName(0, ".store")))
+	require.True(t, os.IsNotExist(err))
+
+	// offloaded segments are fetched on demand
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	for i := uint64(0); i < 10; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+	cached := 0
+	for _, rs := range log.remote {
+		if rs.cached != nil {
+			cached++
+		}
+	}
+	require.Equal(t, 1, cached)
+
+	// the reader includes the offloaded segments
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.True(t, len(b) > 0)
+	require.NoError(t, log.Close())
+
+	// offloaded segments are found again when the log is reopened
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.remote, 4)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), read.Offset)
+
+	// truncating deletes offloaded segments from the object store
+	require.NoError(t, log.Truncate(3))
+	require.Len(t, log.remote, 2)
+	objects, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, objects, 4)
+	_, err = log.Read(1)
+	require.Error(t, err)
+
+	require.NoError(t, log.Remove())
+	objects, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, objects, 0)
+}
+
+func TestOffloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remoteDir, err := ioutil.TempDir("", "tier-test-remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remoteDir)
+
+	store := &failingStore{ObjectStore: &DirObjectStore{Dir: remoteDir}, fail: true}
+	errs := make(chan error, 10)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tier.Store = store
+	c.Tier.LocalSegments = 1
+	c.Tier.OnError = func(err error) { errs <- err }
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// appends that roll segments succeed while the object store is down,
+	// and the segments stay local
+	for i := uint64(0); i < 4; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.ErrorIs(t, <-errs, errStoreDown)
+	log.mu.RLock()
+	require.Len(t, log.segments, 3)
+	require.Empty(t, log.remote)
+	log.mu.RUnlock()
+
+	// once it's back, the next roll offloads them all
+	store.setFail(false)
+	for i := uint64(4); i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	waitOffloaded(t, log, 3)
+	for i := uint64(0); i < 6; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+}
+
+// waitOffloaded waits for the log to have n segments offloaded.
+func waitOffloaded(t *testing.T, log *Log, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.remote) == n
+	}, 5*time.Second, time.Millisecond)
+}
+
+var errStoreDown = errors.New("store down")
+
+// failingStore is an ObjectStore whose Puts fail while fail is set.
+type failingStore struct {
+	ObjectStore
+	mu   sync.Mutex
+	fail bool
+}
+
+func (s *failingStore) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *failingStore) Put(name string, r io.Reader, size int64) error {
+	s.mu.Lock()
+	fail := s.fail
+	s.mu.Unlock()
+	if fail {
+		return errStoreDown
+	}
+	return s.ObjectStore.Put(name, r, size)
+}
@@ -0,0 +1,235 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+// Transactions group records so that consumers reading with ReadCommitted see
+// all of them or none of them. A transaction's records are appended to the
+// log as they're produced, interleaved with other records, and it ends with a
+// control record: a commit marker that makes them visible, or an abort
+// marker that hides them for good. Read still returns every record,
+// including the markers.
+
+// errControlRecord is returned when appending a control record. They're only
+// written by CommitTransaction and AbortTransaction.
+var errControlRecord = errors.New("control records can't be appended")
+
+// transactionState is what the log remembers about an open transaction: the
+// offset of its first record, if it has any, and when it was last used.
+type transactionState struct {
+	First      uint64 `json:"first"`
+	HasRecords bool   `json:"has_records"`
+	lastActive time.Time
+}
+
+// BeginTransaction opens a transaction and returns its ID. Records are added
+// to it by appending them with the ID as their TransactionId, and it's ended
+// with CommitTransaction or AbortTransaction. A transaction is aborted if
+// nothing is appended to it for Config.Transaction.Timeout.
+func (l *Log) BeginTransaction() (string, error) {
+	if l.Config.ReadOnly {
+		return "", ErrReadOnly
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.expireTransactions(context.Background(), now); err != nil {
+		return "", err
+	}
+	l.transactions[id] = &transactionState{lastActive: now}
+	return id, nil
+}
+
+// CommitTransaction ends the transaction by appending a commit marker, which
+// makes its records visible to ReadCommitted. It returns the marker's offset.
+func (l *Log) CommitTransaction(id string) (uint64, error) {
+	return l.endTransaction(id, api.Control_CONTROL_COMMIT)
+}
+
+// AbortTransaction ends the transaction by appending an abort marker, which
+// hides its records from ReadCommitted. It returns the marker's offset.
+func (l *Log) AbortTransaction(id string) (uint64, error) {
+	return l.endTransaction(id, api.Control_CONTROL_ABORT)
+}
+
+func (l *Log) endTransaction(id string, control api.Control) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.expireTransactions(context.Background(), now); err != nil {
+		return 0, err
+	}
+	if _, ok := l.transactions[id]; !ok {
+		return 0, api.ErrTransactionNotFound{ID: id}
+	}
+	off, err := l.append(context.Background(), &api.Record{TransactionId: id, Control: control}, now)
+	if err != nil {
+		return 0, err
+	}
+	outcome := "commit"
+	if control == api.Control_CONTROL_ABORT {
+		outcome = "abort"
+	}
+	l.metrics.transactions.With(outcome).Inc()
+	return off, nil
+}
+
+// ReadCommitted returns the first record at or after off that's visible to a
+// read-committed consumer, skipping control records and the records of
+// aborted transactions. It stops at the first record of the oldest open
+// transaction, since whether that record and those after it are visible
+// isn't known yet, returning ErrOffsetOutOfRange with off if it gets there
+// without finding a record. The record's Offset says where it was found.
+func (l *Log) ReadCommitted(off uint64) (*api.Record, error) {
+	start := time.Now()
+	defer func() {
+		l.metrics.readDuration.Observe(time.Since(start).Seconds())
+	}()
+	l.mu.RLock()
+	if !l.Config.ReadOnly && l.hasExpired(start) {
+		// expiring transactions appends to the log, which a read-only log
+		// leaves to its writer
+		l.mu.RUnlock()
+		l.mu.Lock()
+		err := l.expireTransactions(context.Background(), start)
+		l.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		l.mu.RLock()
+	}
+	defer l.mu.RUnlock()
+	stable := l.lastStableOffset()
+	for next := off; next < stable; next++ {
+		record, err := l.read(next)
+		if err != nil {
+			return nil, err
+		}
+		if record.Control != api.Control_CONTROL_NONE {
+			continue
+		}
+		if _, ok := l.aborted[record.TransactionId]; ok && record.TransactionId != "" {
+			continue
+		}
+		return record, nil
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// lastStableOffset returns the offset of the first record of the oldest open
+// transaction, or the next offset if no open transaction has records. The
+// caller must hold at least the read lock.
+func (l *Log) lastStableOffset() uint64 {
+	stable := l.activeSegment.nextOffset
+	for _, t := range l.transactions {
+		if t.HasRecords && t.First < stable {
+			stable = t.First
+		}
+	}
+	return stable
+}
+
+// checkTransaction checks the record can be appended to its transaction, if
+// it has one. The caller must hold the write lock.
+func (l *Log) checkTransaction(record *api.Record) error {
+	if record.Control != api.Control_CONTROL_NONE {
+		return errControlRecord
+	}
+	if record.TransactionId == "" {
+		return nil
+	}
+	if _, ok := l.transactions[record.TransactionId]; !ok {
+		return api.ErrTransactionNotFound{ID: record.TransactionId}
+	}
+	return nil
+}
+
+// trackTransaction updates the record's transaction, if it has one, for a
+// record that was appended at off.
+func (l *Log) trackTransaction(record *api.Record, off uint64, now time.Time) {
+	id := record.TransactionId
+	if id == "" {
+		return
+	}
+	switch record.Control {
+	case api.Control_CONTROL_COMMIT:
+		delete(l.transactions, id)
+	case api.Control_CONTROL_ABORT:
+		delete(l.transactions, id)
+		l.aborted[id] = off
+	default:
+		t, ok := l.transactions[id]
+		if !ok {
+			// replaying the records of a transaction begun after the
+			// last snapshot
+			t = &transactionState{}
+			l.transactions[id] = t
+		}
+		if !t.HasRecords {
+			t.First, t.HasRecords = off, true
+		}
+		t.lastActive = now
+	}
+}
+
+// hasExpired reports whether any transaction has timed out. The caller must
+// hold at least the read lock.
+func (l *Log) hasExpired(now time.Time) bool {
+	for _, t := range l.transactions {
+		if now.Sub(t.lastActive) > l.Config.Transaction.Timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// expireTransactions aborts the transactions that have timed out. Those with
+// records get an abort marker; those without are just forgotten. The caller
+// must hold the write lock.
+func (l *Log) expireTransactions(ctx context.Context, now time.Time) error {
+	for id, t := range l.transactions {
+		if now.Sub(t.lastActive) <= l.Config.Transaction.Timeout {
+			continue
+		}
+		if t.HasRecords {
+			if _, err := l.append(ctx, &api.Record{TransactionId: id, Control: api.Control_CONTROL_ABORT}, now); err != nil {
+				return err
+			}
+		} else {
+			delete(l.transactions, id)
+		}
+		l.metrics.transactions.With("timeout").Inc()
+	}
+	return nil
+}
+
+// pruneAborted forgets the aborted transactions whose abort markers have been
+// truncated, along with their records. The caller must hold the write lock.
+func (l *Log) pruneAborted() {
+	lowest := l.activeSegment.baseOffset
+	if len(l.remote) > 0 {
+		lowest = l.remote[0].baseOffset
+	} else if len(l.segments) > 0 {
+		lowest = l.segments[0].baseOffset
+	}
+	for id, off := range l.aborted {
+		if off < lowest {
+			delete(l.aborted, id)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+)
+
+func TestTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	appendTo := func(l *Log, txn, value string) uint64 {
+		off, err := l.Append(&api.Record{Value: []byte(value), TransactionId: txn})
+		require.NoError(t, err)
+		return off
+	}
+	// readAll returns the values visible to a read-committed consumer
+	readAll := func(l *Log) []string {
+		var values []string
+		for off := uint64(0); ; {
+			record, err := l.ReadCommitted(off)
+			if err != nil {
+				require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+				return values
+			}
+			values = append(values, string(record.Value))
+			off = record.Offset + 1
+		}
+	}
+
+	committed, err := log.BeginTransaction()
+	require.NoError(t, err)
+	aborted, err := log.BeginTransaction()
+	require.NoError(t, err)
+	appendTo(log, committed, "c1")
+	appendTo(log, "", "plain")
+	appendTo(log, aborted, "a1")
+	appendTo(log, committed, "c2")
+
+	// nothing after the first record of an open transaction is visible
+	require.Empty(t, readAll(log))
+	off, err := log.CommitTransaction(committed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.Equal(t, []string{"c1", "plain"}, readAll(log))
+	_, err = log.AbortTransaction(aborted)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c1", "plain", "c2"}, readAll(log))
+
+	// the markers are in the log for plain reads
+	marker, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, api.Control_CONTROL_COMMIT, marker.Control)
+	require.Equal(t, committed, marker.TransactionId)
+
+	// ended transactions can't be used, and control records can't be
+	// appended directly
+	_, err = log.Append(&api.Record{Value: []byte("late"), TransactionId: committed})
+	require.Equal(t, api.ErrTransactionNotFound{ID: committed}, err)
+	_, err = log.CommitTransaction(aborted)
+	require.Equal(t, api.ErrTransactionNotFound{ID: aborted}, err)
+	_, err = log.Append(&api.Record{Control: api.Control_CONTROL_COMMIT})
+	require.Error(t, err)
+
+	// open and aborted transactions survive reopening the log
+	open, err := log.BeginTransaction()
+	require.NoError(t, err)
+	appendTo(log, open, "o1")
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"c1", "plain", "c2"}, readAll(log))
+	appendTo(log, open, "o2")
+	_, err = log.CommitTransaction(open)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c1", "plain", "c2", "o1", "o2"}, readAll(log))
+	require.NoError(t, log.Close())
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Transaction.Timeout = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	txn, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello"), TransactionId: txn})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("world")})
+	require.NoError(t, err)
+	_, err = log.ReadCommitted(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	// reading after the timeout aborts the transaction, unblocking the
+	// records after it
+	time.Sleep(20 * time.Millisecond)
+	record, err := log.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(record.Value))
+	marker, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, api.Control_CONTROL_ABORT, marker.Control)
+	_, err = log.CommitTransaction(txn)
+	require.Equal(t, api.ErrTransactionNotFound{ID: txn}, err)
+}
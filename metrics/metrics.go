@@ -0,0 +1,417 @@
+// Package metrics keeps counters, gauges and histograms and writes them out
+// in the Prometheus text exposition format, so Prometheus can scrape them.
+//
+// It covers the small part of the Prometheus client library we need without
+// pulling in its dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, in seconds. They suit
+// latencies from a few milliseconds to a few seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// LatencyBuckets suit latencies from microseconds, e.g. a buffered append,
+// up to a second.
+var LatencyBuckets = []float64{
+	.00001, .000025, .00005, .0001, .00025, .0005,
+	.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1,
+}
+
+// Registry holds metrics and writes them out.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// metric is a named family of samples.
+type metric interface {
+	help() string
+	kind() string
+	write(w io.Writer, name string)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds a metric, panicking if the name is invalid or already taken
+// since that's a programming error.
+func (r *Registry) register(name string, m metric) {
+	if !validName(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %q is already registered", name))
+	}
+	r.metrics[name] = m
+}
+
+// WriteTo writes every metric in the Prometheus text format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for i, name := range names {
+		m := metrics[i]
+		fmt.Fprintf(cw, "# HELP %s %s\n", name, escapeHelp(m.help()))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", name, m.kind())
+		m.write(cw, name)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// Handler serves the registry's metrics for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// Counter is a value that only goes up, like the number of appends.
+type Counter struct {
+	bits uint64
+}
+
+// NewCounter registers a counter. Counter names should end in "_total".
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, &family{helpText: help, kindName: "counter", single: c})
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counters can't decrease")
+	}
+	addFloat(&c.bits, v)
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (c *Counter) writeSamples(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, c.Value())
+}
+
+// Gauge is a value that goes up and down, like the number of segments.
+type Gauge struct {
+	bits uint64
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, &family{helpText: help, kindName: "gauge", single: g})
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) writeSamples(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, g.Value())
+}
+
+// gaugeFunc is a gauge whose value is computed when the metrics are written.
+type gaugeFunc func() float64
+
+// NewGaugeFunc registers a gauge whose value is returned by fn each time the
+// metrics are written. fn may be called concurrently.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &family{helpText: help, kindName: "gauge", single: gaugeFunc(fn)})
+}
+
+func (g gaugeFunc) writeSamples(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, g())
+}
+
+// Histogram counts observations, like request latencies, in buckets.
+type Histogram struct {
+	// upperBounds are the buckets' inclusive upper bounds, in increasing
+	// order. counts has one more element, for +Inf.
+	upperBounds []float64
+	counts      []uint64
+	count       uint64
+	sumBits     uint64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, &family{helpText: help, kindName: "histogram", single: h})
+	return h
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+	return &Histogram{
+		upperBounds: buckets,
+		counts:      make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	addFloat(&h.sumBits, v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) writeSamples(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range h.upperBounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, name+"_bucket", joinLabels(labels, `le="`+formatFloat(bound)+`"`), float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+	writeSample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(cumulative))
+	writeSample(w, name+"_sum", labels, math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	writeSample(w, name+"_count", labels, float64(cumulative))
+}
+
+// CounterVec is a family of counters told apart by their label values, e.g.
+// requests by handler and status code.
+type CounterVec struct {
+	*vec
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := newVec(labelNames, func() sampler { return &Counter{} })
+	r.register(name, &family{helpText: help, kindName: "counter", vec: v})
+	return &CounterVec{v}
+}
+
+// With returns the counter for the given label values, which must be given
+// in the order of the vector's label names.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.get(labelValues).(*Counter)
+}
+
+// HistogramVec is a family of histograms told apart by their label values.
+type HistogramVec struct {
+	*vec
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	v := newVec(labelNames, func() sampler { return newHistogram(buckets) })
+	r.register(name, &family{helpText: help, kindName: "histogram", vec: v})
+	return &HistogramVec{v}
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.get(labelValues).(*Histogram)
+}
+
+// sampler is anything that writes samples of a metric: a counter, gauge or
+// histogram.
+type sampler interface {
+	writeSamples(w io.Writer, name, labels string)
+}
+
+// family is a registered metric, either a single sampler or a vector of
+// them.
+type family struct {
+	helpText string
+	kindName string
+	single   sampler
+	vec      *vec
+}
+
+func (f *family) help() string { return f.helpText }
+func (f *family) kind() string { return f.kindName }
+
+func (f *family) write(w io.Writer, name string) {
+	if f.single != nil {
+		f.single.writeSamples(w, name, "")
+		return
+	}
+	f.vec.write(w, name)
+}
+
+type vec struct {
+	labelNames []string
+	newSampler func() sampler
+
+	mu       sync.Mutex
+	samplers map[string]sampler
+}
+
+func newVec(labelNames []string, newSampler func() sampler) *vec {
+	for _, name := range labelNames {
+		if !validName(name) || name == "le" {
+			panic(fmt.Sprintf("metrics: invalid label name %q", name))
+		}
+	}
+	return &vec{
+		labelNames: labelNames,
+		newSampler: newSampler,
+		samplers:   make(map[string]sampler),
+	}
+}
+
+func (v *vec) get(labelValues []string) sampler {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels",
+			len(labelValues), len(v.labelNames)))
+	}
+	pairs := make([]string, len(labelValues))
+	for i, value := range labelValues {
+		pairs[i] = v.labelNames[i] + `="` + escapeLabelValue(value) + `"`
+	}
+	key := strings.Join(pairs, ",")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.samplers[key]
+	if !ok {
+		s = v.newSampler()
+		v.samplers[key] = s
+	}
+	return s
+}
+
+func (v *vec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.samplers))
+	for key := range v.samplers {
+		keys = append(keys, key)
+	}
+	samplers := make([]sampler, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		samplers[i] = v.samplers[key]
+	}
+	v.mu.Unlock()
+	for i, s := range samplers {
+		s.writeSamples(w, name, keys[i])
+	}
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(v))
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// addFloat atomically adds v to the float64 stored in bits.
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c == ':', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	appends := r.NewCounter("appends_total", "Records appended.")
+	segments := r.NewGauge("segments", "Segments on disk.")
+	r.NewGaugeFunc("fill_ratio", "How full the active segment is.", func() float64 { return 0.25 })
+	latency := r.NewHistogram("read_seconds", "Read latency.", []float64{0.1, 1})
+	requests := r.NewCounterVec("requests_total", "HTTP requests.", "method", "code")
+
+	appends.Inc()
+	appends.Add(2)
+	segments.Set(3)
+	segments.Add(-1)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+	requests.With("GET", "200").Inc()
+	requests.With("POST", "500").Add(2)
+	requests.With("GET", "200").Inc()
+	r.NewCounterVec("escaped_total", "Help with a \\ and a\nnewline.", "path").With(`a "quoted"` + "\n" + `\path`).Inc()
+
+	var b bytes.Buffer
+	_, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, `# HELP appends_total Records appended.
+# TYPE appends_total counter
+appends_total 3
+# HELP escaped_total Help with a \\ and a\nnewline.
+# TYPE escaped_total counter
+escaped_total{path="a \"quoted\"\n\\path"} 1
+# HELP fill_ratio How full the active segment is.
+# TYPE fill_ratio gauge
+fill_ratio 0.25
+# HELP read_seconds Read latency.
+# TYPE read_seconds histogram
+read_seconds_bucket{le="0.1"} 1
+read_seconds_bucket{le="1"} 2
+read_seconds_bucket{le="+Inf"} 3
+read_seconds_sum 5.55
+read_seconds_count 3
+# HELP requests_total HTTP requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 2
+requests_total{method="POST",code="500"} 2
+# HELP segments Segments on disk.
+# TYPE segments gauge
+segments 2
+`, b.String())
+
+	require.Equal(t, uint64(3), latency.Count())
+	require.Panics(t, func() { r.NewCounter("appends_total", "again") })
+	require.Panics(t, func() { r.NewCounter("not-valid", "") })
+	require.Panics(t, func() { appends.Add(-1) })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("appends_total", "Records appended.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	b, err := ioutil.ReadAll(w.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "appends_total 1\n")
+}
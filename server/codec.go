@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// defaultRawBytes and maxRawBytes are the default and the largest max_bytes
+// of a raw consume.
+const (
+	defaultRawBytes = 1 << 20
+	maxRawBytes     = 64 << 20
+)
+
+// maxBodyBytes caps the size of a request body.
+const maxBodyBytes = 32 << 20
+
+var (
+	jsonMarshal   = protojson.MarshalOptions{EmitUnpopulated: true}
+	jsonUnmarshal = protojson.UnmarshalOptions{}
+)
+
+// errUnsupportedMediaType is returned by readMessage for a body that isn't
+// JSON or protobuf.
+type errUnsupportedMediaType struct {
+	contentType string
+}
+
+func (e errUnsupportedMediaType) Error() string {
+	return fmt.Sprintf("unsupported Content-Type %q, use %s or %s",
+		e.contentType, api.ContentTypeJSON, api.ContentTypeProtobuf)
+}
+
+// requestType returns the media type of the request's body. Bodies without a
+// Content-Type are taken to be JSON.
+func requestType(r *http.Request) (string, error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return api.ContentTypeJSON, nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil || (mt != api.ContentTypeJSON && mt != api.ContentTypeProtobuf) {
+		return "", errUnsupportedMediaType{ct}
+	}
+	return mt, nil
+}
+
+// readMessage decodes the request's body into m according to its
+// Content-Type.
+func readMessage(r *http.Request, m proto.Message) error {
+	mt, err := requestType(r)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxBodyBytes {
+		return fmt.Errorf("body is larger than %d bytes", maxBodyBytes)
+	}
+	if mt == api.ContentTypeProtobuf {
+		return proto.Unmarshal(b, m)
+	}
+	return jsonUnmarshal.Unmarshal(b, m)
+}
+
+// writeDecodeError writes the response for an error from readMessage.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.As(err, &errUnsupportedMediaType{}) {
+		writeError(w, r, http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, err.Error())
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, api.CodeBadRequest, err.Error())
+}
+
+// responseType picks the media type of the response from the request's Accept
+// header. When both are equally acceptable, as they are without an Accept
+// header, the response is in the same format as the request's body. It
+// returns "" if the client accepts neither.
+func responseType(r *http.Request) string {
+	candidates := []string{api.ContentTypeJSON, api.ContentTypeProtobuf}
+	if mt, err := requestType(r); err == nil && mt == api.ContentTypeProtobuf {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return candidates[0]
+	}
+	type mediaRange struct {
+		typ string
+		q   float64
+	}
+	var ranges []mediaRange
+	for _, header := range accept {
+		for _, part := range strings.Split(header, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			ranges = append(ranges, mediaRange{mt, q})
+		}
+	}
+	// the most specific range matching a type decides its quality
+	quality := func(typ string) float64 {
+		best, specificity := 0.0, -1
+		for _, mr := range ranges {
+			var s int
+			switch {
+			case mr.typ == typ:
+				s = 2
+			case mr.typ == "application/*":
+				s = 1
+			case mr.typ == "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				best, specificity = mr.q, s
+			}
+		}
+		return best
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return quality(candidates[i]) > quality(candidates[j])
+	})
+	if quality(candidates[0]) <= 0 {
+		return ""
+	}
+	return candidates[0]
+}
+
+// acceptable wraps a handler to answer 406 without calling it if the client
+// accepts neither JSON nor protobuf, so a record isn't appended only for the
+// response to be refused.
+func acceptable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if responseType(r) == "" {
+			// writeError sees the Accept header too, and explains what we can send
+			writeError(w, r, http.StatusNotAcceptable, api.CodeNotAcceptable, "")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeMessage writes m as a 200 response in the format the client accepts.
+func writeMessage(w http.ResponseWriter, r *http.Request, m proto.Message) {
+	writeMessageStatus(w, r, http.StatusOK, m)
+}
+
+func writeMessageStatus(w http.ResponseWriter, r *http.Request, status int, m proto.Message) {
+	w.Header().Add("Vary", "Accept")
+	mt := responseType(r)
+	if mt == "" {
+		// say what we can send, in the format most clients can read
+		status = http.StatusNotAcceptable
+		m = &api.ErrorResponse{
+			Code:    api.CodeNotAcceptable,
+			Message: fmt.Sprintf("responses are %s or %s", api.ContentTypeJSON, api.ContentTypeProtobuf),
+		}
+		mt = api.ContentTypeJSON
+	}
+	var b []byte
+	var err error
+	if mt == api.ContentTypeProtobuf {
+		b, err = proto.Marshal(m)
+	} else {
+		b, err = jsonMarshal.Marshal(m)
+		b = append(b, '\n')
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		mt = "text/plain; charset=utf-8"
+		b = []byte(err.Error() + "\n")
+	}
+	w.Header().Set("Content-Type", mt)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	// the status is already sent if this fails, so there's nothing we can
+	// do but drop the connection
+	_, _ = w.Write(b)
+}
+
+// writeRawRecords writes a 200 response of records read raw, laid out as
+// api.ContentTypeRawRecords describes.
+//
+// The records are copied straight from the store's file, so the kernel can
+// send them without them passing through the server.
+func writeRawRecords(w http.ResponseWriter, raw *log.RawRecords) error {
+	head := make([]byte, 8*(1+len(raw.Positions)))
+	binary.BigEndian.PutUint64(head, uint64(len(raw.Positions)))
+	for i, pos := range raw.Positions {
+		binary.BigEndian.PutUint64(head[8*(i+1):], pos)
+	}
+	w.Header().Set("Content-Type", api.ContentTypeRawRecords)
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(head))+raw.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := raw.WriteTo(w)
+	return err
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	runtimepprof "runtime/pprof"
+)
+
+// NewDiagnosticsServer returns a server for debugging a running process:
+//
+//	/debug/pprof/    CPU, heap, mutex and other profiles, for go tool pprof
+//	/debug/goroutines  a stack dump of every goroutine
+//	/debug/version   what the binary was built from
+//
+// Profiles can expose memory contents and slow the process down, so it's
+// meant to listen on a private address, separately from the log's server.
+func NewDiagnosticsServer(addr string) *http.Server {
+	r := http.NewServeMux()
+	r.HandleFunc("/debug/pprof/", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.HandleFunc("/debug/goroutines", handleGoroutines)
+	r.HandleFunc("/debug/version", handleVersion)
+	return &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+}
+
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// VersionResponse describes the running binary.
+type VersionResponse struct {
+	GoVersion string `json:"go_version"`
+	Path      string `json:"path,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	res := VersionResponse{GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		res.Path = info.Main.Path
+		res.Version = info.Main.Version
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				res.Revision = s.Value
+			case "vcs.time":
+				res.Time = s.Value
+			case "vcs.modified":
+				res.Modified = s.Value == "true"
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
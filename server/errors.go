@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// writeError writes an api.ErrorResponse in the format the client accepts.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorResponse(w, r, status, &api.ErrorResponse{Code: code, Message: message})
+}
+
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, res *api.ErrorResponse) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeMessageStatus(w, r, status, res)
+}
+
+// writeLogError writes the response for an error returned by the log.
+func writeLogError(w http.ResponseWriter, r *http.Request, err error) {
+	var gap api.ErrSequenceGap
+	switch {
+	case errors.As(err, &api.ErrOffsetOutOfRange{}):
+		writeError(w, r, http.StatusNotFound, api.CodeOffsetOutOfRange, err.Error())
+	case errors.As(err, &api.ErrSequenceOutOfOrder{}):
+		writeError(w, r, http.StatusConflict, api.CodeSequenceOutOfOrder, err.Error())
+	case errors.As(err, &gap):
+		// the producer needs the last sequence to number its next record
+		writeErrorResponse(w, r, http.StatusConflict, &api.ErrorResponse{
+			Code:         api.CodeSequenceGap,
+			Message:      err.Error(),
+			LastSequence: &gap.Last,
+		})
+	case errors.As(err, &api.ErrTransactionNotFound{}):
+		writeError(w, r, http.StatusNotFound, api.CodeTransactionNotFound, err.Error())
+	case errors.Is(err, log.ErrRawUnavailable):
+		writeError(w, r, http.StatusConflict, api.CodeRawUnavailable, err.Error())
+	case errors.Is(err, ErrRecovering):
+		writeError(w, r, http.StatusServiceUnavailable, api.CodeRecovering, err.Error())
+	default:
+		writeError(w, r, http.StatusInternalServerError, api.CodeInternal, err.Error())
+	}
+}
+
+// methods routes a request to the handler for its method, answering 405
+// with an Allow header for the others. HEAD requests go to the GET handler.
+type methods map[string]http.Handler
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, ok := m[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		h, ok = m[http.MethodGet]
+	}
+	if !ok {
+		w.Header().Set("Allow", m.allow())
+		writeError(w, r, http.StatusMethodNotAllowed, api.CodeMethodNotAllowed,
+			r.Method+" isn't allowed, use "+m.allow())
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (m methods) allow() string {
+	allowed := make([]string, 0, len(m)+1)
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	if _, ok := m[http.MethodGet]; ok {
+		if _, ok = m[http.MethodHead]; !ok {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	sort.Strings(allowed)
+	return strings.Join(allowed, ", ")
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// ErrRecovering is returned for requests made while the log is still being
+// opened.
+var ErrRecovering = errors.New("log is recovering")
+
+// PendingLog is a CommitLog that isn't open yet, so the server can answer
+// health checks while the log recovers its segments on startup. Requests
+// fail with ErrRecovering until Open is called.
+type PendingLog struct {
+	mu  sync.RWMutex
+	log CommitLog
+}
+
+// Open makes requests go to l from now on.
+func (p *PendingLog) Open(l CommitLog) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.log = l
+}
+
+// Recovering reports whether the log has yet to be opened.
+func (p *PendingLog) Recovering() bool {
+	return p.get() == nil
+}
+
+func (p *PendingLog) get() CommitLog {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.log
+}
+
+func (p *PendingLog) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	l := p.get()
+	if l == nil {
+		return 0, ErrRecovering
+	}
+	return l.AppendContext(ctx, record)
+}
+
+func (p *PendingLog) AppendBatch(ctx context.Context, records []*api.Record) ([]uint64, error) {
+	l := p.get()
+	if l == nil {
+		return nil, ErrRecovering
+	}
+	return l.AppendBatch(ctx, records)
+}
+
+func (p *PendingLog) Read(off uint64) (*api.Record, error) {
+	l := p.get()
+	if l == nil {
+		return nil, ErrRecovering
+	}
+	return l.Read(off)
+}
+
+func (p *PendingLog) ReadCommitted(off uint64) (*api.Record, error) {
+	l := p.get()
+	if l == nil {
+		return nil, ErrRecovering
+	}
+	return l.ReadCommitted(off)
+}
+
+func (p *PendingLog) BeginTransaction() (string, error) {
+	l := p.get()
+	if l == nil {
+		return "", ErrRecovering
+	}
+	return l.BeginTransaction()
+}
+
+func (p *PendingLog) CommitTransaction(id string) (uint64, error) {
+	l := p.get()
+	if l == nil {
+		return 0, ErrRecovering
+	}
+	return l.CommitTransaction(id)
+}
+
+func (p *PendingLog) AbortTransaction(id string) (uint64, error) {
+	l := p.get()
+	if l == nil {
+		return 0, ErrRecovering
+	}
+	return l.AbortTransaction(id)
+}
+
+func (p *PendingLog) LowestOffset() (uint64, error) {
+	l := p.get()
+	if l == nil {
+		return 0, ErrRecovering
+	}
+	return l.LowestOffset()
+}
+
+func (p *PendingLog) HighestOffset() (uint64, error) {
+	l := p.get()
+	if l == nil {
+		return 0, ErrRecovering
+	}
+	return l.HighestOffset()
+}
+
+func (p *PendingLog) ReadRaw(off, maxBytes uint64) (*log.RawRecords, error) {
+	l := p.get()
+	if l == nil {
+		return nil, ErrRecovering
+	}
+	return l.ReadRaw(off, maxBytes)
+}
+
+// readinessTimeout bounds how long /readyz waits for its checks.
+const readinessTimeout = 5 * time.Second
+
+// ReadyResponse is the body of a /readyz response. Checks maps each check's
+// name to "ok" or the reason it failed.
+type ReadyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleHealthz reports that the process is up and serving HTTP.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the server can take requests: the log is
+// open and has finished recovering, and the data dir, if configured, is
+// writable. It answers 503 if any check fails.
+func (s *httpServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	checks := map[string]func(context.Context) error{
+		"log": s.checkLog,
+	}
+	if s.dataDir != "" {
+		checks["disk"] = s.checkDisk
+	}
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := ReadyResponse{Status: "ready", Checks: make(map[string]string, len(checks))}
+	status := http.StatusOK
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			res.Checks[name] = err.Error()
+			res.Status = "not ready"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		res.Checks[name] = "ok"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// checkLog checks the log is open, and has finished recovering if it's a
+// PendingLog, by asking it for its offsets.
+func (s *httpServer) checkLog(ctx context.Context) error {
+	if s.Log == nil {
+		return errors.New("no log configured")
+	}
+	_, err := s.Log.HighestOffset()
+	return err
+}
+
+// checkDisk writes and syncs a file in the data dir, which fails if the disk
+// is full or has been remounted read-only.
+func (s *httpServer) checkDisk(ctx context.Context) error {
+	f, err := os.CreateTemp(s.dataDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write([]byte("ok")); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pending := &PendingLog{}
+	h := NewHTTPServer("", Config{CommitLog: pending, DataDir: dir}).Handler
+	readyz := func(t *testing.T, h http.Handler, status int, checks map[string]string) {
+		t.Helper()
+		w := serve(h, http.MethodGet, "/readyz", "")
+		require.Equal(t, status, w.Code, w.Body.String())
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		res := ReadyResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		want := ReadyResponse{Status: "ready", Checks: checks}
+		if status != http.StatusOK {
+			want.Status = "not ready"
+		}
+		require.Equal(t, want, res)
+	}
+
+	// the process is up while the log recovers, but not ready
+	w := serve(h, http.MethodGet, "/healthz", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "ok\n", w.Body.String())
+	readyz(t, h, http.StatusServiceUnavailable, map[string]string{
+		"log":  ErrRecovering.Error(),
+		"disk": "ok",
+	})
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	pending.Open(clog)
+	readyz(t, h, http.StatusOK, map[string]string{"log": "ok", "disk": "ok"})
+	// the disk check cleans up after itself
+	probes, err := filepath.Glob(path.Join(dir, ".readyz-*"))
+	require.NoError(t, err)
+	require.Empty(t, probes)
+
+	// a data dir that can't be written to fails the disk check, which is
+	// only made when there's a data dir
+	h = NewHTTPServer("", Config{CommitLog: clog, DataDir: path.Join(dir, "missing")}).Handler
+	w = serve(h, http.MethodGet, "/readyz", "")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	res := ReadyResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Equal(t, "ok", res.Checks["log"])
+	require.Contains(t, res.Checks["disk"], "no such file or directory")
+	h = NewHTTPServer("", Config{CommitLog: clog}).Handler
+	readyz(t, h, http.StatusOK, map[string]string{"log": "ok"})
+}
@@ -1,20 +1,98 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+	"github.com/MRSharff/distributed-services-with-go/metrics"
+	"github.com/MRSharff/distributed-services-with-go/trace"
 )
 
-// I'm going to not use gorilla mux for now
+// CommitLog is the log the server appends records to and reads them from.
+// It's satisfied by *log.Log.
+type CommitLog interface {
+	AppendContext(context.Context, *api.Record) (uint64, error)
+	AppendBatch(context.Context, []*api.Record) ([]uint64, error)
+	Read(uint64) (*api.Record, error)
+	ReadCommitted(uint64) (*api.Record, error)
+	BeginTransaction() (string, error)
+	CommitTransaction(id string) (uint64, error)
+	AbortTransaction(id string) (uint64, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	ReadRaw(off, maxBytes uint64) (*log.RawRecords, error)
+}
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
-	r := http.NewServeMux()
+type Config struct {
+	// CommitLog is the log records are appended to and read from. Use a
+	// PendingLog to start serving before the log has been opened.
+	CommitLog CommitLog
+	// DataDir, if set, is the directory holding the log, which /readyz
+	// checks is writable.
+	DataDir string
+	// Metrics is served on /metrics along with the server's own HTTP
+	// metrics, which are registered with it. The server uses a registry of
+	// its own if it's nil.
+	Metrics *metrics.Registry
+	// Logger is where requests are logged. Nothing is logged if it's nil.
+	Logger *slog.Logger
+	// Tracer records spans for produce and consume requests, continuing the
+	// trace in a request's traceparent header if it has one. Nothing is
+	// traced if it's nil.
+	Tracer *trace.Tracer
+}
 
-	// gorilla mux can use .Method("POST") and .Method("GET") but ours can't
-	// so lets just use a handle func that uses a switch on the method to defer to
-	// handleProduce and handleConsume
-	r.HandleFunc("/", httpsrv.handle)
+func NewHTTPServer(addr string, config Config) *http.Server {
+	if config.Metrics == nil {
+		config.Metrics = metrics.NewRegistry()
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	httpsrv := newHTTPServer(config)
+	m := newHTTPMetrics(config.Metrics)
+	logged := func(name string, h http.HandlerFunc) http.Handler {
+		return m.instrument(name, logRequests(config.Logger, acceptable(h)))
+	}
+	r := http.NewServeMux()
+	r.Handle("/records", methods{
+		http.MethodPost: logged("produce", httpsrv.handleProduce),
+	})
+	r.Handle("/records/batch", methods{
+		http.MethodPost: logged("produce_batch", httpsrv.handleProduceBatch),
+	})
+	r.Handle("/records/{offset}", methods{
+		http.MethodGet: logged("consume", httpsrv.handleConsume),
+	})
+	// raw responses aren't JSON or protobuf, so they skip acceptable
+	r.Handle("/records/{offset}/raw", methods{
+		http.MethodGet: m.instrument("consume_raw", logRequests(config.Logger, httpsrv.handleConsumeRaw)),
+	})
+	r.Handle("/transactions", methods{
+		http.MethodPost: logged("begin_transaction", httpsrv.handleBeginTransaction),
+	})
+	r.Handle("/transactions/{id}/commit", methods{
+		http.MethodPost: logged("commit_transaction", httpsrv.handleEndTransaction(true)),
+	})
+	r.Handle("/transactions/{id}/abort", methods{
+		http.MethodPost: logged("abort_transaction", httpsrv.handleEndTransaction(false)),
+	})
+	r.Handle("/offsets", methods{
+		http.MethodGet: logged("offsets", httpsrv.handleOffsets),
+	})
+	r.Handle("/metrics", methods{http.MethodGet: config.Metrics.Handler()})
+	r.Handle("/healthz", methods{http.MethodGet: http.HandlerFunc(handleHealthz)})
+	r.Handle("/readyz", methods{http.MethodGet: http.HandlerFunc(httpsrv.handleReadyz)})
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, api.CodeNotFound, "no such resource: "+r.URL.Path)
+	})
 	return &http.Server{
 		Addr:    addr,
 		Handler: r,
@@ -22,83 +100,248 @@ func NewHTTPServer(addr string) *http.Server {
 }
 
 type httpServer struct {
-	Log *Log
+	Log     CommitLog
+	dataDir string
+	tracer  *trace.Tracer
 }
 
-func newHTTPServer() *httpServer {
-	return &httpServer{Log: NewLog()}
+func newHTTPServer(config Config) *httpServer {
+	return &httpServer{
+		Log:     config.CommitLog,
+		dataDir: config.DataDir,
+		tracer:  config.Tracer,
+	}
 }
 
-type ProduceRequest struct {
-	Record Record `json:"record"`
-}
+// The request and response bodies are the api package's messages, sent as
+// protobuf or JSON depending on the request's Content-Type and Accept
+// headers. See codec.go.
 
-type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
-}
+// handleProduce appends the record in the body to the log: POST /records.
+func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.startSpan(r.Context(), "server.handleProduce")
+	defer span.End()
+	req := &api.ProduceRequest{}
+	if err := readMessage(r, req); err != nil {
+		span.RecordError(err)
+		writeDecodeError(w, r, err)
+		return
+	}
+	if req.Record == nil {
+		writeError(w, r, http.StatusBadRequest, api.CodeBadRequest, "missing record")
+		return
+	}
+	if req.Record.Control != api.Control_CONTROL_NONE {
+		writeError(w, r, http.StatusBadRequest, api.CodeBadRequest,
+			"control records are written by committing or aborting a transaction")
+		return
+	}
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
-}
+	off, err := s.Log.AppendContext(ctx, req.Record)
+	if err != nil {
+		span.RecordError(err)
+		logAppendError(ctx, err)
+		writeLogError(w, r, err)
+		return
+	}
+	span.SetAttributes(trace.Int64("log.offset", int64(off)))
+	requestLogger(ctx).Debug("produced record", "offset", off, "bytes", len(req.Record.Value))
 
-type ConsumeResponse struct {
-	Record Record `json:"record"`
+	writeMessage(w, r, &api.ProduceResponse{Offset: off})
 }
 
-func (s *httpServer) handle(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		s.handleConsume(w, r)
-	case http.MethodPost:
-		s.handleProduce(w, r)
+// handleProduceBatch appends the records in the body to the log, all of them
+// or none: POST /records/batch.
+func (s *httpServer) handleProduceBatch(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.startSpan(r.Context(), "server.handleProduceBatch")
+	defer span.End()
+	req := &api.ProduceBatchRequest{}
+	if err := readMessage(r, req); err != nil {
+		span.RecordError(err)
+		writeDecodeError(w, r, err)
+		return
+	}
+	if len(req.Records) == 0 {
+		writeError(w, r, http.StatusBadRequest, api.CodeBadRequest, "missing records")
+		return
+	}
+	size := 0
+	for i, record := range req.Records {
+		if record.Control != api.Control_CONTROL_NONE {
+			writeError(w, r, http.StatusBadRequest, api.CodeBadRequest,
+				fmt.Sprintf("record %d: control records are written by committing or aborting a transaction", i))
+			return
+		}
+		size += len(record.Value)
 	}
-}
 
-func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	offs, err := s.Log.AppendBatch(ctx, req.Records)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		span.RecordError(err)
+		logAppendError(ctx, err)
+		writeLogError(w, r, err)
 		return
 	}
+	span.SetAttributes(trace.Int("log.records", len(offs)))
+	requestLogger(ctx).Debug("produced records", "offset", offs[0], "records", len(offs), "bytes", size)
 
-	off, err := s.Log.Append(req.Record)
+	writeMessage(w, r, &api.ProduceBatchResponse{Offsets: offs})
+}
+
+// logAppendError logs why an append failed: as a warning if the log rejected
+// the records, and as an error otherwise.
+func logAppendError(ctx context.Context, err error) {
+	if errors.As(err, &api.ErrSequenceOutOfOrder{}) || errors.As(err, &api.ErrSequenceGap{}) ||
+		errors.As(err, &api.ErrTransactionNotFound{}) {
+		requestLogger(ctx).Warn("append rejected", "error", err)
+	} else {
+		requestLogger(ctx).Error("append failed", "error", err)
+	}
+}
+
+// handleConsume reads the record at an offset: GET /records/{offset}.
+//
+// With ?isolation=read_committed it returns the first record at or after the
+// offset that isn't a control record or part of an aborted transaction, and
+// nothing past the first record of a transaction that's still open. The
+// record's offset says where it was found.
+func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.startSpan(r.Context(), "server.handleConsume")
+	defer span.End()
+	offset, err := strconv.ParseUint(r.PathValue("offset"), 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, api.CodeBadRequest, "offset must be a non-negative integer")
 		return
 	}
-
-	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
+	read := s.Log.Read
+	switch isolation := r.URL.Query().Get("isolation"); isolation {
+	case "", "read_uncommitted":
+	case "read_committed":
+		read = s.Log.ReadCommitted
+	default:
+		writeError(w, r, http.StatusBadRequest, api.CodeBadRequest,
+			"isolation must be read_committed or read_uncommitted, not "+strconv.Quote(isolation))
+		return
+	}
+	span.SetAttributes(trace.Int64("log.offset", int64(offset)))
+	record, err := read(offset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			span.RecordError(err)
+			requestLogger(ctx).Error("read failed", "offset", offset, "error", err)
+		}
+		writeLogError(w, r, err)
 		return
 	}
-	// default code is OK
+	requestLogger(ctx).Debug("consumed record", "offset", offset, "bytes", len(record.Value))
+
+	writeMessage(w, r, &api.ConsumeResponse{Record: record})
 }
 
-func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	var req ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+// handleConsumeRaw streams the records from an offset on as the log stores
+// them, for consumers catching up: GET /records/{offset}/raw. The body is
+// described by writeRawRecords. ?max_bytes bounds the size of the records
+// sent, though at least one is; it defaults to defaultRawBytes.
+//
+// Records of encrypted or offloaded segments can't be sent raw and are
+// answered with 409 raw_unavailable; they have to be consumed one by one.
+func (s *httpServer) handleConsumeRaw(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.startSpan(r.Context(), "server.handleConsumeRaw")
+	defer span.End()
+	offset, err := strconv.ParseUint(r.PathValue("offset"), 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, api.CodeBadRequest, "offset must be a non-negative integer")
 		return
 	}
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	maxBytes := uint64(defaultRawBytes)
+	if v := r.URL.Query().Get("max_bytes"); v != "" {
+		if maxBytes, err = strconv.ParseUint(v, 10, 64); err != nil || maxBytes > maxRawBytes {
+			writeError(w, r, http.StatusBadRequest, api.CodeBadRequest,
+				fmt.Sprintf("max_bytes must be an integer up to %d", maxRawBytes))
+			return
+		}
+	}
+	span.SetAttributes(trace.Int64("log.offset", int64(offset)))
+	raw, err := s.Log.ReadRaw(offset, maxBytes)
+	if err != nil {
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) && !errors.Is(err, log.ErrRawUnavailable) {
+			span.RecordError(err)
+			requestLogger(ctx).Error("raw read failed", "offset", offset, "error", err)
+		}
+		writeLogError(w, r, err)
 		return
 	}
+	defer raw.Close()
+	span.SetAttributes(trace.Int64("log.records", int64(len(raw.Positions))))
+	if err = writeRawRecords(w, raw); err != nil {
+		// the status has been sent, so all that's left is to log it
+		span.RecordError(err)
+		requestLogger(ctx).Warn("raw response failed", "offset", offset, "error", err)
+		return
+	}
+	requestLogger(ctx).Debug("consumed raw records", "offset", offset,
+		"records", len(raw.Positions), "bytes", raw.Size)
+}
 
+// handleBeginTransaction opens a transaction: POST /transactions. Records are
+// produced to it by setting their transaction_id.
+func (s *httpServer) handleBeginTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.startSpan(r.Context(), "server.handleBeginTransaction")
+	defer span.End()
+	id, err := s.Log.BeginTransaction()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		requestLogger(ctx).Error("begin transaction failed", "error", err)
+		writeLogError(w, r, err)
 		return
 	}
+	requestLogger(ctx).Debug("began transaction", "transaction", id)
+
+	writeMessage(w, r, &api.BeginTransactionResponse{TransactionId: id})
+}
 
-	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+// handleEndTransaction commits or aborts a transaction:
+// POST /transactions/{id}/commit and POST /transactions/{id}/abort.
+func (s *httpServer) handleEndTransaction(commit bool) http.HandlerFunc {
+	name, end := "abort", s.Log.AbortTransaction
+	if commit {
+		name, end = "commit", s.Log.CommitTransaction
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := s.startSpan(r.Context(), "server.handleEndTransaction")
+		defer span.End()
+		id := r.PathValue("id")
+		span.SetAttributes(trace.String("log.transaction", id), trace.String("log.outcome", name))
+		off, err := end(id)
+		if err != nil {
+			span.RecordError(err)
+			if errors.As(err, &api.ErrTransactionNotFound{}) {
+				requestLogger(ctx).Warn(name+" rejected", "transaction", id, "error", err)
+			} else {
+				requestLogger(ctx).Error(name+" failed", "transaction", id, "error", err)
+			}
+			writeLogError(w, r, err)
+			return
+		}
+		requestLogger(ctx).Debug("ended transaction", "transaction", id, "outcome", name, "offset", off)
+
+		writeMessage(w, r, &api.EndTransactionResponse{Offset: off})
+	}
+}
+
+// handleOffsets returns the offsets of the first and last records in the
+// log: GET /offsets.
+func (s *httpServer) handleOffsets(w http.ResponseWriter, r *http.Request) {
+	lowest, err := s.Log.LowestOffset()
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	highest, err := s.Log.HighestOffset()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeLogError(w, r, err)
 		return
 	}
+
+	writeMessage(w, r, &api.OffsetsResponse{Lowest: lowest, Highest: highest})
 }
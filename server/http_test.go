@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/MRSharff/distributed-services-with-go/api/v1"
+	"github.com/MRSharff/distributed-services-with-go/log"
+)
+
+// testServer returns the handler of a server over a log in a fresh directory,
+// which also serves as the server's data dir.
+func testServer(t *testing.T) (http.Handler, *log.Log) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, clog.Remove()) })
+	return NewHTTPServer("", Config{CommitLog: clog, DataDir: dir}).Handler, clog
+}
+
+// serve makes a request of h with the given headers.
+func serve(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Add(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// requireError checks w is a JSON error response with the given status and
+// code.
+func requireError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	require.Equal(t, status, w.Code, w.Body.String())
+	require.Equal(t, api.ContentTypeJSON, w.Header().Get("Content-Type"))
+	res := &api.ErrorResponse{}
+	require.NoError(t, protojson.Unmarshal(w.Body.Bytes(), res))
+	require.Equal(t, code, res.Code)
+	require.NotEmpty(t, res.Message)
+}
+
+func TestRoutes(t *testing.T) {
+	h, clog := testServer(t)
+	_, err := clog.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	id, err := clog.BeginTransaction()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		method, target, body string
+		status               int
+		// code is the error code of a failed request, and allow the Allow
+		// header of a 405
+		code, allow string
+	}{
+		{method: "POST", target: "/records", body: `{"record":{"value":"aGVsbG8="}}`, status: 200},
+		{method: "POST", target: "/records", body: `{}`, status: 400, code: api.CodeBadRequest},
+		{method: "POST", target: "/records", body: `{"record":`, status: 400, code: api.CodeBadRequest},
+		{method: "GET", target: "/records", status: 405, code: api.CodeMethodNotAllowed, allow: "POST"},
+		{method: "POST", target: "/records/batch", body: `{"records":[{"value":"aGVsbG8="},{"value":"aGVsbG8="}]}`, status: 200},
+		{method: "POST", target: "/records/batch", body: `{"records":[]}`, status: 400, code: api.CodeBadRequest},
+		{method: "POST", target: "/records/batch", body: `{"records":[{"control":"CONTROL_COMMIT"}]}`, status: 400, code: api.CodeBadRequest},
+		{method: "POST", target: "/records/batch", body: `{"records":[{"producerId":"p","sequence":"0"},{"producerId":"p","sequence":"2"}]}`, status: 409, code: api.CodeSequenceGap},
+		{method: "GET", target: "/records/batch", status: 405, code: api.CodeMethodNotAllowed, allow: "POST"},
+		{method: "GET", target: "/records/0", status: 200},
+		{method: "HEAD", target: "/records/0", status: 200},
+		{method: "GET", target: "/records/9", status: 404, code: api.CodeOffsetOutOfRange},
+		{method: "GET", target: "/records/-1", status: 400, code: api.CodeBadRequest},
+		{method: "GET", target: "/records/0?isolation=dirty", status: 400, code: api.CodeBadRequest},
+		{method: "DELETE", target: "/records/0", status: 405, code: api.CodeMethodNotAllowed, allow: "GET, HEAD"},
+		{method: "GET", target: "/records/0/raw", status: 200},
+		{method: "GET", target: "/records/0/raw?max_bytes=x", status: 400, code: api.CodeBadRequest},
+		{method: "POST", target: "/records/0/raw", status: 405, code: api.CodeMethodNotAllowed, allow: "GET, HEAD"},
+		{method: "POST", target: "/transactions", status: 200},
+		{method: "GET", target: "/transactions", status: 405, code: api.CodeMethodNotAllowed, allow: "POST"},
+		{method: "POST", target: "/transactions/" + id + "/commit", status: 200},
+		{method: "POST", target: "/transactions/" + id + "/abort", status: 404, code: api.CodeTransactionNotFound},
+		{method: "POST", target: "/transactions/nope/commit", status: 404, code: api.CodeTransactionNotFound},
+		{method: "GET", target: "/transactions/nope/commit", status: 405, code: api.CodeMethodNotAllowed, allow: "POST"},
+		{method: "GET", target: "/offsets", status: 200},
+		{method: "PUT", target: "/offsets", status: 405, code: api.CodeMethodNotAllowed, allow: "GET, HEAD"},
+		{method: "GET", target: "/metrics", status: 200},
+		{method: "GET", target: "/healthz", status: 200},
+		{method: "GET", target: "/readyz", status: 200},
+		{method: "POST", target: "/readyz", status: 405, code: api.CodeMethodNotAllowed, allow: "GET, HEAD"},
+		// anything else falls through to "/"
+		{method: "GET", target: "/", status: 404, code: api.CodeNotFound},
+		{method: "GET", target: "/nope", status: 404, code: api.CodeNotFound},
+		{method: "GET", target: "/records/0/raw/more", status: 404, code: api.CodeNotFound},
+		{method: "POST", target: "/transactions/a/b/commit", status: 404, code: api.CodeNotFound},
+	} {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := serve(h, tt.method, tt.target, tt.body)
+			require.Equal(t, tt.allow, w.Header().Get("Allow"))
+			if tt.code == "" {
+				require.Equal(t, tt.status, w.Code, w.Body.String())
+				return
+			}
+			requireError(t, w, tt.status, tt.code)
+		})
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	h, clog := testServer(t)
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}
+	pb, err := proto.Marshal(req)
+	require.NoError(t, err)
+	js, err := protojson.Marshal(req)
+	require.NoError(t, err)
+	const (
+		jsonType  = api.ContentTypeJSON
+		protoType = api.ContentTypeProtobuf
+	)
+
+	produced := 0
+	for _, tt := range []struct {
+		name, contentType string
+		accept            []string
+		// want is the response's Content-Type, and code the error code of
+		// a failed request
+		want, code string
+	}{
+		{name: "json by default", want: jsonType},
+		{name: "like the request", contentType: protoType, want: protoType},
+		{name: "json with parameters", contentType: jsonType + "; charset=utf-8", want: jsonType},
+		{name: "accept protobuf", contentType: jsonType, accept: []string{protoType}, want: protoType},
+		{name: "accept json", contentType: protoType, accept: []string{jsonType}, want: jsonType},
+		{name: "accept anything", contentType: protoType, accept: []string{"*/*"}, want: protoType},
+		{name: "higher quality", accept: []string{jsonType + ";q=0.5, " + protoType}, want: protoType},
+		{name: "specific range wins", accept: []string{protoType + ";q=0.1, */*;q=0.5"}, want: jsonType},
+		{name: "excluded", accept: []string{"application/*;q=0.2, " + jsonType + ";q=0"}, want: protoType},
+		{name: "bad q ignored", accept: []string{protoType + ";q=x, " + jsonType}, want: jsonType},
+		{name: "several headers", accept: []string{"text/html", protoType}, want: protoType},
+		{name: "not acceptable", accept: []string{"text/html"}, want: jsonType, code: api.CodeNotAcceptable},
+		{name: "all excluded", accept: []string{"*/*;q=0"}, want: jsonType, code: api.CodeNotAcceptable},
+		{name: "unsupported", contentType: "text/plain", want: jsonType, code: api.CodeUnsupportedMediaType},
+		{name: "unparsable", contentType: ";;", want: jsonType, code: api.CodeUnsupportedMediaType},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var header []string
+			body := string(js)
+			if tt.contentType != "" {
+				header = append(header, "Content-Type", tt.contentType)
+				if tt.contentType == protoType {
+					body = string(pb)
+				}
+			}
+			for _, accept := range tt.accept {
+				header = append(header, "Accept", accept)
+			}
+			w := serve(h, http.MethodPost, "/records", body, header...)
+			require.Equal(t, tt.want, w.Header().Get("Content-Type"))
+			switch {
+			case tt.code == api.CodeNotAcceptable:
+				requireError(t, w, http.StatusNotAcceptable, tt.code)
+				return
+			case tt.code != "":
+				requireError(t, w, http.StatusUnsupportedMediaType, tt.code)
+				return
+			}
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			require.Equal(t, "Accept", w.Header().Get("Vary"))
+			res := &api.ProduceResponse{}
+			if tt.want == protoType {
+				require.NoError(t, proto.Unmarshal(w.Body.Bytes(), res))
+			} else {
+				require.NoError(t, protojson.Unmarshal(w.Body.Bytes(), res))
+			}
+			require.Equal(t, uint64(produced), res.Offset)
+			produced++
+		})
+	}
+
+	// nothing was appended for the requests that failed
+	highest, err := clog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(produced-1), highest)
+}
+
+// benchCodecs are the body formats the handler benchmarks run with.
+var benchCodecs = []struct {
+	name        string
+	contentType string
+	marshal     func(proto.Message) ([]byte, error)
+}{
+	{"protobuf", api.ContentTypeProtobuf, proto.Marshal},
+	{"json", api.ContentTypeJSON, protojson.Marshal},
+}
+
+// benchServer returns the handler of a server over a log in a fresh
+// directory.
+func benchServer(b *testing.B) (http.Handler, *log.Log) {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "server-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16 << 20
+	c.Segment.MaxIndexBytes = 12 << 20
+	clog, err := log.NewLog(dir, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { clog.Remove() })
+	return NewHTTPServer("", Config{CommitLog: clog}).Handler, clog
+}
+
+func BenchmarkProduce(b *testing.B) {
+	for _, codec := range benchCodecs {
+		for _, size := range []int{64, 1 << 10, 16 << 10} {
+			b.Run(fmt.Sprintf("%s/value=%dB", codec.name, size), func(b *testing.B) {
+				h, _ := benchServer(b)
+				body, err := codec.marshal(&api.ProduceRequest{Record: &api.Record{Value: make([]byte, size)}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+					req.Header.Set("Content-Type", codec.contentType)
+					req.Header.Set("Accept", codec.contentType)
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						b.Fatalf("produce returned %d: %s", w.Code, w.Body)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkConsume(b *testing.B) {
+	const records = 10000
+	for _, codec := range benchCodecs {
+		for _, size := range []int{64, 1 << 10, 16 << 10} {
+			b.Run(fmt.Sprintf("%s/value=%dB", codec.name, size), func(b *testing.B) {
+				h, clog := benchServer(b)
+				value := make([]byte, size)
+				for i := 0; i < records; i++ {
+					if _, err := clog.Append(&api.Record{Value: value}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/records/%d", i%records), nil)
+					req.Header.Set("Accept", codec.contentType)
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						b.Fatalf("consume returned %d: %s", w.Code, w.Body)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/MRSharff/distributed-services-with-go/trace"
+)
+
+// requestIDHeader carries a request's ID. The server uses the caller's ID if
+// the request has one, and generates one otherwise, so a request can be
+// followed from the client's logs to ours.
+const requestIDHeader = "X-Request-ID"
+
+// requestInfo is what logRequests keeps about a request while it's handled.
+type requestInfo struct {
+	// logger tags each line with the request's ID, and its trace ID once
+	// the handler has started a span.
+	logger *slog.Logger
+}
+
+type requestInfoKey struct{}
+
+// requestLogger returns the logger for the request handled with ctx.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.logger
+	}
+	return slog.Default()
+}
+
+// startSpan starts the span for the request handled with ctx and tags the
+// request's log lines with its trace ID.
+func (s *httpServer) startSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	ctx, span := s.tracer.Start(ctx, name)
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok && span != nil {
+		info.logger = info.logger.With("trace_id", span.SpanContext().TraceID.String())
+	}
+	return ctx, span
+}
+
+// logRequests wraps a handler to give each request an ID, pick up the trace
+// it belongs to from its traceparent header, and log it once it's handled.
+// Failed requests are logged as warnings, or errors if the server was at
+// fault.
+func logRequests(logger *slog.Logger, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := r.Context()
+		if sc, err := trace.ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+			ctx = trace.ContextWithRemoteParent(ctx, sc)
+		}
+		info := &requestInfo{logger: logger.With("request_id", id)}
+		ctx = context.WithValue(ctx, requestInfoKey{}, info)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		info.logger.Log(ctx, level, "handled request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	}
+}
+
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
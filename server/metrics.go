@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MRSharff/distributed-services-with-go/metrics"
+)
+
+// httpMetrics count the server's requests and how long they take.
+type httpMetrics struct {
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+func newHTTPMetrics(r *metrics.Registry) *httpMetrics {
+	return &httpMetrics{
+		requests: r.NewCounterVec(
+			"http_requests_total",
+			"HTTP requests handled, by handler, method and status code.",
+			"handler", "method", "code",
+		),
+		duration: r.NewHistogramVec(
+			"http_request_duration_seconds",
+			"Time taken to handle HTTP requests, by handler and method.",
+			metrics.DefBuckets,
+			"handler", "method",
+		),
+	}
+}
+
+// instrument wraps a handler so its requests are counted and timed.
+func (m *httpMetrics) instrument(name string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		m.requests.With(name, r.Method, strconv.Itoa(rec.status)).Inc()
+		m.duration.With(name, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers the status code a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom hands io.Copy on to the ResponseWriter's ReadFrom, which copies
+// from a file to the connection with sendfile.
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{r.ResponseWriter}, src)
+}
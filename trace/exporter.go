@@ -0,0 +1,214 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans somewhere they can be looked at. The tracer
+// calls Export from a single goroutine.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// WriterExporter writes each span as a line of JSON, e.g. to stdout.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// jsonSpan is how WriterExporter writes a span.
+type jsonSpan struct {
+	Name          string                 `json:"name"`
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+	Start         time.Time              `json:"start"`
+	DurationMS    float64                `json:"duration_ms"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	Status        string                 `json:"status,omitempty"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+}
+
+var statusNames = map[StatusCode]string{StatusOK: "ok", StatusError: "error"}
+
+func (e *WriterExporter) Export(spans []SpanData) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, s := range spans {
+		js := jsonSpan{
+			Name:          s.Name,
+			TraceID:       s.SpanContext.TraceID.String(),
+			SpanID:        s.SpanContext.SpanID.String(),
+			Start:         s.Start,
+			DurationMS:    float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Status:        statusNames[s.Status],
+			StatusMessage: s.StatusMessage,
+		}
+		if s.Parent.SpanID.IsValid() {
+			js.ParentSpanID = s.Parent.SpanID.String()
+		}
+		if len(s.Attributes) > 0 {
+			js.Attributes = make(map[string]interface{}, len(s.Attributes))
+			for _, a := range s.Attributes {
+				js.Attributes[a.Key] = a.Value
+			}
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(b.Bytes())
+	return err
+}
+
+// DefaultOTLPEndpoint is where an OpenTelemetry collector running locally
+// accepts traces over HTTP.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// OTLPConfig configures an OTLPExporter. Zero values get the defaults noted
+// on each field.
+type OTLPConfig struct {
+	// Endpoint is the collector's traces URL. Defaults to
+	// DefaultOTLPEndpoint.
+	Endpoint string
+	// ServiceName is reported as the service.name resource attribute.
+	// Defaults to "log".
+	ServiceName string
+	// Client is the HTTP client used for requests. Defaults to a client with
+	// a 10s timeout.
+	Client *http.Client
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP's JSON
+// encoding over HTTP.
+type OTLPExporter struct {
+	config OTLPConfig
+}
+
+func NewOTLPExporter(c OTLPConfig) *OTLPExporter {
+	if c.Endpoint == "" {
+		c.Endpoint = DefaultOTLPEndpoint
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "log"
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OTLPExporter{config: c}
+}
+
+// The OTLP request body, as described by the opentelemetry-proto repo's
+// trace service. 64-bit integers are encoded as strings and IDs as hex.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/MRSharff/distributed-services-with-go"}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.SpanContext.TraceID.String(),
+			SpanID:            s.SpanContext.SpanID.String(),
+			Name:              s.Name,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent.SpanID.IsValid() {
+			span.ParentSpanID = s.Parent.SpanID.String()
+		}
+		for _, a := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttribute(a))
+		}
+		if s.Status != StatusUnset {
+			span.Status = &otlpStatus{Code: int(s.Status), Message: s.StatusMessage}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttribute(String("service.name", e.config.ServiceName)),
+		}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := e.config.Client.Post(e.config.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("trace: collector returned %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+func otlpAttribute(a Attribute) otlpKeyValue {
+	var v map[string]interface{}
+	switch value := a.Value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpKeyValue{Key: a.Key, Value: v}
+}
@@ -0,0 +1,347 @@
+// Package trace records spans, the timed operations that make up a request,
+// in the style of OpenTelemetry, and exports them as JSON lines or to a
+// collector that accepts OTLP over HTTP.
+//
+// Like the metrics package it covers only the part of OpenTelemetry we need,
+// without pulling in the SDK.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace, the tree of spans making up one request.
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext is what a child span needs to know about its parent, and what
+// gets passed between processes in the traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// ErrBadTraceparent is returned when parsing a malformed traceparent header.
+var ErrBadTraceparent = errors.New("trace: malformed traceparent")
+
+// ParseTraceparent parses a W3C Trace Context traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, ErrBadTraceparent
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, ErrBadTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+	if !sc.IsValid() {
+		return sc, ErrBadTraceparent
+	}
+	return sc, nil
+}
+
+// Traceparent formats the span context as a traceparent header. We record
+// every span, so the sampled flag is always set.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-01"
+}
+
+// Attribute is a key-value pair describing a span. Value is a string, int64,
+// float64 or bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+func Int64(key string, value int64) Attribute { return Attribute{key, value} }
+
+func Int(key string, value int) Attribute { return Attribute{key, int64(value)} }
+
+func Float64(key string, value float64) Attribute { return Attribute{key, value} }
+
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// StatusCode says whether a span's operation failed. It's unset unless an
+// error was recorded.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+// SpanData is a finished span, as handed to an Exporter.
+type SpanData struct {
+	Name          string
+	SpanContext   SpanContext
+	Parent        SpanContext
+	Start, End    time.Time
+	Attributes    []Attribute
+	Status        StatusCode
+	StatusMessage string
+}
+
+// Span is an operation being timed. A nil *Span records nothing, so code can
+// always call a span's methods whether or not the request is being traced.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the span's IDs, or the zero SpanContext for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// RecordError marks the span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status = StatusError
+	s.data.StatusMessage = err.Error()
+}
+
+// End finishes the span and queues it for export. Calls after the first are
+// ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.export(data)
+}
+
+type spanKey struct{}
+
+type remoteParentKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, so spans started from
+// it become its children.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent returns a copy of ctx carrying a parent span from
+// another process, usually parsed from a traceparent header, so the next
+// span started from it joins that trace.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentKey{}, sc)
+}
+
+// Start starts a child of the span carried by ctx, using that span's tracer.
+// If ctx carries no span, nothing is being traced and Start returns ctx and a
+// nil span. It lets packages like log add spans to a trace without being
+// handed a tracer.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name)
+}
+
+// TracerConfig configures a Tracer. Zero values get the defaults noted on
+// each field.
+type TracerConfig struct {
+	// Exporter is where finished spans are sent.
+	Exporter Exporter
+	// BatchSize is the most spans passed to one Export call. Defaults to 256.
+	BatchSize int
+	// BatchTimeout is the longest a finished span waits to be exported.
+	// Defaults to 1s.
+	BatchTimeout time.Duration
+	// QueueSize is the most finished spans waiting to be exported; spans
+	// finished while the queue is full are dropped rather than slowing down
+	// the traced code. Defaults to 2048.
+	QueueSize int
+	// OnError is called with errors returned by the exporter. They're
+	// ignored if it's nil.
+	OnError func(error)
+}
+
+// Tracer starts spans and exports them in batches from a background
+// goroutine. A nil *Tracer starts no spans.
+type Tracer struct {
+	config TracerConfig
+	queue  chan SpanData
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func NewTracer(c TracerConfig) *Tracer {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 256
+	}
+	if c.BatchTimeout <= 0 {
+		c.BatchTimeout = time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 2048
+	}
+	t := &Tracer{
+		config: c,
+		queue:  make(chan SpanData, c.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a span. It's a child of the span or remote parent carried by
+// ctx, or the root of a new trace if there's neither. The returned context
+// carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.SpanContext()
+	} else if sc, ok := ctx.Value(remoteParentKey{}).(SpanContext); ok {
+		parent = sc
+	}
+	span := &Span{tracer: t}
+	span.data.Name = name
+	span.data.Parent = parent
+	span.data.Start = time.Now()
+	if parent.IsValid() {
+		span.data.SpanContext.TraceID = parent.TraceID
+	} else {
+		randomID(span.data.SpanContext.TraceID[:])
+	}
+	randomID(span.data.SpanContext.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+func randomID(b []byte) {
+	// crypto/rand doesn't fail on the platforms we run on, and an ID that's
+	// all zeros would only make the span invalid.
+	_, _ = rand.Read(b)
+}
+
+func (t *Tracer) export(data SpanData) {
+	if t == nil {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- data:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.config.BatchTimeout)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, t.config.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.config.Exporter.Export(batch); err != nil && t.config.OnError != nil {
+			t.config.OnError(err)
+		}
+		batch = make([]SpanData, 0, t.config.BatchSize)
+	}
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) == t.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close exports the spans that have finished and stops the tracer. Spans
+// ending afterwards are dropped.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	<-t.done
+	return nil
+}
@@ -0,0 +1,164 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is an Exporter that keeps the spans it's given.
+type recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recorder) Export(spans []SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	rec := &recorder{}
+	tracer := NewTracer(TracerConfig{Exporter: rec})
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := Start(ctx, "child")
+	child.SetAttributes(Int("offset", 3), String("segment", "0.store"))
+	child.RecordError(errors.New("boom"))
+	child.End()
+	root.End()
+	root.End()
+	require.NoError(t, tracer.Close())
+
+	require.Len(t, rec.spans, 2)
+	c, r := rec.spans[0], rec.spans[1]
+	require.Equal(t, "child", c.Name)
+	require.Equal(t, "root", r.Name)
+	require.True(t, r.SpanContext.IsValid())
+	require.False(t, r.Parent.IsValid())
+	require.Equal(t, r.SpanContext.TraceID, c.SpanContext.TraceID)
+	require.Equal(t, r.SpanContext, c.Parent)
+	require.Equal(t, []Attribute{{"offset", int64(3)}, {"segment", "0.store"}}, c.Attributes)
+	require.Equal(t, StatusError, c.Status)
+	require.Equal(t, "boom", c.StatusMessage)
+	require.False(t, r.End.Before(c.End))
+
+	// spans ending after Close are dropped
+	_, late := tracer.Start(context.Background(), "late")
+	late.End()
+	require.Len(t, rec.spans, 2)
+}
+
+func TestUntraced(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "root")
+	require.Nil(t, span)
+	ctx, span = Start(ctx, "child")
+	require.Nil(t, span)
+	require.Nil(t, SpanFromContext(ctx))
+	span.SetAttributes(Int("offset", 1))
+	span.RecordError(errors.New("boom"))
+	span.End()
+	require.NoError(t, tracer.Close())
+}
+
+func TestTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	require.NoError(t, err)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	require.Equal(t, header, sc.Traceparent())
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, err = ParseTraceparent(bad)
+		require.Equal(t, ErrBadTraceparent, err, bad)
+	}
+
+	rec := &recorder{}
+	tracer := NewTracer(TracerConfig{Exporter: rec})
+	_, span := tracer.Start(ContextWithRemoteParent(context.Background(), sc), "handle")
+	span.End()
+	require.NoError(t, tracer.Close())
+	require.Equal(t, sc.TraceID, rec.spans[0].SpanContext.TraceID)
+	require.Equal(t, sc, rec.spans[0].Parent)
+}
+
+func TestWriterExporter(t *testing.T) {
+	var b bytes.Buffer
+	tracer := NewTracer(TracerConfig{Exporter: NewWriterExporter(&b)})
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := Start(ctx, "child")
+	child.SetAttributes(Int("offset", 3))
+	child.End()
+	root.End()
+	require.NoError(t, tracer.Close())
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 2)
+	var span map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &span))
+	require.Equal(t, "child", span["name"])
+	require.Equal(t, root.SpanContext().TraceID.String(), span["trace_id"])
+	require.Equal(t, root.SpanContext().SpanID.String(), span["parent_span_id"])
+	require.Equal(t, map[string]interface{}{"offset": float64(3)}, span["attributes"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(b, &got))
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(OTLPConfig{Endpoint: srv.URL + "/v1/traces", ServiceName: "test"})
+	tracer := NewTracer(TracerConfig{Exporter: e})
+	_, span := tracer.Start(context.Background(), "append")
+	span.SetAttributes(Int("offset", 7), Bool("rolled", true))
+	span.RecordError(errors.New("boom"))
+	span.End()
+	require.NoError(t, tracer.Close())
+
+	require.Len(t, got.ResourceSpans, 1)
+	rs := got.ResourceSpans[0]
+	require.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	require.Equal(t, "test", rs.Resource.Attributes[0].Value["stringValue"])
+	s := rs.ScopeSpans[0].Spans[0]
+	require.Equal(t, "append", s.Name)
+	require.Equal(t, span.SpanContext().TraceID.String(), s.TraceID)
+	require.Equal(t, "7", s.Attributes[0].Value["intValue"])
+	require.Equal(t, true, s.Attributes[1].Value["boolValue"])
+	require.Equal(t, &otlpStatus{Code: 2, Message: "boom"}, s.Status)
+
+	var exportErr error
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	tracer = NewTracer(TracerConfig{Exporter: e, OnError: func(err error) { exportErr = err }})
+	_, span = tracer.Start(context.Background(), "append")
+	span.End()
+	require.NoError(t, tracer.Close())
+	require.EqualError(t, exportErr, "trace: collector returned 503 Service Unavailable: unavailable")
+}